@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"golang.org/x/net/context"
+)
+
+/*
+POST /api/admin/certifiedKey - upload a public key carrying a certification from the organization key
+<body should be an armored GPG key>
+
+If the key is already known, its stored form is replaced (keeping its owner);
+otherwise it is added as an external key.
+*/
+func handlePostCertifiedKey(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	store := StoreFromContext(ctx)
+	if !isAdmin(ctx) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if org, err := orgKey(ctx); err != nil {
+		rlog(ctx, "Could not load organization key: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if org == nil {
+		http.Error(rw, "no organization key configured", http.StatusBadRequest)
+		return
+	} else if b, err := ioutil.ReadAll(r.Body); err != nil {
+		rlog(ctx, "Could not read entire request body: ", err)
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	} else if key, err := readSingleKey(b); err != nil {
+		http.Error(rw, fmt.Sprintf("malformed key: %v", err), http.StatusBadRequest)
+		return
+	} else if err := certifiedBy(key, org); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if keyID := key.PrimaryKey.KeyIdString(); false {
+	} else if _, armored, err := store.GetPublicKey(keyID); err == sql.ErrNoRows {
+		if err := store.AddExternalPublicKey(keyID, b); err != nil {
+			rlog(ctx, "Could not add public key: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(rw, r, path.Join("/api/publicKey", keyID), http.StatusCreated)
+	} else if err != nil {
+		rlog(ctx, "Could not query public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if old, err := readSingleKey(armored); err == nil && !bytes.Equal(old.PrimaryKey.Fingerprint[:], key.PrimaryKey.Fingerprint[:]) {
+		http.Error(rw, "mismatching keys", http.StatusBadRequest)
+		return
+	} else if err := store.PutPublicKey(keyID, b); err != nil {
+		rlog(ctx, "Could not update public key: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		http.Redirect(rw, r, path.Join("/api/publicKey", keyID), http.StatusCreated)
+	}
+}
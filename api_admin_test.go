@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"goji.io/pat"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestHandlePostCertifiedKey(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Post("/api/admin/certifiedKey"), handlePostCertifiedKey)
+	db := StoreFromContext(h.ctx)
+	admin := UserFromContext(h.ctx)
+	other, otherKey := h.addUser("other")
+	post := func(body []byte) *httptest.ResponseRecorder {
+		r, err := http.NewRequest("POST", "/api/admin/certifiedKey", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		h.mux.ServeHTTPC(h.ctx, rw, r)
+		return rw
+	}
+	key, err := openpgp.NewEntity("external", "", "external@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := key.PrimaryKey.KeyIdString()
+
+	config := ConfigFromContext(h.ctx)
+	config.Admins = []string{"tolar2"}
+	h.ctx = ContextWithConfig(h.ctx, config)
+	if rw := post(armorForTest(t, key)); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST without an organization key: %d %s", rw.Code, rw.Body)
+	}
+	org := trustForTest(t, h)
+	if rw := post(armorForTest(t, key)); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of an uncertified key: %d %s", rw.Code, rw.Body)
+	} else if _, _, err := db.GetPublicKey(keyID); err == nil {
+		t.Error("POST of an uncertified key added it")
+	}
+	certifyForTest(t, key, org)
+	if rw := post([]byte("not a key")); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of a malformed key: %d %s", rw.Code, rw.Body)
+	}
+	h.as(other)
+	if rw := post(armorForTest(t, key)); rw.Code != http.StatusForbidden {
+		t.Errorf("POST by a non-admin: %d %s", rw.Code, rw.Body)
+	} else if _, _, err := db.GetPublicKey(keyID); err != sql.ErrNoRows {
+		t.Errorf("POST by a non-admin added the key: %v", err)
+	}
+	h.as(admin)
+	if rw := post(armorForTest(t, key)); rw.Code != http.StatusCreated {
+		t.Errorf("POST of a certified key: %d %s", rw.Code, rw.Body)
+	} else if _, armored, err := db.GetPublicKey(keyID); err != nil {
+		t.Fatal(err)
+	} else if stored, err := readSingleKey(armored); err != nil {
+		t.Fatal(err)
+	} else if err := certifiedBy(stored, org); err != nil {
+		t.Errorf("The stored key lost its certification: %v", err)
+	}
+
+	// the keys of users are replaced, keeping their owner
+	certifyForTest(t, otherKey, org)
+	if rw := post(armorForTest(t, otherKey)); rw.Code != http.StatusCreated {
+		t.Errorf("POST of a certified key of a user: %d %s", rw.Code, rw.Body)
+	} else if owner, armored, err := db.GetPublicKey(otherKey.PrimaryKey.KeyIdString()); err != nil || owner != "other" {
+		t.Errorf("The key of a user belongs to %q: %v", owner, err)
+	} else if stored, err := readSingleKey(armored); err != nil {
+		t.Fatal(err)
+	} else if err := certifiedBy(stored, org); err != nil {
+		t.Errorf("The stored key of a user wasn't replaced: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// attachmentsSuffix replaces the .gpg of an entry in the name of the
+	// directory its attachments are kept in, next to it.
+	attachmentsSuffix = ".attachments"
+
+	defaultMaxAttachmentSize = 32 << 20
+)
+
+// attachmentDir returns the directory of the attachments of the entry p.
+func attachmentDir(p string) string {
+	return strings.TrimSuffix(cleanPassPath(p), ".gpg") + attachmentsSuffix
+}
+
+// isAttachmentDir checks if p is the directory of the attachments of an
+// entry, which must exist next to it. Other directories named like it (e.g.
+// made with pass) are listed like any directory.
+func isAttachmentDir(tx PassTx, p string) bool {
+	p = cleanPassPath(p)
+	if !strings.HasSuffix(p, attachmentsSuffix) {
+		return false
+	}
+	exists, isFile := tx.Type(strings.TrimSuffix(p, attachmentsSuffix) + ".gpg")
+	return exists && isFile
+}
+
+// withAttachments returns p and, if it's an entry with attachments, their
+// directory.
+func withAttachments(tx PassTx, p string) []string {
+	ret := []string{cleanPassPath(p)}
+	if exists, isFile := tx.Type(p); exists && isFile {
+		if exists, isFile := tx.Type(attachmentDir(p)); exists && !isFile {
+			ret = append(ret, attachmentDir(p))
+		}
+	}
+	return ret
+}
+
+// listAttachments returns the names of the attachments of the entry p.
+func listAttachments(tx PassTx, p string) ([]string, error) {
+	names := []string{}
+	if exists, isFile := tx.Type(attachmentDir(p)); !exists || isFile {
+		return names, nil
+	} else if l, err := tx.List(attachmentDir(p)); err != nil {
+		return nil, err
+	} else {
+		for _, d := range l {
+			if d.File && strings.HasSuffix(d.Name, ".gpg") {
+				names = append(names, d.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// snapshotWithAttachments is snapshotSubtree, also taking in the
+// attachments of p if it's an entry.
+func snapshotWithAttachments(tx PassTx, p string) (passSnapshot, error) {
+	snap := passSnapshot{recipients: make(map[string][]string)}
+	for _, d := range withAttachments(tx, p) {
+		s, err := snapshotSubtree(tx, d)
+		if err != nil {
+			return snap, err
+		}
+		snap.files = append(snap.files, s.files...)
+		for dir, r := range s.recipients {
+			snap.recipients[dir] = r
+		}
+	}
+	return snap, nil
+}
+
+func maxAttachmentSize(ctx context.Context) int64 {
+	if size := ConfigFromContext(ctx).Attachments.MaxSize; size > 0 {
+		return size
+	}
+	return defaultMaxAttachmentSize
+}
+
+// attachmentPath returns the entry and the path in the store of the
+// attachment that a request to a mounted attachment endpoint is for.
+func attachmentPath(ctx context.Context) (string, string, error) {
+	p := passPath(ctx)
+	entry, name := path.Dir(p), path.Base(p)
+	if err := validatePassPath(entry, passPathFile); err != nil {
+		return "", "", err
+	} else if err := validatePassPath(name, passPathFile); err != nil {
+		return "", "", err
+	}
+	return cleanPassPath(entry), path.Join(attachmentDir(entry), name), nil
+}
+
+// openFile opens p, streaming it from stores that can.
+func openFile(tx PassTx, p string) (io.ReadCloser, error) {
+	if sr, ok := tx.(PassStreamReader); ok {
+		return sr.Open(p)
+	} else if c, err := tx.Get(p); err != nil {
+		return nil, err
+	} else {
+		return ioutil.NopCloser(bytes.NewReader(c)), nil
+	}
+}
+
+// putFile writes p from r, streaming it to stores that can.
+func putFile(tx PassTxW, p string, r io.Reader, limit int64) error {
+	if sw, ok := tx.(PassStreamWriter); ok {
+		return sw.PutStream(p, r, limit)
+	} else if c, err := ioutil.ReadAll(io.LimitReader(r, limit+1)); err != nil {
+		return err
+	} else if int64(len(c)) > limit {
+		return ErrTooLarge
+	} else {
+		tx.Put(p, c)
+		return nil
+	}
+}
+
+/*
+GET /api/attachment/* - download an attachment of a password
+<response is the encrypted file, as application/octet-stream>
+
+The path is that of the password followed by the name of the attachment,
+which ends in .gpg like the password's, e.g.
+/api/attachment/path/to/file.gpg/name.gpg. The names of the attachments of a
+password are listed by GET /api/pass/*. Attachments are kept in the directory
+<password minus .gpg>.attachments next to the password, and share its
+recipients.
+
+The ETag header identifies the current version of the attachment, for use with
+If-Match when changing it.
+*/
+func handleGetAttachment(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	ps := PassFromContext(ctx)
+	if _, p, err := attachmentPath(ctx); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.Begin(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, isFile := tx.Type(p); !exists || !isFile {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if f, err := openFile(tx, p); err != nil {
+		rlog(ctx, "Could not open attachment: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		defer f.Close()
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		setETag(rw, tx, p)
+		if _, err := io.Copy(rw, f); err != nil {
+			rlog(ctx, "Could not send attachment: ", err)
+		}
+	}
+}
+
+/*
+POST /api/attachment/* - attach a file to a password, or replace an attachment
+<body should be the encrypted file, as application/octet-stream>
+
+Like the password, the attachment must be encrypted to the recipients of its
+directory. Attachments larger than Attachments.MaxSize in the configuration
+(32 MiB by default) are refused with 413 Request Entity Too Large. Honors
+If-Match like POST /api/pass/*.
+*/
+func handlePostAttachment(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	ps := PassFromContext(ctx)
+	u := UserFromContext(ctx)
+	limit := maxAttachmentSize(ctx)
+	if entry, p, err := attachmentPath(ctx); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if r.ContentLength > limit {
+		http.Error(rw, "attachment too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, isFile := tx.Type(entry); !exists || !isFile {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if exists, isFile := tx.Type(p); exists && !isFile {
+		http.Error(rw, "can't overwrite a directory", http.StatusBadRequest)
+		return
+	} else if !ifMatch(r, tx, p) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
+		rlog(ctx, "Could not get public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if recipients, err := tx.Recipients(p); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !containsAny(recipients, uPubKeyIDs) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if err := putFile(tx, p, r.Body, limit); err == ErrTooLarge {
+		http.Error(rw, "attachment too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if verr, ok := err.(VerifyError); ok {
+		http.Error(rw, verr.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not write attachment: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if err := tx.Commit(commitInfo(ctx, OpAttach, "Attached "+path.Base(p)+" to "+entry+".")); err != nil {
+		commitError(ctx, rw, err)
+		return
+	}
+}
+
+/*
+DELETE /api/attachment/* - remove an attachment from a password
+
+Honors If-Match like POST /api/pass/*.
+*/
+func handleDeleteAttachment(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	ps := PassFromContext(ctx)
+	u := UserFromContext(ctx)
+	if _, p, err := attachmentPath(ctx); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, isFile := tx.Type(p); !exists || !isFile {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if !ifMatch(r, tx, p) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
+		rlog(ctx, "Could not get public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if recipients, err := tx.Recipients(p); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !containsAny(recipients, uPubKeyIDs) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else {
+		tx.Delete(p)
+		if err := tx.Commit(commitInfo(ctx, OpDelete, "Removed "+p+" from store.")); err != nil {
+			commitError(ctx, rw, err)
+			return
+		}
+	}
+}
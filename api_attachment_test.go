@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"goji.io/pat"
+)
+
+func TestHandleAttachment(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Post("/api/move"), handlePostMove)
+	var config Config
+	config.Attachments.MaxSize = 4096
+	h.ctx = ContextWithConfig(h.ctx, config)
+	raw := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/octet-stream")
+		rw := httptest.NewRecorder()
+		h.mux.ServeHTTPC(h.ctx, rw, r)
+		return rw
+	}
+	pw, att := encryptForTest(t, "password"), encryptForTest(t, "attachment")
+
+	if rw := raw("POST", "/api/attachment/dir/a.gpg/file.gpg", att); rw.Code != http.StatusNotFound {
+		t.Errorf("POST to a missing entry: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/dir/a.gpg", struct {
+		Contents []byte `json:"contents"`
+	}{pw}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rw.Code, rw.Body)
+	} else if rw := raw("POST", "/api/attachment/dir/a.gpg/file.gpg", att); rw.Code != http.StatusOK {
+		t.Fatalf("POST of an attachment: %d %s", rw.Code, rw.Body)
+	} else if rw := raw("POST", "/api/attachment/dir/a.gpg/plain.gpg", []byte("plain")); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of an unencrypted attachment: %d %s", rw.Code, rw.Body)
+	} else if rw := raw("POST", "/api/attachment/dir/a.gpg/large.gpg", bytes.Repeat(att, 4096/len(att)+1)); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST of an attachment over the limit: %d %s", rw.Code, rw.Body)
+	} else if rw := raw("POST", "/api/attachment/dir/a.gpg/file", att); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of an attachment not named .gpg: %d %s", rw.Code, rw.Body)
+	} else if rw := raw("GET", "/api/attachment/dir/a.gpg/file.gpg", nil); rw.Code != http.StatusOK || !bytes.Equal(rw.Body.Bytes(), att) {
+		t.Errorf("GET of an attachment: %d", rw.Code)
+	} else if ct := rw.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("GET of an attachment returned %s", ct)
+	}
+
+	var file struct {
+		Attachments []string `json:"attachments"`
+	}
+	var dir struct {
+		Children []struct {
+			Name string `json:"name"`
+		} `json:"children"`
+	}
+	if rw := h.do("GET", "/api/pass/dir/a.gpg", nil, &file); rw.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", rw.Code, rw.Body)
+	} else if len(file.Attachments) != 1 || file.Attachments[0] != "file.gpg" {
+		t.Errorf("GET listed attachments %q", file.Attachments)
+	} else if rw := h.do("GET", "/api/pass/dir", nil, &dir); rw.Code != http.StatusOK {
+		t.Fatalf("GET of a directory: %d %s", rw.Code, rw.Body)
+	} else if len(dir.Children) != 1 {
+		t.Errorf("GET of a directory listed %+v", dir.Children)
+	}
+	// directories named like attachments are listed without their entry
+	if tx, err := h.ps.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.Put("dir/notes.attachments/c.gpg", pw)
+		if err := tx.Commit(CommitInfo{Message: "Add directory"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rw := h.do("GET", "/api/pass/dir", nil, &dir); rw.Code != http.StatusOK {
+		t.Fatalf("GET of a directory: %d %s", rw.Code, rw.Body)
+	} else if len(dir.Children) != 2 || dir.Children[1].Name != "notes.attachments" {
+		t.Errorf("GET of a directory with a directory named like attachments listed %+v", dir.Children)
+	}
+
+	// attachments move and get deleted with their entry
+	if rw := h.do("POST", "/api/move", map[string]string{"from": "dir/a.gpg", "to": "b.gpg"}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Move: %d %s", rw.Code, rw.Body)
+	} else if rw := raw("GET", "/api/attachment/dir/a.gpg/file.gpg", nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of a moved attachment at its old path: %d", rw.Code)
+	} else if rw := raw("GET", "/api/attachment/b.gpg/file.gpg", nil); rw.Code != http.StatusOK || !bytes.Equal(rw.Body.Bytes(), att) {
+		t.Errorf("GET of a moved attachment: %d", rw.Code)
+	} else if rw := h.do("DELETE", "/api/pass/b.gpg?dryRun=true", nil, nil); rw.Code != http.StatusOK || !bytes.Contains(rw.Body.Bytes(), []byte("b.attachments/file.gpg")) {
+		t.Errorf("Dry run: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("DELETE", "/api/pass/b.gpg", nil, nil); rw.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", rw.Code, rw.Body)
+	} else if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if exists, _ := tx.Type("b.attachments"); exists {
+		t.Error("DELETE left the attachments of the entry")
+	}
+}
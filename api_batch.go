@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// maxBatchOperations limits the size of a POST /api/batch request.
+const maxBatchOperations = 1000
+
+// batchOperation is a single change in a POST /api/batch request.
+type batchOperation struct {
+	Op         string   `json:"op"`
+	Path       string   `json:"path"`
+	Contents   []byte   `json:"contents"`
+	Recipients []string `json:"recipients"`
+	Recursive  bool     `json:"recursive"`
+	IfMatch    string   `json:"ifMatch"`
+}
+
+type batchResult struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+/*
+POST /api/batch - make several changes in a single commit
+{
+	"operations": [
+		{
+			"op": "put",
+			"path": "full/path/to/file",
+			"contents": "full file contents, base64 encoded",
+			"ifMatch": "ETag from GET /api/pass/* (optional)"
+		},
+		{
+			"op": "delete",
+			"path": "full/path/to/file/or/directory",
+			"recursive": true,
+			"ifMatch": "ETag from GET /api/pass/* (optional)"
+		},
+		{
+			"op": "setRecipients",
+			"path": "full/path/to/directory",
+			"recipients": ["list","of","key","ids"],
+			"ifMatch": "ETag from GET /api/passPerm/* (optional)"
+		}
+	],
+	"message": "commit message"
+}
+
+Each operation is checked like the request for it alone would be (POST and
+DELETE /api/pass/*, POST /api/passPerm/*), as if it were made right after the
+operations before it; ETags are compared with the store as it was before the
+batch. Files that must be reencrypted when setting recipients are put by
+operations of the same batch.
+
+Either every operation is committed, or none is, so no operation may be in a
+mount. The response lists the status of each operation, in order:
+{
+	"error": "the first error, if any",
+	"results": [
+		{
+			"path": "path of the operation",
+			"status": 200,
+			"error": "why the operation failed, if it did"
+		}
+	]
+}
+If any operation fails, the response has its status, and the operations that
+would have succeeded have status 424 Failed Dependency. A concurrent change to
+the same paths results in 409 Conflict, without results.
+*/
+func handlePostBatch(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	ps := PassFromContext(ctx)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "invalid JSON", http.StatusBadRequest)
+		return
+	} else if msg := req.check(); msg != "" {
+		http.Error(rw, msg, http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if status, response, err := applyBatch(ctx, tx, req.Operations); err != nil {
+		rlog(ctx, "Could not apply batch operation: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		if status == http.StatusOK {
+			if err := tx.Commit(commitInfo(ctx, OpBatch, req.message())); err != nil {
+				verr, ok := err.(VerifyError)
+				if !ok {
+					commitError(ctx, rw, err)
+					return
+				}
+				status = response.blame(req.Operations, verr)
+			}
+		}
+		renderBatch(ctx, rw, status, response)
+	}
+}
+
+// batchRequest is the body of a POST /api/batch request.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+	Message    string           `json:"message"`
+}
+
+// check returns why the request can't be made, if it can't.
+func (req batchRequest) check() string {
+	if len(req.Operations) == 0 {
+		return "no operations"
+	} else if len(req.Operations) > maxBatchOperations {
+		return fmt.Sprintf("too many operations (at most %d)", maxBatchOperations)
+	}
+	return ""
+}
+
+// message returns the commit message of the request.
+func (req batchRequest) message() string {
+	if req.Message == "" {
+		return fmt.Sprintf("Made %d changes.", len(req.Operations))
+	}
+	return req.Message
+}
+
+// paths returns the paths of the operations of the request.
+func (req batchRequest) paths() []string {
+	paths := make([]string, len(req.Operations))
+	for i, op := range req.Operations {
+		paths[i] = op.Path
+	}
+	return paths
+}
+
+type batchResponse struct {
+	Error   string        `json:"error,omitempty"`
+	Results []batchResult `json:"results"`
+}
+
+// blame records that committing the operations failed because of verr,
+// blaming the operations on the offending path if there are any, and returns
+// the status of the response.
+func (response *batchResponse) blame(ops []batchOperation, verr VerifyError) int {
+	response.Error = verr.Error()
+	for i, op := range ops {
+		if cleanPassPath(op.Path) == cleanPassPath(verr.Path) {
+			response.Results[i].Status = http.StatusBadRequest
+			response.Results[i].Error = verr.Reason
+		}
+	}
+	return http.StatusBadRequest
+}
+
+// applyBatch makes the operations in tx, and returns the status and response
+// of POST /api/batch for them. tx must not have been changed yet.
+func applyBatch(ctx context.Context, tx PassTxW, ops []batchOperation) (int, batchResponse, error) {
+	var response batchResponse
+	uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(UserFromContext(ctx).ID)
+	if err != nil {
+		return 0, response, err
+	}
+
+	// the transaction only shows the store before the batch until the first
+	// change
+	matched := make([]bool, len(ops))
+	for i, op := range ops {
+		matched[i] = matchETags(op.IfMatch, tx, op.Path)
+	}
+
+	status := http.StatusOK
+	response.Results = make([]batchResult, len(ops))
+	for i, op := range ops {
+		s, msg, err := applyBatchOperation(ctx, tx, uPubKeyIDs, op, matched[i])
+		if err != nil {
+			return 0, response, err
+		} else if s != http.StatusOK && status == http.StatusOK {
+			status = s
+			response.Error = fmt.Sprintf("%s %s: %s", op.Op, op.Path, msg)
+		}
+		response.Results[i] = batchResult{Path: op.Path, Status: s, Error: msg}
+	}
+	return status, response, nil
+}
+
+// renderBatch renders the response of a batch, in which the operations that
+// would have succeeded failed with the batch unless status is 200.
+func renderBatch(ctx context.Context, rw http.ResponseWriter, status int, response batchResponse) {
+	if status != http.StatusOK {
+		for i := range response.Results {
+			if response.Results[i].Status == http.StatusOK {
+				response.Results[i].Status = http.StatusFailedDependency
+			}
+		}
+	}
+	if err := RenderFromContext(ctx).JSON(rw, status, response); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
+
+// applyBatchOperation makes op in tx if it passes the checks of the handler
+// for the same change alone. It returns the status that handler would respond
+// with, and the reason for a failure. matched is the result of comparing
+// op.IfMatch with the store before the batch.
+func applyBatchOperation(ctx context.Context, tx PassTxW, uPubKeyIDs []string, op batchOperation, matched bool) (int, string, error) {
+	p := cleanPassPath(op.Path)
+	if _, _, ok := findMount(ctx, op.Path); ok {
+		return http.StatusBadRequest, "can't change passwords in mounts", nil
+	}
+	switch op.Op {
+	case "put":
+		if err := validatePassPath(op.Path, passPathFile); err != nil {
+			return http.StatusBadRequest, err.Error(), nil
+		} else if exists, isFile := tx.Type(p); exists && !isFile {
+			return http.StatusBadRequest, "can't overwrite a directory", nil
+		} else if !matched {
+			return http.StatusPreconditionFailed, "precondition failed", nil
+		} else if recipients, err := tx.Recipients(p); err != nil {
+			return 0, "", err
+		} else if !containsAny(recipients, uPubKeyIDs) {
+			return http.StatusForbidden, "forbidden", nil
+		}
+		tx.Put(p, op.Contents)
+
+	case "delete":
+		if err := validatePassPath(op.Path, passPathAny); err != nil {
+			return http.StatusBadRequest, err.Error(), nil
+		} else if exists, isFile := tx.Type(p); !exists {
+			return http.StatusNotFound, "not found", nil
+		} else if !isFile && !op.Recursive {
+			return http.StatusBadRequest, "can't delete a directory without recursive", nil
+		} else if p == "" {
+			return http.StatusBadRequest, "can't delete the root directory", nil
+		} else if !matched {
+			return http.StatusPreconditionFailed, "precondition failed", nil
+		} else if recipients, err := tx.Recipients(p); err != nil {
+			return 0, "", err
+		} else if !containsAny(recipients, uPubKeyIDs) {
+			return http.StatusForbidden, "forbidden", nil
+		} else if snap, err := snapshotWithAttachments(tx, p); err != nil {
+			return 0, "", err
+		} else {
+			// the user must be able to read everything that gets deleted
+			for _, f := range snap.files {
+				if recipients, err := tx.Recipients(f); err != nil {
+					return 0, "", err
+				} else if !containsAny(recipients, uPubKeyIDs) {
+					return http.StatusForbidden, "forbidden: not a recipient of /" + f, nil
+				}
+			}
+		}
+		for _, d := range withAttachments(tx, p) {
+			tx.Delete(d)
+		}
+
+	case "setRecipients":
+		if err := validatePassPath(op.Path, passPathDir); err != nil {
+			return http.StatusBadRequest, err.Error(), nil
+		} else if exists, isFile := tx.Type(p); !exists {
+			return http.StatusNotFound, "not found", nil
+		} else if isFile {
+			return http.StatusBadRequest, "can't set the recipients of a file", nil
+		} else if !matched {
+			return http.StatusPreconditionFailed, "precondition failed", nil
+		} else if recipients, err := tx.Recipients(p); err != nil {
+			return 0, "", err
+		} else if !containsAny(recipients, uPubKeyIDs) {
+			return http.StatusForbidden, "forbidden", nil
+		} else if err := checkRecipientsCertified(ctx, op.Recipients); err != nil {
+			if _, ok := err.(UncertifiedKeyError); ok {
+				return http.StatusBadRequest, err.Error(), nil
+			}
+			return 0, "", err
+		}
+		tx.SetRecipients(p, op.Recipients)
+
+	default:
+		return http.StatusBadRequest, fmt.Sprintf("unknown operation %q", op.Op), nil
+	}
+	return http.StatusOK, "", nil
+}
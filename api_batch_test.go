@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHandleBatch(t *testing.T) {
+	h := newHandlerTest(t)
+	pw := encryptForTest(t, "password")
+
+	type request struct {
+		Operations []batchOperation `json:"operations"`
+		Message    string           `json:"message"`
+	}
+	var response struct {
+		Error   string        `json:"error"`
+		Results []batchResult `json:"results"`
+	}
+	batch := func(ops ...batchOperation) int {
+		response.Error, response.Results = "", nil
+		rw := h.do("POST", "/api/batch", request{ops, "batch"}, nil)
+		if rw.Code != http.StatusConflict && rw.Code != http.StatusInternalServerError {
+			if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+				t.Fatalf("%v\n%s", err, rw.Body)
+			}
+		}
+		return rw.Code
+	}
+	revisions := func() int {
+		tx, err := h.ps.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs, err := tx.History("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(revs)
+	}
+
+	before := revisions()
+	if code := batch(
+		batchOperation{Op: "put", Path: "/dir/a.gpg", Contents: pw},
+		batchOperation{Op: "put", Path: "/dir/b.gpg", Contents: pw},
+		batchOperation{Op: "put", Path: "/c.gpg", Contents: pw},
+		batchOperation{Op: "delete", Path: "/c.gpg"},
+	); code != http.StatusOK {
+		t.Fatalf("Batch: %d %+v", code, response)
+	} else if len(response.Results) != 4 || response.Results[3].Status != http.StatusOK {
+		t.Errorf("Unexpected results: %+v", response.Results)
+	} else if revisions() != before+1 {
+		t.Errorf("Batch made %d commits", revisions()-before)
+	} else if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if exists, _ := tx.Type("dir/b.gpg"); !exists {
+		t.Error("Batch did not put dir/b.gpg")
+	} else if exists, _ := tx.Type("c.gpg"); exists {
+		t.Error("Batch did not delete c.gpg")
+	} else if revs, err := tx.History("/"); err != nil || revs[0].Operation != OpBatch || revs[0].Message != "batch" {
+		t.Errorf("Unexpected history: %+v, %v", revs, err)
+	}
+
+	// a single failure leaves the store alone
+	before = revisions()
+	if code := batch(
+		batchOperation{Op: "put", Path: "/d.gpg", Contents: pw},
+		batchOperation{Op: "put", Path: "/dir", Contents: pw},
+		batchOperation{Op: "delete", Path: "/missing.gpg"},
+		batchOperation{Op: "delete", Path: "/dir/a.gpg", IfMatch: `"stale"`},
+		batchOperation{Op: "rename", Path: "/dir/a.gpg"},
+	); code != http.StatusBadRequest {
+		t.Fatalf("Failing batch: %d %+v", code, response)
+	} else if len(response.Results) != 5 {
+		t.Fatalf("Unexpected results: %+v", response.Results)
+	} else {
+		for i, status := range []int{
+			http.StatusFailedDependency,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusPreconditionFailed,
+			http.StatusBadRequest,
+		} {
+			if response.Results[i].Status != status {
+				t.Errorf("Operation %d: status %d, expected %d", i, response.Results[i].Status, status)
+			}
+		}
+	}
+	if revisions() != before {
+		t.Error("Failing batch made a commit")
+	}
+
+	// files that aren't encrypted to their recipients are blamed on their put
+	if code := batch(
+		batchOperation{Op: "put", Path: "/e.gpg", Contents: pw},
+		batchOperation{Op: "put", Path: "/f.gpg", Contents: []byte("plain")},
+	); code != http.StatusBadRequest {
+		t.Fatalf("Batch with an unencrypted file: %d %+v", code, response)
+	} else if response.Results[0].Status != http.StatusFailedDependency || response.Results[1].Status != http.StatusBadRequest {
+		t.Errorf("Unexpected results: %+v", response.Results)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+
+	"golang.org/x/net/context"
+)
+
+// passProposer returns the PassProposer of the current PassStore, if any.
+func passProposer(ctx context.Context) (PassProposer, bool) {
+	p, ok := PassFromContext(ctx).(PassProposer)
+	return p, ok
+}
+
+func newChangeID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// recipientUsers returns the IDs of the users owning a key that p is
+// encrypted to in tx.
+func recipientUsers(ctx context.Context, tx PassTx, p string) (map[string]bool, error) {
+	recipients, err := tx.Recipients(p)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool)
+	for _, r := range recipients {
+		if id, err := StoreFromContext(ctx).GetUserForPublicKey(normalizeKeyID(r)); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		} else if id != "" {
+			users[id] = true
+		}
+	}
+	return users, nil
+}
+
+// changeReviewers returns the users other than the current one who are
+// recipients of every path in paths, in tx.
+func changeReviewers(ctx context.Context, tx PassTx, paths []string) ([]ChangeReview, error) {
+	var common map[string]bool
+	for _, p := range paths {
+		users, err := recipientUsers(ctx, tx, p)
+		if err != nil {
+			return nil, err
+		}
+		if common != nil {
+			for id := range common {
+				if !users[id] {
+					delete(common, id)
+				}
+			}
+		} else {
+			common = users
+		}
+	}
+	delete(common, UserFromContext(ctx).ID)
+
+	ids := make([]string, 0, len(common))
+	for id := range common {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	reviewers := make([]ChangeReview, len(ids))
+	for i, id := range ids {
+		reviewers[i] = ChangeReview{UserID: id}
+	}
+	return reviewers, nil
+}
+
+// changeDir returns the path whose recipients decide who may make a change to
+// the file p: the directory for the special files of a directory, p itself
+// otherwise.
+func changeDir(p string) string {
+	switch path.Base(p) {
+	case recipientFile, recipientSigFile, placeholderFile:
+		return path.Dir(p)
+	}
+	return p
+}
+
+// getChangeRequest gets the change request in the :id of the URL, if the
+// current user may see it. Otherwise, it responds with an error and returns
+// false.
+func getChangeRequest(ctx context.Context, rw http.ResponseWriter) (ChangeRequest, bool) {
+	u := UserFromContext(ctx)
+	c, err := StoreFromContext(ctx).GetChangeRequest(pat.Param(ctx, "id"))
+	if err == sql.ErrNoRows {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return c, false
+	} else if err != nil {
+		rlog(ctx, "Could not get change request: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return c, false
+	} else if c.UserID != u.ID && !c.isReviewer(u.ID) && !isAdmin(ctx) {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return c, false
+	}
+	return c, true
+}
+
+func (c ChangeRequest) isReviewer(userID string) bool {
+	for _, r := range c.Reviewers {
+		if r.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewChange gives c the status of the decision of the user, and records
+// the decision if they are a reviewer. If the status of c changed since it
+// was read, sql.ErrNoRows is returned.
+func reviewChange(store Store, c ChangeRequest, userID, decision string) error {
+	if err := store.SetChangeRequestStatus(c.ID, c.Status, decision); err != nil {
+		return err
+	} else if c.isReviewer(userID) {
+		return store.SetChangeReview(c.ID, userID, decision)
+	}
+	return nil
+}
+
+// changeRequestChanged reports that a change request changed status while
+// the request was being handled.
+func changeRequestChanged(rw http.ResponseWriter) {
+	http.Error(rw, "change request was changed; reload and try again", http.StatusConflict)
+}
+
+func renderChangeRequest(ctx context.Context, rw http.ResponseWriter, status int, c ChangeRequest) {
+	if err := RenderFromContext(ctx).JSON(rw, status, c); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
+
+/*
+GET /api/change - list the change requests made or reviewed by the user, newest first
+[
+	{
+		"id": "change request ID",
+		"userId": "user who made the change",
+		"message": "commit message",
+		"status": "open, approved, rejected or merged",
+		"created": "2016-01-02T15:04:05Z",
+		"reviewers": [
+			{
+				"userId": "user who may review the change",
+				"decision": "approved, rejected, or empty until reviewed"
+			}
+		]
+	}
+]
+*/
+func handleGetChanges(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	if changes, err := StoreFromContext(ctx).ListChangeRequests(UserFromContext(ctx).ID); err != nil {
+		rlog(ctx, "Could not list change requests: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+	} else if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, changes); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
+
+/*
+POST /api/change - open a change request
+<body like POST /api/batch>
+
+The operations are checked like POST /api/batch would, but instead of being
+committed, they are kept aside until another user approves them. The
+reviewers are the other users who are recipients of every path the operations
+are on. If the operations fail, the response is like that of POST /api/batch.
+Otherwise, it is 201 Created with the change request, like the elements of GET
+/api/change.
+*/
+func handlePostChange(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	u := UserFromContext(ctx)
+	if proposer, ok := passProposer(ctx); !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "invalid JSON", http.StatusBadRequest)
+		return
+	} else if msg := req.check(); msg != "" {
+		http.Error(rw, msg, http.StatusBadRequest)
+		return
+	} else if tx, err := PassFromContext(ctx).BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if reviewers, err := changeReviewers(ctx, tx, req.paths()); err != nil {
+		rlog(ctx, "Could not find reviewers: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if status, response, err := applyBatch(ctx, tx, req.Operations); err != nil {
+		rlog(ctx, "Could not apply batch operation: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if status != http.StatusOK {
+		renderBatch(ctx, rw, status, response)
+		return
+	} else if len(reviewers) == 0 {
+		http.Error(rw, "no other user is a recipient of every path to review the change", http.StatusBadRequest)
+		return
+	} else if id, err := newChangeID(); err != nil {
+		rlog(ctx, "Could not generate change request ID: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if err := proposer.Propose(tx, id, commitInfo(ctx, OpBatch, req.message())); err != nil {
+		if verr, ok := err.(VerifyError); ok {
+			renderBatch(ctx, rw, response.blame(req.Operations, verr), response)
+			return
+		}
+		rlog(ctx, "Could not propose change: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		c := ChangeRequest{
+			ID:        id,
+			UserID:    u.ID,
+			Message:   req.message(),
+			Status:    ChangeOpen,
+			Created:   time.Now().UTC(),
+			Reviewers: reviewers,
+		}
+		if err := StoreFromContext(ctx).AddChangeRequest(c); err != nil {
+			rlog(ctx, "Could not add change request: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Location", path.Join("change", id))
+		renderChangeRequest(ctx, rw, http.StatusCreated, c)
+	}
+}
+
+/*
+GET /api/change/:id - get a change request made or reviewed by the user
+
+The response is like the elements of GET /api/change.
+*/
+func handleGetChange(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	if c, ok := getChangeRequest(ctx, rw); ok {
+		renderChangeRequest(ctx, rw, http.StatusOK, c)
+	}
+}
+
+/*
+GET /api/change/:id/diff - list what a change request changes
+{
+	"files": [
+		{
+			"path": "full/path/to/file",
+			"change": "added, modified or deleted"
+		}
+	],
+	"recipients": [
+		{
+			"path": "full/path/to/directory",
+			"old": ["key","ids","before"],
+			"new": ["key","ids","after"]
+		}
+	]
+}
+
+The contents of the files are not included; they are only readable once the
+change is merged.
+*/
+func handleGetChangeDiff(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	type fileChange struct {
+		Path   string `json:"path"`
+		Change string `json:"change"`
+	}
+	type recipientChange struct {
+		Path string   `json:"path"`
+		Old  []string `json:"old"`
+		New  []string `json:"new"`
+	}
+	var response struct {
+		Files      []fileChange      `json:"files"`
+		Recipients []recipientChange `json:"recipients"`
+	}
+	response.Files = []fileChange{}
+	response.Recipients = []recipientChange{}
+
+	if proposer, ok := passProposer(ctx); !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if c, ok := getChangeRequest(ctx, rw); !ok {
+		return
+	} else if base, proposed, changed, err := proposer.Proposal(c.ID); err != nil {
+		rlog(ctx, "Could not get proposal: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		for _, p := range changed {
+			switch path.Base(p) {
+			case recipientSigFile, placeholderFile:
+			case recipientFile:
+				dir := path.Dir(p)
+				if old, err := base.Recipients(dir); err != nil {
+					rlog(ctx, "Could not get recipients: ", err)
+					http.Error(rw, "internal server error", http.StatusInternalServerError)
+					return
+				} else if new, err := proposed.Recipients(dir); err != nil {
+					rlog(ctx, "Could not get recipients: ", err)
+					http.Error(rw, "internal server error", http.StatusInternalServerError)
+					return
+				} else {
+					response.Recipients = append(response.Recipients, recipientChange{Path: dir, Old: old, New: new})
+				}
+			default:
+				change := "modified"
+				if exists, _ := base.Type(p); !exists {
+					change = "added"
+				} else if exists, _ := proposed.Type(p); !exists {
+					change = "deleted"
+				}
+				response.Files = append(response.Files, fileChange{Path: p, Change: change})
+			}
+		}
+		if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, response); err != nil {
+			rlog(ctx, "Could not render JSON: ", err)
+		}
+	}
+}
+
+/*
+POST /api/change/:id/approve - approve an open change request, and merge it
+
+Only reviewers may approve. The response is like POST /api/change/:id/merge.
+If the merge fails, the change request stays approved, and the merge can be
+retried.
+*/
+func handlePostChangeApprove(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(ctx)
+	store := StoreFromContext(ctx)
+	if c, ok := getChangeRequest(ctx, rw); !ok {
+		return
+	} else if !c.isReviewer(u.ID) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if c.Status != ChangeOpen {
+		http.Error(rw, "change request is "+c.Status, http.StatusConflict)
+		return
+	} else if err := reviewChange(store, c, u.ID, ChangeApproved); err == sql.ErrNoRows {
+		changeRequestChanged(rw)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not review change request: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if c, err := store.GetChangeRequest(c.ID); err != nil {
+		rlog(ctx, "Could not get change request: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		mergeChangeRequest(ctx, rw, c)
+	}
+}
+
+/*
+POST /api/change/:id/reject - reject a change request that isn't merged yet
+
+Reviewers may reject a change request, and its author may withdraw it. The
+response is the change request, like GET /api/change/:id.
+*/
+func handlePostChangeReject(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(ctx)
+	store := StoreFromContext(ctx)
+	if c, ok := getChangeRequest(ctx, rw); !ok {
+		return
+	} else if !c.isReviewer(u.ID) && c.UserID != u.ID {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if c.Status != ChangeOpen && c.Status != ChangeApproved {
+		http.Error(rw, "change request is "+c.Status, http.StatusConflict)
+		return
+	} else if err := reviewChange(store, c, u.ID, ChangeRejected); err == sql.ErrNoRows {
+		changeRequestChanged(rw)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not review change request: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if c, err := store.GetChangeRequest(c.ID); err != nil {
+		rlog(ctx, "Could not get change request: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		renderChangeRequest(ctx, rw, http.StatusOK, c)
+	}
+}
+
+/*
+POST /api/change/:id/merge - merge an approved change request
+
+The author and the reviewers who approved the change must still be recipients
+of everything it changes. If anything it changes was changed since it was
+made, or the change request was merged or rejected meanwhile, the response is
+409 Conflict. Otherwise, the response is the merged change request, like GET
+/api/change/:id. The merge is recorded as the author's.
+*/
+func handlePostChangeMerge(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(ctx)
+	if c, ok := getChangeRequest(ctx, rw); !ok {
+		return
+	} else if !c.isReviewer(u.ID) && c.UserID != u.ID {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if c.Status != ChangeApproved {
+		http.Error(rw, "change request is "+c.Status, http.StatusConflict)
+		return
+	} else {
+		mergeChangeRequest(ctx, rw, c)
+	}
+}
+
+// mergeChangeRequest merges the approved change request c, and responds with
+// it. The merge is authored by the user who made the change; the users who
+// approved and merged it are named in the message.
+func mergeChangeRequest(ctx context.Context, rw http.ResponseWriter, c ChangeRequest) {
+	store := StoreFromContext(ctx)
+	users := []string{c.UserID}
+	for _, r := range c.Reviewers {
+		if r.Decision == ChangeApproved {
+			users = append(users, r.UserID)
+		}
+	}
+	info := commitInfo(ctx, OpMerge, fmt.Sprintf("Merged change request %s: %s\n\nApproved by %s; merged by %s.",
+		c.ID, c.Message, strings.Join(users[1:], ", "), UserFromContext(ctx).ID))
+
+	if proposer, ok := passProposer(ctx); !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if _, _, changed, err := proposer.Proposal(c.ID); err != nil {
+		rlog(ctx, "Could not get proposal: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if author, err := store.GetUser(c.UserID); err != nil {
+		rlog(ctx, "Could not get author of change request: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if tip, err := PassFromContext(ctx).Begin(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		info.UserID, info.UserName = author.ID, author.Name
+		for _, p := range changed {
+			if recipients, err := recipientUsers(ctx, tip, changeDir(p)); err != nil {
+				rlog(ctx, "Could not get recipients: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else {
+				for _, id := range users {
+					if !recipients[id] {
+						http.Error(rw, fmt.Sprintf("forbidden: %s is not a recipient of /%s anymore", id, changeDir(p)), http.StatusForbidden)
+						return
+					}
+				}
+			}
+		}
+
+		// the change request is marked merged first, so that it can't be
+		// merged twice or rejected while it's merged, and marked approved
+		// again if the merge fails
+		if err := store.SetChangeRequestStatus(c.ID, ChangeApproved, ChangeMerged); err == sql.ErrNoRows {
+			changeRequestChanged(rw)
+			return
+		} else if err != nil {
+			rlog(ctx, "Could not set change request status: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		unmerge := func() {
+			if err := store.SetChangeRequestStatus(c.ID, ChangeMerged, ChangeApproved); err != nil {
+				rlog(ctx, "Could not reset change request status: ", err)
+			}
+		}
+		if tx, err := proposer.BeginMerge(c.ID); err == ErrConflict {
+			unmerge()
+			commitError(ctx, rw, err)
+			return
+		} else if err != nil {
+			unmerge()
+			rlog(ctx, "Could not start merge: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		} else if err := tx.Commit(info); err != nil {
+			unmerge()
+			commitError(ctx, rw, err)
+			return
+		}
+		c.Status = ChangeMerged
+		renderChangeRequest(ctx, rw, http.StatusOK, c)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/unrolled/render"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/net/context"
+)
+
+func TestHandleChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+
+	// a second user, to review the changes of tolar2
+	key, err := openpgp.NewEntity("reviewer", "", "reviewer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var armored bytes.Buffer
+	if w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil); err != nil {
+		t.Fatal(err)
+	} else if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Close()
+	}
+	reviewer := User{UserFull: UserFull{UserMeta: UserMeta{ID: "reviewer", Name: "Reviewer"}}, Password: []byte("x")}
+	if err := db.PostUser(reviewer); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddPublicKey("reviewer", key.PrimaryKey.KeyIdString(), armored.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	tolar2, err := db.GetUser("tolar2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(tolar2PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range key.Identities {
+		// prefer the algorithms of tolar2's key, so files can be encrypted to
+		// both
+		for _, tid := range keys[0].Identities {
+			id.SelfSignature.PreferredSymmetric = tid.SelfSignature.PreferredSymmetric
+			id.SelfSignature.PreferredHash = tid.SelfSignature.PreferredHash
+		}
+	}
+	encrypt := func(plain string) []byte {
+		var buf bytes.Buffer
+		w, err := openpgp.Encrypt(&buf, append(keys, key), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(plain))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	g, err := NewGitPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetKeyResolver(storeKeyResolver(db))
+	if tx, err := g.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()})
+		tx.SetRecipients("private", []string{tolar2PublicKeyID})
+		tx.Put("b.gpg", encrypt("b"))
+		if err := tx.Commit(CommitInfo{Message: "Set initial recipients"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	ctx = ContextWithConfig(ctx, Config{})
+	ctx = ContextWithStore(ctx, db)
+	ctx = ContextWithPass(ctx, g)
+	ctx = ContextWithRender(ctx, render.New())
+	mux := goji.NewMux()
+	mux.HandleFuncC(pat.Get("/api/change"), handleGetChanges)
+	mux.HandleFuncC(pat.Post("/api/change"), handlePostChange)
+	mux.HandleFuncC(pat.Get("/api/change/:id"), handleGetChange)
+	mux.HandleFuncC(pat.Get("/api/change/:id/diff"), handleGetChangeDiff)
+	mux.HandleFuncC(pat.Post("/api/change/:id/approve"), handlePostChangeApprove)
+	mux.HandleFuncC(pat.Post("/api/change/:id/reject"), handlePostChangeReject)
+	mux.HandleFuncC(pat.Post("/api/change/:id/merge"), handlePostChangeMerge)
+	h := &handlerTest{t: t, mux: mux}
+	as := func(u User) *handlerTest {
+		h.ctx = ContextWithUser(ctx, u)
+		return h
+	}
+	exists := func(p string) bool {
+		tx, err := g.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, _ := tx.Type(p)
+		return e
+	}
+
+	var c ChangeRequest
+	propose := func(ops ...batchOperation) int {
+		c = ChangeRequest{}
+		rw := as(tolar2).do("POST", "/api/change", batchRequest{ops, "change"}, nil)
+		if rw.Code == http.StatusCreated {
+			if err := json.Unmarshal(rw.Body.Bytes(), &c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rw.Code
+	}
+
+	// only files someone else can read can be changed by a change request
+	if code := propose(batchOperation{Op: "put", Path: "private/a.gpg", Contents: encryptForTest(t, "a")}); code != http.StatusBadRequest {
+		t.Errorf("Proposing a change no one can review: %d", code)
+	}
+	if code := propose(
+		batchOperation{Op: "put", Path: "a.gpg", Contents: encrypt("a")},
+		batchOperation{Op: "delete", Path: "b.gpg"},
+	); code != http.StatusCreated {
+		t.Fatalf("Proposing a change: %d", code)
+	} else if c.Status != ChangeOpen || len(c.Reviewers) != 1 || c.Reviewers[0].UserID != "reviewer" {
+		t.Fatalf("Unexpected change request: %+v", c)
+	} else if exists("a.gpg") || !exists("b.gpg") {
+		t.Fatal("Proposing a change changed the store")
+	}
+
+	var diff struct {
+		Files []struct {
+			Path   string `json:"path"`
+			Change string `json:"change"`
+		} `json:"files"`
+	}
+	var list []ChangeRequest
+	if rw := as(reviewer).do("GET", "/api/change/"+c.ID+"/diff", nil, &diff); rw.Code != http.StatusOK {
+		t.Fatalf("GET diff: %d %s", rw.Code, rw.Body)
+	} else if len(diff.Files) != 2 || diff.Files[0].Change != "added" || diff.Files[1].Change != "deleted" {
+		t.Errorf("Unexpected diff: %+v", diff)
+	} else if rw := as(reviewer).do("GET", "/api/change", nil, &list); rw.Code != http.StatusOK || len(list) != 1 {
+		t.Errorf("GET change: %d %+v", rw.Code, list)
+	} else if rw := as(tolar2).do("POST", "/api/change/"+c.ID+"/approve", nil, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("Approving one's own change: %d %s", rw.Code, rw.Body)
+	} else if rw := as(tolar2).do("POST", "/api/change/"+c.ID+"/merge", nil, nil); rw.Code != http.StatusConflict {
+		t.Errorf("Merging an open change: %d %s", rw.Code, rw.Body)
+	} else if rw := as(reviewer).do("POST", "/api/change/"+c.ID+"/approve", nil, &c); rw.Code != http.StatusOK {
+		t.Fatalf("Approving: %d %s", rw.Code, rw.Body)
+	} else if c.Status != ChangeMerged {
+		t.Errorf("Approved change is %s", c.Status)
+	} else if !exists("a.gpg") || exists("b.gpg") {
+		t.Error("Approving a change didn't merge it")
+	}
+	// the merge is the author's, and names who approved it
+	if merge, err := g.gitO("log", "-1", "--format=%an%n%B", "refs/heads/master"); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(string(merge), tolar2.Name+"\n") || !strings.Contains(string(merge), "Approved by reviewer; merged by reviewer.") || !strings.Contains(string(merge), "User-Id: tolar2") {
+		t.Errorf("Unexpected merge:\n%s", merge)
+	}
+
+	// rejected changes can't be merged
+	if code := propose(batchOperation{Op: "delete", Path: "a.gpg"}); code != http.StatusCreated {
+		t.Fatalf("Proposing a change: %d", code)
+	} else if rw := as(reviewer).do("POST", "/api/change/"+c.ID+"/reject", nil, &c); rw.Code != http.StatusOK || c.Status != ChangeRejected {
+		t.Fatalf("Rejecting: %d %s", rw.Code, rw.Body)
+	} else if rw := as(reviewer).do("POST", "/api/change/"+c.ID+"/approve", nil, nil); rw.Code != http.StatusConflict {
+		t.Errorf("Approving a rejected change: %d %s", rw.Code, rw.Body)
+	} else if !exists("a.gpg") {
+		t.Error("Rejecting a change merged it")
+	}
+
+	// neither can changes to files that changed since
+	if code := propose(batchOperation{Op: "put", Path: "a.gpg", Contents: encrypt("a2")}); code != http.StatusCreated {
+		t.Fatalf("Proposing a change: %d", code)
+	}
+	if tx, err := g.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.Put("a.gpg", encrypt("a3"))
+		if err := tx.Commit(CommitInfo{Message: "Change a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rw := as(reviewer).do("POST", "/api/change/"+c.ID+"/approve", nil, nil); rw.Code != http.StatusConflict {
+		t.Errorf("Approving a conflicting change: %d %s", rw.Code, rw.Body)
+	} else if rw := as(reviewer).do("GET", "/api/change/"+c.ID, nil, &c); rw.Code != http.StatusOK || c.Status != ChangeApproved {
+		t.Errorf("Change that failed to merge: %d %+v", rw.Code, c)
+	}
+
+	// decisions on a change request whose status changed since it was read
+	// are refused
+	stale := c
+	stale.Status = ChangeOpen
+	if err := reviewChange(db, stale, "reviewer", ChangeRejected); err != sql.ErrNoRows {
+		t.Errorf("Rejecting a change request that changed: %v", err)
+	} else if c, err := db.GetChangeRequest(c.ID); err != nil || c.Status != ChangeApproved {
+		t.Errorf("Change request after a refused decision: %+v, %v", c, err)
+	}
+}
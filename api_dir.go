@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+/*
+POST /api/dir/* - create an empty directory
+{
+	"recipients": ["optional","list","of","key","ids"],
+	"message": "commit message"
+}
+
+With recipients, the directory gets its own .gpg-id; otherwise it inherits
+the recipients of its parent. The body may be empty.
+*/
+func handlePostDir(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Recipients []string `json:"recipients"`
+		Message    string   `json:"message"`
+	}
+	p := passPath(ctx)
+	ps := PassFromContext(ctx)
+	u := UserFromContext(ctx)
+	if err := validatePassPath(p, passPathDir); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(rw, "invalid JSON", http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, _ := tx.Type(p); exists {
+		http.Error(rw, "already exists", http.StatusConflict)
+		return
+	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
+		rlog(ctx, "Could not get public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if recipients, err := tx.Recipients(p); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !containsAny(recipients, uPubKeyIDs) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if err := checkRecipientsCertified(ctx, req.Recipients); err != nil {
+		if _, ok := err.(UncertifiedKeyError); ok {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		} else {
+			rlog(ctx, "Could not check recipient certifications: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	} else {
+		if len(req.Recipients) > 0 {
+			tx.SetRecipients(p, req.Recipients)
+		} else {
+			tx.Mkdir(p)
+		}
+
+		message := req.Message
+		if message == "" {
+			message = fmt.Sprintf("Created directory %s.", "/"+cleanPassPath(p))
+		}
+		if err := tx.Commit(commitInfo(ctx, OpMkdir, message)); err != nil {
+			commitError(ctx, rw, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"goji.io/pat"
+)
+
+func TestHandleDir(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Post("/api/dir/*"), mounted(handlePostDir))
+	other, key := h.addUser("other")
+	var dir struct {
+		Children   []interface{} `json:"children"`
+		Recipients []string      `json:"recipients"`
+	}
+
+	if rw := h.do("POST", "/api/dir/empty", nil, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST without a body: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("GET", "/api/pass/empty", nil, &dir); rw.Code != http.StatusOK || dir.Children == nil {
+		t.Errorf("GET of an empty directory: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/dir/empty", nil, nil); rw.Code != http.StatusConflict {
+		t.Errorf("POST of an existing directory: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/dir/.hidden", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of an invalid name: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/dir/x.gpg", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of a directory named like a file: %d %s", rw.Code, rw.Body)
+	}
+
+	shared := []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()}
+	if rw := h.do("POST", "/api/dir/shared", map[string][]string{"recipients": shared}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST with recipients: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("GET", "/api/pass/shared", nil, &dir); rw.Code != http.StatusOK || len(dir.Recipients) != 2 {
+		t.Errorf("GET of a directory with recipients: %d %s", rw.Code, rw.Body)
+	} else if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if !hasOwnRecipients(tx, "shared") {
+		t.Error("POST with recipients didn't give the directory its own")
+	}
+
+	// users can only create directories where they are recipients
+	h.as(other)
+	if rw := h.do("POST", "/api/dir/mine", nil, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("POST where the user isn't a recipient: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/dir/shared/sub", nil, nil); rw.Code != http.StatusOK {
+		t.Errorf("POST where the user is a recipient: %d %s", rw.Code, rw.Body)
+	}
+}
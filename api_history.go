@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+
+	"golang.org/x/net/context"
+)
+
+/*
+GET /api/history/* - list the changes to a password or directory, newest first
+Response:
+{
+	"path": "full/path/to/file",
+	"revisions": [
+		{
+			"revision": "commit ID",
+			"author": "name of the user who made the change",
+			"authorEmail": "email of the user who made the change",
+			"time": "2016-05-05T12:00:00Z",
+			"message": "commit message",
+			"version": "version (ETag) of the path after the change; empty if it was removed",
+			"userId": "ID of the user who made the change, if known",
+			"requestId": "ID of the API request that made the change, if known",
+			"operation": "put, delete, reencrypt, restore, move, mkdir or merge, if known"
+		}
+	]
+}
+
+GET /api/history/*?revision=<commit ID> - get a password as of an earlier revision
+Response is the same as for GET /api/pass/* on a file, with an additional
+"revision" field.
+*/
+func handleGetHistory(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	type responseHistory struct {
+		Path      string         `json:"path"`
+		Revisions []PassRevision `json:"revisions"`
+	}
+	type responseFile struct {
+		Name       string   `json:"name"`
+		Path       string   `json:"path"`
+		Revision   string   `json:"revision"`
+		Contents   []byte   `json:"contents"`
+		Recipients []string `json:"recipients"`
+	}
+
+	p := passPath(ctx)
+	rev := r.URL.Query().Get("revision")
+	ps := PassFromContext(ctx)
+	var response interface{}
+	if err := validatePassPath(p, passPathAny); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.Begin(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if rev == "" {
+		if revs, err := tx.History(p); err != nil {
+			rlog(ctx, "Could not get history: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		} else if len(revs) == 0 {
+			http.Error(rw, "not found", http.StatusNotFound)
+			return
+		} else {
+			response = responseHistory{
+				Path:      apiPath(ctx, path.Clean(p)),
+				Revisions: revs,
+			}
+		}
+	} else if old, err := tx.At(rev); err == ErrUnknownRevision {
+		http.Error(rw, "unknown revision", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not open revision: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, isFile := old.Type(p); !exists {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if !isFile {
+		http.Error(rw, "not a file", http.StatusBadRequest)
+		return
+	} else if contents, err := old.Get(p); err != nil {
+		rlog(ctx, "Could not get file contents: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if recipients, err := getRecipients(bytes.NewReader(contents)); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		response = responseFile{
+			Name:       apiPassName(p),
+			Path:       apiPath(ctx, path.Clean(p)),
+			Revision:   rev,
+			Contents:   contents,
+			Recipients: recipients,
+		}
+		setETag(rw, old, p)
+	}
+
+	if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, response); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"goji.io/pat"
+)
+
+func TestHandleHistory(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Get("/api/history/*"), mounted(handleGetHistory))
+	type post struct {
+		Contents []byte `json:"contents"`
+	}
+	var history struct {
+		Path      string         `json:"path"`
+		Revisions []PassRevision `json:"revisions"`
+	}
+	var file struct {
+		Path       string   `json:"path"`
+		Revision   string   `json:"revision"`
+		Contents   []byte   `json:"contents"`
+		Recipients []string `json:"recipients"`
+	}
+	first, second := encryptForTest(t, "first"), encryptForTest(t, "second")
+
+	if rw := h.do("GET", "/api/history/dir/a.gpg", nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of a path that never existed: %d %s", rw.Code, rw.Body)
+	}
+	for _, c := range [][]byte{first, second} {
+		if rw := h.do("POST", "/api/pass/dir/a.gpg", post{c}, nil); rw.Code != http.StatusOK {
+			t.Fatalf("POST: %d %s", rw.Code, rw.Body)
+		}
+	}
+	if rw := h.do("DELETE", "/api/pass/dir/a.gpg", nil, nil); rw.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", rw.Code, rw.Body)
+	}
+
+	// deleted files keep their history, newest first
+	if rw := h.do("GET", "/api/history/dir/a.gpg", nil, &history); rw.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", rw.Code, rw.Body)
+	} else if history.Path != "/dir/a.gpg" || len(history.Revisions) != 3 {
+		t.Fatalf("GET returned %+v", history)
+	} else if history.Revisions[0].Version != "" || history.Revisions[1].Version == "" {
+		t.Errorf("GET returned versions %+v", history.Revisions)
+	} else if history.Revisions[1].UserID != "tolar2" {
+		t.Errorf("GET returned the user %q", history.Revisions[1].UserID)
+	} else if rw := h.do("GET", "/api/history/dir", nil, &history); rw.Code != http.StatusOK || len(history.Revisions) != 3 {
+		t.Errorf("GET of a directory: %d %s", rw.Code, rw.Body)
+	}
+
+	// the file as of an earlier revision
+	rev := history.Revisions[2].Revision
+	if rw := h.do("GET", "/api/history/dir/a.gpg?revision="+rev, nil, &file); rw.Code != http.StatusOK {
+		t.Fatalf("GET of a revision: %d %s", rw.Code, rw.Body)
+	} else if !bytes.Equal(file.Contents, first) || file.Revision != rev {
+		t.Errorf("GET of a revision returned %+v", file)
+	} else if len(file.Recipients) != 1 {
+		t.Errorf("GET of a revision returned the recipients %q", file.Recipients)
+	} else if rw.Header().Get("ETag") == "" {
+		t.Error("GET of a revision set no ETag")
+	}
+	if rw := h.do("GET", "/api/history/dir/a.gpg?revision="+history.Revisions[0].Revision, nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of a revision without the file: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("GET", "/api/history/dir?revision="+rev, nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("GET of a directory at a revision: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("GET", "/api/history/dir/a.gpg?revision=unknown", nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown revision: %d %s", rw.Code, rw.Body)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+/*
+POST /api/move - move or rename a password or directory
+{
+	"from": "/path/to/old",
+	"to": "/path/to/new",
+	"files": {
+		"full/path/to/new/file": "reencrypted contents, base64 encoded"
+	},
+	"message": "commit message"
+}
+
+The user must be a recipient of everything that moves, or the response is 403
+Forbidden. The attachments of a password move with it. The move is a single commit, so
+it can't involve mounts. If the destination has different recipients than the
+source, the files that don't have recipients of their own must be reencrypted;
+without them in "files", the response is 409 Conflict:
+{
+	"error": "some files must be reencrypted",
+	"reencrypt": {
+		"full/path/to/new/file": ["key","ids","to","encrypt","to"]
+	}
+}
+The client should reencrypt the files (listed by their new paths) and repeat
+the request with the new contents in "files".
+*/
+func handlePostMove(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From    string            `json:"from"`
+		To      string            `json:"to"`
+		Files   map[string][]byte `json:"files"`
+		Message string            `json:"message"`
+	}
+	ps := PassFromContext(ctx)
+	u := UserFromContext(ctx)
+	store := StoreFromContext(ctx)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "invalid JSON", http.StatusBadRequest)
+		return
+	} else if err := validatePassPath(req.From, passPathAny); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if _, _, ok := findMount(ctx, req.From); ok {
+		http.Error(rw, "can't move passwords in mounts", http.StatusBadRequest)
+		return
+	} else if _, _, ok := findMount(ctx, req.To); ok {
+		http.Error(rw, "can't move passwords in mounts", http.StatusBadRequest)
+		return
+	} else if from := cleanPassPath(req.From); from == "" {
+		http.Error(rw, "can't move the root directory", http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, isFile := tx.Type(from); !exists {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if err := validatePassPath(req.To, passPathKindOf(isFile)); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if to := cleanPassPath(req.To); to == "" || to == from || strings.HasPrefix(to, from+"/") {
+		http.Error(rw, "can't move a directory into itself", http.StatusBadRequest)
+		return
+	} else if exists, _ := tx.Type(to); exists {
+		http.Error(rw, "destination already exists", http.StatusConflict)
+		return
+	} else if exists, _ := tx.Type(attachmentDir(to)); isFile && exists {
+		http.Error(rw, "destination already exists", http.StatusConflict)
+		return
+	} else if !ifMatch(r, tx, from) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if uPubKeyIDs, err := store.GetPublicKeyIDs(u.ID); err != nil {
+		rlog(ctx, "Could not get public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if srcRecipients, err := tx.Recipients(from); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if dstRecipients, err := tx.Recipients(path.Dir("/" + to)); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !containsAny(srcRecipients, uPubKeyIDs) || !containsAny(dstRecipients, uPubKeyIDs) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if snap, err := snapshotWithAttachments(tx, from); err != nil {
+		rlog(ctx, "Could not list files: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		// the user must be able to read everything that gets moved
+		for _, f := range snap.files {
+			if recipients, err := tx.Recipients(f); err != nil {
+				rlog(ctx, "Could not get recipients: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else if !containsAny(recipients, uPubKeyIDs) {
+				http.Error(rw, "forbidden: not a recipient of "+apiPath(ctx, "/"+f), http.StatusForbidden)
+				return
+			}
+		}
+		for dir, recipients := range snap.recipients {
+			if !containsAny(recipients, uPubKeyIDs) {
+				http.Error(rw, "forbidden: not a recipient of "+apiPath(ctx, "/"+dir), http.StatusForbidden)
+				return
+			}
+		}
+
+		// files that get their recipients from above the moved path need to be
+		// reencrypted, unless the destination has the same recipients
+		// (matchKeyIDs without a resolver compares the lists as sets)
+		var inheriting []string
+		if isFile {
+			inheriting = []string{from}
+		} else if !hasOwnRecipients(tx, from) {
+			if inheriting, err = tx.GetAffectedFiles(from); err != nil {
+				rlog(ctx, "Could not get affected files: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		// the attachments of a file move with it
+		attached := len(withAttachments(tx, from)) > 1
+		if attached && !hasOwnRecipients(tx, attachmentDir(from)) {
+			if files, err := tx.GetAffectedFiles(attachmentDir(from)); err != nil {
+				rlog(ctx, "Could not get affected files: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else {
+				inheriting = append(inheriting, files...)
+			}
+		}
+		if matchKeyIDs(srcRecipients, dstRecipients, nil) {
+			inheriting = nil
+		}
+
+		moved := func(f string) string {
+			f = cleanPassPath(f)
+			if attached && strings.HasPrefix(f, attachmentDir(from)+"/") {
+				return path.Join(attachmentDir(to), strings.TrimPrefix(f, attachmentDir(from)))
+			}
+			return path.Join(to, strings.TrimPrefix(f, from))
+		}
+		files := make(map[string][]byte, len(req.Files))
+		for f, c := range req.Files {
+			files[cleanPassPath(f)] = c
+		}
+
+		if err := tx.Move(from, to); err != nil {
+			rlog(ctx, "Could not move: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		} else if attached {
+			if err := tx.Move(attachmentDir(from), attachmentDir(to)); err != nil {
+				rlog(ctx, "Could not move attachments: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		reencrypt := make(map[string][]string)
+		for _, f := range inheriting {
+			if c, ok := files[moved(f)]; ok {
+				tx.Put(moved(f), c)
+				delete(files, moved(f))
+			} else {
+				reencrypt[moved(f)] = dstRecipients
+			}
+		}
+		if len(reencrypt) > 0 {
+			renderReencrypt(ctx, rw, reencrypt)
+			return
+		}
+		for f := range files {
+			http.Error(rw, fmt.Sprintf("%s: not a file that needs reencryption", "/"+f), http.StatusBadRequest)
+			return
+		}
+
+		message := req.Message
+		if message == "" {
+			message = fmt.Sprintf("Moved %s to %s.", "/"+from, "/"+to)
+		}
+		if err := tx.Commit(commitInfo(ctx, OpMove, message)); err != nil {
+			commitError(ctx, rw, err)
+			return
+		}
+	}
+}
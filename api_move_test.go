@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"goji.io/pat"
+)
+
+func TestHandleMove(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Post("/api/move"), handlePostMove)
+	other, key := h.addUser("other")
+	tolar2 := tolar2Keys(t)[0]
+	type move struct {
+		From  string            `json:"from"`
+		To    string            `json:"to"`
+		Files map[string][]byte `json:"files,omitempty"`
+	}
+	commit := func(f func(tx PassTxW)) {
+		tx, err := h.ps.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(tx)
+		if err := tx.Commit(CommitInfo{Message: "Test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(p string) []byte {
+		tx, err := h.ps.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := tx.Get(p)
+		return c
+	}
+
+	a := encryptForTest(t, "a")
+	commit(func(tx PassTxW) {
+		tx.Put("a.gpg", a)
+		tx.Put("dir/b.gpg", encryptForTest(t, "b"))
+		tx.SetRecipients("shared", []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()})
+		tx.Put("shared/c.gpg", encryptForTestTo(t, "c", tolar2, key))
+	})
+
+	if rw := h.do("POST", "/api/move", move{From: "/", To: "/x"}, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("Move of the root directory: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/move", move{From: "/dir", To: "/dir/sub"}, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("Move of a directory into itself: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/move", move{From: "/a.gpg", To: "/dir/b.gpg"}, nil); rw.Code != http.StatusConflict {
+		t.Errorf("Move over an existing file: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/move", move{From: "/missing.gpg", To: "/b.gpg"}, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("Move of a missing file: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/move", move{From: "/a.gpg", To: "/dir/a.gpg"}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Move of a file: %d %s", rw.Code, rw.Body)
+	} else if get("a.gpg") != nil || !bytes.Equal(get("dir/a.gpg"), a) {
+		t.Error("Move of a file didn't move it")
+	}
+
+	// files that change recipients must be reencrypted by the client
+	var res reencryptResponse
+	reencrypted := encryptForTestTo(t, "a", tolar2, key)
+	if rw := h.do("POST", "/api/move", move{From: "/dir/a.gpg", To: "/shared/a.gpg"}, nil); rw.Code != http.StatusConflict {
+		t.Fatalf("Move to other recipients: %d %s", rw.Code, rw.Body)
+	} else if err := json.NewDecoder(rw.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	} else if r := res.Reencrypt["shared/a.gpg"]; len(res.Reencrypt) != 1 || len(r) != 2 {
+		t.Errorf("Move asked to reencrypt %+v", res.Reencrypt)
+	} else if rw := h.do("POST", "/api/move", move{"/dir/a.gpg", "/shared/a.gpg", map[string][]byte{"shared/a.gpg": reencrypted}}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Move with reencrypted files: %d %s", rw.Code, rw.Body)
+	} else if !bytes.Equal(get("shared/a.gpg"), reencrypted) {
+		t.Error("Move didn't use the reencrypted file")
+	}
+
+	// users must be recipients of everything that moves
+	commit(func(tx PassTxW) {
+		tx.Put("shared/sub/c.gpg", encryptForTestTo(t, "c", tolar2, key))
+		tx.SetRecipients("shared/sub/secret", []string{tolar2PublicKeyID})
+		tx.Put("shared/sub/secret/d.gpg", encryptForTest(t, "d"))
+	})
+	h.as(other)
+	if rw := h.do("POST", "/api/move", move{From: "/shared/sub", To: "/shared/moved"}, nil); rw.Code != http.StatusForbidden || !bytes.Contains(rw.Body.Bytes(), []byte("shared/sub/secret/d.gpg")) {
+		t.Errorf("Move of a directory with a file the user can't access: %d %s", rw.Code, rw.Body)
+	}
+	commit(func(tx PassTxW) { tx.Delete("shared/sub/secret/d.gpg") })
+	if rw := h.do("POST", "/api/move", move{From: "/shared/sub", To: "/shared/moved"}, nil); rw.Code != http.StatusForbidden || !bytes.Contains(rw.Body.Bytes(), []byte("shared/sub/secret")) {
+		t.Errorf("Move of a directory with a directory the user can't access: %d %s", rw.Code, rw.Body)
+	} else if get("shared/sub/c.gpg") == nil {
+		t.Error("A forbidden move was committed")
+	} else if rw := h.do("POST", "/api/move", move{From: "/shared/sub/c.gpg", To: "/shared/e.gpg"}, nil); rw.Code != http.StatusOK {
+		t.Errorf("Move of a file the user can access: %d %s", rw.Code, rw.Body)
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"path"
 	"strings"
 
-	"goji.io/pattern"
+	"github.com/elithrar/goji-logger"
 
 	"golang.org/x/net/context"
 )
@@ -17,6 +17,78 @@ func apiPassName(s string) string {
 	return strings.TrimSuffix(path.Base(s), ".gpg")
 }
 
+func etag(version string) string {
+	return `"` + version + `"`
+}
+
+// setETag sets the ETag header to the version of p.
+func setETag(rw http.ResponseWriter, tx PassTx, p string) {
+	if v, err := tx.Version(p); err == nil {
+		rw.Header().Set("ETag", etag(v))
+	}
+}
+
+// ifMatch checks the If-Match header of r against the current version of p.
+// Requests without an If-Match header always match.
+func ifMatch(r *http.Request, tx PassTx, p string) bool {
+	return matchETags(r.Header.Get("If-Match"), tx, p)
+}
+
+// matchETags checks a list of ETags, as in an If-Match header, against the
+// current version of p. An empty list always matches.
+func matchETags(h string, tx PassTx, p string) bool {
+	if h == "" {
+		return true
+	}
+	v, err := tx.Version(p)
+	if err != nil {
+		return false
+	}
+	for _, tag := range strings.Split(h, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// commitInfo describes a transaction made by the current request.
+func commitInfo(ctx context.Context, operation, message string) CommitInfo {
+	u := UserFromContext(ctx)
+	return CommitInfo{
+		UserID:    u.ID,
+		UserName:  u.Name,
+		Message:   message,
+		RequestID: logger.GetReqID(ctx),
+		Operation: operation,
+	}
+}
+
+// commitError reports an error from PassTxW.Commit. Changes rejected by the
+// store are the client's fault; anything else is ours.
+func commitError(ctx context.Context, rw http.ResponseWriter, err error) {
+	if verr, ok := err.(VerifyError); ok {
+		http.Error(rw, verr.Error(), http.StatusBadRequest)
+	} else if err == ErrConflict {
+		http.Error(rw, "conflicting change; reload and try again", http.StatusConflict)
+	} else {
+		rlog(ctx, "Could not commit transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// recipientsError reports an error from PassTx.Recipients. Recipients without
+// a trusted signature are refused until an admin checks and signs them.
+func recipientsError(ctx context.Context, rw http.ResponseWriter, err error) {
+	if serr, ok := err.(SignatureError); ok {
+		rlog(ctx, "Refusing recipients: ", err)
+		http.Error(rw, serr.Error(), http.StatusConflict)
+	} else {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+	}
+}
+
 /*
 GET /api/pass/* - get a password or a list of passwords
 Reponse for files:
@@ -24,7 +96,8 @@ Reponse for files:
 	"name": "base name of the file, minus the .gpg",
 	"path": "full/path/to/file",
 	"contents": "full file contents, base64 encoded",
-	"recipients": ["key","ids","that","can","access"]
+	"recipients": ["key","ids","that","can","access"],
+	"attachments": ["names","of","attachments.gpg"]
 }
 
 Reponse for directories:
@@ -33,33 +106,44 @@ Reponse for directories:
 		{
 			"name": "name of the child",
 			"path": "full path of the child",
-			"type": "'dir' or 'file'"
+			"type": "'dir' or 'file'",
+			"mount": true
 		}
 	],
 	"recipients": ["key","ids","that","can","access","directory"]
 }
+The root directory starts with the mounts the user may see, which are
+directories with "mount" set. Their paths are handled by their own stores.
+
+The ETag header identifies the current version of the file or directory, for
+use with If-Match when changing it.
 */
 func handleGetPass(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
 	type responseFile struct {
-		Name       string   `json:"name"`
-		Path       string   `json:"path"`
-		Contents   []byte   `json:"contents"`
-		Recipients []string `json:"recipients"`
+		Name        string   `json:"name"`
+		Path        string   `json:"path"`
+		Contents    []byte   `json:"contents"`
+		Recipients  []string `json:"recipients"`
+		Attachments []string `json:"attachments"`
 	}
 	type responseDirEnt struct {
-		Name string `json:"name"`
-		Path string `json:"path"`
-		Type string `json:"type"`
+		Name  string `json:"name"`
+		Path  string `json:"path"`
+		Type  string `json:"type"`
+		Mount bool   `json:"mount,omitempty"`
 	}
 	type responseDir struct {
 		Children   []responseDirEnt `json:"children"`
 		Recipients []string         `json:"recipients"`
 	}
 
-	p := pattern.Path(ctx)
+	p := passPath(ctx)
 	ps := PassFromContext(ctx)
 	var response interface{}
-	if tx, err := ps.Begin(); err != nil {
+	if err := validatePassPath(p, passPathAny); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.Begin(); err != nil {
 		rlog(ctx, "Could not start transaction: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		return
@@ -75,13 +159,19 @@ func handleGetPass(ctx context.Context, rw http.ResponseWriter, r *http.Request)
 			rlog(ctx, "Could not get recipients: ", err)
 			http.Error(rw, "internal server error", http.StatusInternalServerError)
 			return
+		} else if attachments, err := listAttachments(tx, p); err != nil {
+			rlog(ctx, "Could not list attachments: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
 		} else {
 			response = responseFile{
-				Name:       apiPassName(p),
-				Path:       path.Clean(p),
-				Contents:   contents,
-				Recipients: recipients,
+				Name:        apiPassName(p),
+				Path:        apiPath(ctx, path.Clean(p)),
+				Contents:    contents,
+				Recipients:  recipients,
+				Attachments: attachments,
 			}
+			setETag(rw, tx, p)
 		}
 	} else {
 		if recipients, err := tx.Recipients(p); err != nil {
@@ -94,13 +184,22 @@ func handleGetPass(ctx context.Context, rw http.ResponseWriter, r *http.Request)
 			return
 		} else {
 			rChildren := make([]responseDirEnt, 0, len(children))
+			mountNames := make(map[string]bool)
+			if cleanPassPath(p) == "" && !inMount(ctx) {
+				for _, m := range visibleMounts(ctx) {
+					rChildren = append(rChildren, responseDirEnt{m.Name, "/" + m.Name, "dir", true})
+				}
+				for name := range MountsFromContext(ctx) {
+					mountNames[name] = true
+				}
+			}
 			for _, c := range children {
-				if c.File && !strings.HasSuffix(c.Name, ".gpg") {
+				if c.File && !strings.HasSuffix(c.Name, ".gpg") || mountNames[c.Name] || !c.File && isAttachmentDir(tx, path.Join(p, c.Name)) {
 					continue
 				}
 				var ch responseDirEnt
 				ch.Name = apiPassName(c.Name)
-				ch.Path = path.Join(p, c.Name)
+				ch.Path = apiPath(ctx, path.Join(p, c.Name))
 				ch.Type = "file"
 				if !c.File {
 					ch.Type = "dir"
@@ -112,6 +211,7 @@ func handleGetPass(ctx context.Context, rw http.ResponseWriter, r *http.Request)
 				Children:   rChildren,
 				Recipients: recipients,
 			}
+			setETag(rw, tx, p)
 		}
 	}
 
@@ -126,22 +226,32 @@ POST /api/pass/* - save or create a password
 	"contents": "full file contents, base64 encoded",
 	"message": "commit message"
 }
+
+If an If-Match header is given and the password has changed since, the
+response is 412 Precondition Failed. A concurrent change to the same password
+results in 409 Conflict.
 */
 func handlePostPass(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Contents []byte `json:"contents"`
 		Message  string `json:"message"`
 	}
-	p := pattern.Path(ctx)
+	p := passPath(ctx)
 	ps := PassFromContext(ctx)
 	u := UserFromContext(ctx)
-	if tx, err := ps.BeginW(); err != nil {
+	if err := validatePassPath(p, passPathFile); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
 		rlog(ctx, "Could not start transaction: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		return
 	} else if exists, isFile := tx.Type(p); exists && !isFile {
 		http.Error(rw, "can't overwrite a directory", http.StatusBadRequest)
 		return
+	} else if !ifMatch(r, tx, p) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
+		return
 	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
 		rlog(ctx, "Could not get public keys: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
@@ -158,9 +268,8 @@ func handlePostPass(ctx context.Context, rw http.ResponseWriter, r *http.Request
 		return
 	} else {
 		tx.Put(p, req.Contents)
-		if err := tx.Commit(u.Name, req.Message); err != nil {
-			rlog(ctx, "Could not commit transaction: ", err)
-			http.Error(rw, "internal server error", http.StatusInternalServerError)
+		if err := tx.Commit(commitInfo(ctx, OpPut, req.Message)); err != nil {
+			commitError(ctx, rw, err)
 			return
 		}
 	}
@@ -168,20 +277,43 @@ func handlePostPass(ctx context.Context, rw http.ResponseWriter, r *http.Request
 
 /*
 DELETE /api/pass/* - delete a password
+
+Honors If-Match like POST /api/pass/*.
+
+Directories are only deleted with ?recursive=true, and only if the user is a
+recipient of every file in them. With &dryRun=true, nothing is deleted, and
+the response lists the files that would be removed:
+{
+	"files": ["list","of","full","file","paths"]
+}
 */
 func handleDeletePass(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
-	p := pattern.Path(ctx)
+	var response struct {
+		Files []string `json:"files"`
+	}
+	p := passPath(ctx)
 	ps := PassFromContext(ctx)
 	u := UserFromContext(ctx)
-	if tx, err := ps.BeginW(); err != nil {
+	recursive := r.URL.Query().Get("recursive") == "true"
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	if err := validatePassPath(p, passPathAny); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
 		rlog(ctx, "Could not start transaction: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		return
 	} else if exists, isFile := tx.Type(p); !exists {
 		http.Error(rw, "not found", http.StatusNotFound)
 		return
-	} else if !isFile {
-		http.Error(rw, "can't delete a directory", http.StatusBadRequest)
+	} else if !isFile && !recursive {
+		http.Error(rw, "can't delete a directory without recursive=true", http.StatusBadRequest)
+		return
+	} else if cleanPassPath(p) == "" {
+		http.Error(rw, "can't delete the root directory", http.StatusBadRequest)
+		return
+	} else if !ifMatch(r, tx, p) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
 		return
 	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
 		rlog(ctx, "Could not get public keys: ", err)
@@ -194,11 +326,39 @@ func handleDeletePass(ctx context.Context, rw http.ResponseWriter, r *http.Reque
 	} else if !containsAny(recipients, uPubKeyIDs) {
 		http.Error(rw, "forbidden", http.StatusForbidden)
 		return
+	} else if snap, err := snapshotWithAttachments(tx, p); err != nil {
+		rlog(ctx, "Could not list files: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
 	} else {
-		tx.Delete(p)
-		if err := tx.Commit(u.Name, "Removed "+p+" from store."); err != nil {
-			rlog(ctx, "Could not commit transaction: ", err)
-			http.Error(rw, "internal server error", http.StatusInternalServerError)
+		// the user must be able to read everything that gets deleted
+		for _, f := range snap.files {
+			if recipients, err := tx.Recipients(f); err != nil {
+				rlog(ctx, "Could not get recipients: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else if !containsAny(recipients, uPubKeyIDs) {
+				http.Error(rw, "forbidden: not a recipient of "+apiPath(ctx, "/"+f), http.StatusForbidden)
+				return
+			}
+		}
+
+		if dryRun {
+			response.Files = make([]string, len(snap.files))
+			for i, f := range snap.files {
+				response.Files[i] = apiPath(ctx, f)
+			}
+			if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, response); err != nil {
+				rlog(ctx, "Could not render JSON: ", err)
+			}
+			return
+		}
+
+		for _, d := range withAttachments(tx, p) {
+			tx.Delete(d)
+		}
+		if err := tx.Commit(commitInfo(ctx, OpDelete, "Removed "+p+" from store.")); err != nil {
+			commitError(ctx, rw, err)
 			return
 		}
 	}
@@ -217,15 +377,17 @@ func handleGetPerm(ctx context.Context, rw http.ResponseWriter, r *http.Request)
 		Access []string `json:"access"`
 		Change []string `json:"change"`
 	}
-	p := pattern.Path(ctx)
+	p := passPath(ctx)
 	ps := PassFromContext(ctx)
-	if tx, err := ps.Begin(); err != nil {
+	if err := validatePassPath(p, passPathDir); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.Begin(); err != nil {
 		rlog(ctx, "Could not start transaction: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		return
 	} else if recipients, err := tx.Recipients(p); err != nil {
-		rlog(ctx, "Could not get recipients: ", err)
-		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		recipientsError(ctx, rw, err)
 		return
 	} else if affected, err := tx.GetAffectedFiles(p); err != nil {
 		rlog(ctx, "Could not get affected files: ", err)
@@ -233,7 +395,11 @@ func handleGetPerm(ctx context.Context, rw http.ResponseWriter, r *http.Request)
 		return
 	} else {
 		response.Access = recipients
-		response.Change = affected
+		response.Change = make([]string, len(affected))
+		for i, f := range affected {
+			response.Change[i] = apiPath(ctx, f)
+		}
+		setETag(rw, tx, p)
 		if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, response); err != nil {
 			rlog(ctx, "Could not render JSON: ", err)
 		}
@@ -248,16 +414,21 @@ POST /api/passPerm/* - set permissions on a directory
 		"full/path/to/file": "reencrypted contents, base64 encrypted"
 	}
 }
+
+Honors If-Match (with the ETag from GET /api/passPerm/*) like POST /api/pass/*.
 */
 func handlePostPerm(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
-	p := pattern.Path(ctx)
+	p := passPath(ctx)
 	ps := PassFromContext(ctx)
 	u := UserFromContext(ctx)
 	var req struct {
 		Access []string          `json:"access"`
 		Files  map[string][]byte `json:"files"`
 	}
-	if tx, err := ps.BeginW(); err != nil {
+	if err := validatePassPath(p, passPathDir); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
 		rlog(ctx, "Could not start transaction: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		return
@@ -267,13 +438,15 @@ func handlePostPerm(ctx context.Context, rw http.ResponseWriter, r *http.Request
 	} else if isFile {
 		http.Error(rw, "can't change permissions on a directory", http.StatusBadRequest)
 		return
+	} else if !ifMatch(r, tx, p) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
+		return
 	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
 		rlog(ctx, "Could not get public keys: ", err)
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 		return
 	} else if recipients, err := tx.Recipients(p); err != nil {
-		rlog(ctx, "Could not get recipients: ", err)
-		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		recipientsError(ctx, rw, err)
 		return
 	} else if !containsAny(recipients, uPubKeyIDs) {
 		http.Error(rw, "forbidden", http.StatusForbidden)
@@ -285,19 +458,26 @@ func handlePostPerm(ctx context.Context, rw http.ResponseWriter, r *http.Request
 	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(rw, "invalid JSON", http.StatusBadRequest)
 		return
+	} else if err := checkRecipientsCertified(ctx, req.Access); err != nil {
+		if _, ok := err.(UncertifiedKeyError); ok {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		} else {
+			rlog(ctx, "Could not check recipient certifications: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+		}
+		return
 	} else {
 		tx.SetRecipients(p, req.Access)
 		for _, f := range affected {
-			c := req.Files[f]
+			c := req.Files[apiPath(ctx, f)]
 			if len(c) == 0 {
-				http.Error(rw, "missing reencrypted file "+f, http.StatusInternalServerError)
+				http.Error(rw, "missing reencrypted file "+apiPath(ctx, f), http.StatusInternalServerError)
 				return
 			}
 			tx.Put(f, c)
 		}
-		if err := tx.Commit(u.Name, fmt.Sprintf("Reencrypted %s to %v.", p, req.Access)); err != nil {
-			rlog(ctx, "Could not commit transaction: ", err)
-			http.Error(rw, "internal server error", http.StatusInternalServerError)
+		if err := tx.Commit(commitInfo(ctx, OpReencrypt, fmt.Sprintf("Reencrypted %s to %v.", p, req.Access))); err != nil {
+			commitError(ctx, rw, err)
 			return
 		}
 	}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/unrolled/render"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/net/context"
+)
+
+// handlerTest serves the API as the tolar2 user, with a MemPass whose root
+// directory has tolar2 as its recipient.
+type handlerTest struct {
+	t   *testing.T
+	ps  *MemPass
+	mux *goji.Mux
+	ctx context.Context
+}
+
+func newHandlerTest(t *testing.T) *handlerTest {
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	ps := NewMemPass()
+	ps.SetKeyResolver(storeKeyResolver(db))
+	if tx, err := ps.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		if err := tx.Commit(CommitInfo{Message: "Set initial recipients"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := db.GetUser("tolar2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	ctx = ContextWithConfig(ctx, Config{})
+	ctx = ContextWithStore(ctx, db)
+	ctx = ContextWithPass(ctx, ps)
+	ctx = ContextWithUser(ctx, u)
+	ctx = ContextWithRender(ctx, render.New())
+
+	mux := goji.NewMux()
+	mux.HandleFuncC(pat.Get("/api/pass/*"), mounted(handleGetPass))
+	mux.HandleFuncC(pat.Post("/api/pass/*"), mounted(handlePostPass))
+	mux.HandleFuncC(pat.Delete("/api/pass/*"), mounted(handleDeletePass))
+	mux.HandleFuncC(pat.Get("/api/tree/*"), mounted(handleGetTree))
+	mux.HandleFuncC(pat.Get("/api/search"), handleGetSearch)
+	mux.HandleFuncC(pat.Get("/api/passPerm/*"), mounted(handleGetPerm))
+	mux.HandleFuncC(pat.Post("/api/batch"), handlePostBatch)
+	mux.HandleFuncC(pat.Get("/api/attachment/*"), mounted(handleGetAttachment))
+	mux.HandleFuncC(pat.Post("/api/attachment/*"), mounted(handlePostAttachment))
+	mux.HandleFuncC(pat.Delete("/api/attachment/*"), mounted(handleDeleteAttachment))
+	return &handlerTest{t, ps, mux, ctx}
+}
+
+// do makes a request, decoding a JSON response into out (if not nil), and
+// returns the response.
+func (h *handlerTest) do(method, url string, body interface{}, out interface{}) *httptest.ResponseRecorder {
+	return h.doIfMatch(method, url, "", body, out)
+}
+
+// doIfMatch is do with an If-Match header, unless etag is empty.
+func (h *handlerTest) doIfMatch(method, url, etag string, body interface{}, out interface{}) *httptest.ResponseRecorder {
+	var in bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&in).Encode(body)
+	}
+	r, err := http.NewRequest(method, url, &in)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if etag != "" {
+		r.Header.Set("If-Match", etag)
+	}
+	rw := httptest.NewRecorder()
+	h.mux.ServeHTTPC(h.ctx, rw, r)
+	if out != nil && rw.Code == http.StatusOK {
+		if err := json.Unmarshal(rw.Body.Bytes(), out); err != nil {
+			h.t.Fatalf("%s %s: %v\n%s", method, url, err, rw.Body)
+		}
+	}
+	return rw
+}
+
+// addUser adds a user with a new key, which prefers the algorithms of
+// tolar2's key so that files can be encrypted to both.
+func (h *handlerTest) addUser(id string) (User, *openpgp.Entity) {
+	return addUserForTest(h.t, StoreFromContext(h.ctx), id)
+}
+
+func addUserForTest(t testing.TB, db Store, id string) (User, *openpgp.Entity) {
+	key, err := openpgp.NewEntity(id, "", id+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range key.Identities {
+		for _, tid := range tolar2Keys(t)[0].Identities {
+			uid.SelfSignature.PreferredSymmetric = tid.SelfSignature.PreferredSymmetric
+			uid.SelfSignature.PreferredHash = tid.SelfSignature.PreferredHash
+		}
+	}
+	var armored bytes.Buffer
+	if w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil); err != nil {
+		t.Fatal(err)
+	} else if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Close()
+	}
+	u := User{UserFull: UserFull{UserMeta: UserMeta{ID: id, Name: id}}, Password: []byte("x")}
+	if err := db.PostUser(u); err != nil {
+		t.Fatal(err)
+	} else if err := db.AddPublicKey(id, key.PrimaryKey.KeyIdString(), armored.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return u, key
+}
+
+// as makes the following requests as u.
+func (h *handlerTest) as(u User) *handlerTest {
+	h.ctx = ContextWithUser(h.ctx, u)
+	return h
+}
+
+func tolar2Keys(t testing.TB) openpgp.EntityList {
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(tolar2PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// encryptForTestTo is encryptForTest with other keys than tolar2's.
+func encryptForTestTo(t testing.TB, plain string, keys ...*openpgp.Entity) []byte {
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, keys, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(plain))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestHandlePass(t *testing.T) {
+	h := newHandlerTest(t)
+	pw := encryptForTest(t, "password")
+
+	type post struct {
+		Contents []byte `json:"contents"`
+		Message  string `json:"message"`
+	}
+	if rw := h.do("POST", "/api/pass/dir/a.gpg", post{pw, "add a"}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/dir/b.gpg", post{[]byte("plain"), ""}, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of an unencrypted file: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/dir", post{pw, ""}, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST over a directory: %d %s", rw.Code, rw.Body)
+	}
+
+	var file struct {
+		Name       string   `json:"name"`
+		Path       string   `json:"path"`
+		Contents   []byte   `json:"contents"`
+		Recipients []string `json:"recipients"`
+	}
+	if rw := h.do("GET", "/api/pass/dir/a.gpg", nil, &file); rw.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", rw.Code, rw.Body)
+	} else if file.Name != "a" || !bytes.Equal(file.Contents, pw) || len(file.Recipients) != 1 {
+		t.Errorf("GET returned %+v", file)
+	} else if rw.Header().Get("ETag") == "" {
+		t.Error("GET did not set an ETag")
+	}
+
+	var dir struct {
+		Children []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"children"`
+		Recipients []string `json:"recipients"`
+	}
+	if rw := h.do("GET", "/api/pass/dir", nil, &dir); rw.Code != http.StatusOK {
+		t.Fatalf("GET of a directory: %d %s", rw.Code, rw.Body)
+	} else if len(dir.Children) != 1 || dir.Children[0].Name != "a" || dir.Children[0].Type != "file" {
+		t.Errorf("GET of a directory returned %+v", dir)
+	} else if rw := h.do("GET", "/api/pass/missing.gpg", nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing file: %d", rw.Code)
+	}
+
+	if rw := h.do("DELETE", "/api/pass/dir", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("DELETE of a directory without recursive=true: %d", rw.Code)
+	} else if rw := h.do("DELETE", "/api/pass/dir?recursive=true&dryRun=true", nil, nil); rw.Code != http.StatusOK || !bytes.Contains(rw.Body.Bytes(), []byte("dir/a.gpg")) {
+		t.Errorf("Dry run: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("DELETE", "/api/pass/dir/a.gpg", nil, nil); rw.Code != http.StatusOK {
+		t.Errorf("DELETE: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("GET", "/api/pass/dir/a.gpg", nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: %d", rw.Code)
+	}
+
+	// every change was its own revision, attributed to the user
+	if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if revs, err := tx.History("/dir/a.gpg"); err != nil || len(revs) != 2 {
+		t.Fatalf("History: %+v, %v", revs, err)
+	} else if revs[0].UserID != "tolar2" || revs[0].Operation != OpDelete || revs[1].Message != "add a" {
+		t.Errorf("Unexpected history: %+v", revs)
+	}
+}
+
+func TestHandlePassMounts(t *testing.T) {
+	h := newHandlerTest(t)
+	pw := encryptForTest(t, "password")
+
+	newMount := func(name string, users ...string) Mount {
+		ps := NewMemPass()
+		ps.SetKeyResolver(storeKeyResolver(StoreFromContext(h.ctx)))
+		tx, err := ps.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		if err := tx.Commit(CommitInfo{Message: "Set initial recipients"}); err != nil {
+			t.Fatal(err)
+		}
+		return Mount{Name: name, Store: ps, Users: users}
+	}
+	team := newMount("team")
+	h.ctx = ContextWithMounts(h.ctx, map[string]Mount{
+		"team":   team,
+		"hidden": newMount("hidden", "someone-else"),
+	})
+
+	type post struct {
+		Contents []byte `json:"contents"`
+		Message  string `json:"message"`
+	}
+	if rw := h.do("POST", "/api/pass/team/dir/a.gpg", post{pw, ""}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST in a mount: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/hidden/a.gpg", post{pw, ""}, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("POST in a hidden mount: %d %s", rw.Code, rw.Body)
+	}
+	if tx, err := team.Store.Begin(); err != nil {
+		t.Fatal(err)
+	} else if exists, _ := tx.Type("dir/a.gpg"); !exists {
+		t.Error("POST did not write to the mount's store")
+	} else if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if exists, _ := tx.Type("team"); exists {
+		t.Error("POST wrote to the main store")
+	}
+
+	type dirent struct {
+		Name  string `json:"name"`
+		Path  string `json:"path"`
+		Type  string `json:"type"`
+		Mount bool   `json:"mount"`
+	}
+	var dir struct {
+		Children []dirent `json:"children"`
+	}
+	if rw := h.do("GET", "/api/pass/", nil, &dir); rw.Code != http.StatusOK {
+		t.Fatalf("GET of the root: %d %s", rw.Code, rw.Body)
+	} else if len(dir.Children) != 1 || dir.Children[0] != (dirent{"team", "/team", "dir", true}) {
+		t.Errorf("GET of the root returned %+v", dir.Children)
+	}
+	dir.Children = nil
+	if rw := h.do("GET", "/api/pass/team/dir", nil, &dir); rw.Code != http.StatusOK {
+		t.Fatalf("GET in a mount: %d %s", rw.Code, rw.Body)
+	} else if len(dir.Children) != 1 || dir.Children[0].Path != "/team/dir/a.gpg" {
+		t.Errorf("GET in a mount returned %+v", dir.Children)
+	}
+
+	var perm struct {
+		Change []string `json:"change"`
+	}
+	if rw := h.do("GET", "/api/passPerm/team/", nil, &perm); rw.Code != http.StatusOK {
+		t.Fatalf("GET of permissions in a mount: %d %s", rw.Code, rw.Body)
+	} else if len(perm.Change) != 1 || perm.Change[0] != "team/dir/a.gpg" {
+		t.Errorf("GET of permissions in a mount returned %+v", perm.Change)
+	} else if rw := h.do("GET", "/api/passPerm/hidden/", nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of permissions in a hidden mount: %d", rw.Code)
+	}
+}
+
+func TestHandlePassVerify(t *testing.T) {
+	h := newHandlerTest(t)
+	_, key := h.addUser("other")
+	tolar2 := tolar2Keys(t)[0]
+	if tx, err := h.ps.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("shared", []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()})
+		if err := tx.Commit(CommitInfo{Message: "Share a directory"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type post struct {
+		Contents []byte `json:"contents"`
+	}
+	// files must be encrypted to exactly the recipients of their directory
+	if rw := h.do("POST", "/api/pass/shared/a.gpg", post{encryptForTest(t, "a")}, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of a file missing a recipient: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/a.gpg", post{encryptForTestTo(t, "a", tolar2, key)}, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of a file encrypted to another key: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/shared/a.gpg", post{encryptForTestTo(t, "a", tolar2, key)}, nil); rw.Code != http.StatusOK {
+		t.Errorf("POST of a file encrypted to its recipients: %d %s", rw.Code, rw.Body)
+	}
+	if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if exists, _ := tx.Type("a.gpg"); exists {
+		t.Error("A rejected file was committed")
+	}
+}
+
+// TestHandlePassExisting checks that paths made by pass (or earlier versions
+// of the server) that new ones can't have still work.
+func TestHandlePassExisting(t *testing.T) {
+	h := newHandlerTest(t)
+	pw := encryptForTest(t, "password")
+	files := memFiles{
+		"a:b.gpg":       pw,
+		"old.gpg/c.gpg": pw,
+	}
+	for p, c := range h.ps.revisions[len(h.ps.revisions)-1].files {
+		files[p] = c
+	}
+	h.ps.revisions = append(h.ps.revisions, memRevision{files: files})
+
+	var file struct {
+		Contents []byte `json:"contents"`
+	}
+	if rw := h.do("GET", "/api/pass/a:b.gpg", nil, &file); rw.Code != http.StatusOK || !bytes.Equal(file.Contents, pw) {
+		t.Errorf("GET of an existing name with a bad character: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("GET", "/api/pass/old.gpg/c.gpg", nil, nil); rw.Code != http.StatusOK {
+		t.Errorf("GET below an existing directory named like a file: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("POST", "/api/pass/x:y.gpg", file, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("POST of a new name with a bad character: %d %s", rw.Code, rw.Body)
+	}
+	// and can be rewritten, e.g. when reencrypting them
+	if tx, err := h.ps.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.Put("a:b.gpg", encryptForTest(t, "password"))
+		if err := tx.Commit(CommitInfo{Message: "Reencrypt"}); err != nil {
+			t.Errorf("Rewriting an existing name with a bad character: %v", err)
+		}
+	}
+	if rw := h.do("DELETE", "/api/pass/a:b.gpg", nil, nil); rw.Code != http.StatusOK {
+		t.Errorf("DELETE of an existing name with a bad character: %d %s", rw.Code, rw.Body)
+	} else if rw := h.do("DELETE", "/api/pass/old.gpg?recursive=true", nil, nil); rw.Code != http.StatusOK {
+		t.Errorf("DELETE of an existing directory named like a file: %d %s", rw.Code, rw.Body)
+	} else if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if l, err := tx.List("/"); err != nil || len(l) != 0 {
+		t.Errorf("Left after deleting: %+v, %v", l, err)
+	}
+}
+
+func TestHandlePassIfMatch(t *testing.T) {
+	h := newHandlerTest(t)
+	type post struct {
+		Contents []byte `json:"contents"`
+	}
+	etag := func(p string) string {
+		rw := h.do("GET", p, nil, nil)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", p, rw.Code, rw.Body)
+		}
+		return rw.Header().Get("ETag")
+	}
+
+	if rw := h.do("POST", "/api/pass/a.gpg", post{encryptForTest(t, "1")}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rw.Code, rw.Body)
+	}
+	first := etag("/api/pass/a.gpg")
+	if rw := h.doIfMatch("POST", "/api/pass/a.gpg", first, post{encryptForTest(t, "2")}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST with the current ETag: %d %s", rw.Code, rw.Body)
+	} else if etag("/api/pass/a.gpg") == first {
+		t.Fatal("The ETag didn't change")
+	}
+
+	// writes based on the old version fail, and change nothing
+	second := etag("/api/pass/a.gpg")
+	if rw := h.doIfMatch("POST", "/api/pass/a.gpg", first, post{encryptForTest(t, "3")}, nil); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("POST with a stale ETag: %d %s", rw.Code, rw.Body)
+	} else if rw := h.doIfMatch("DELETE", "/api/pass/a.gpg", first, nil, nil); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag: %d %s", rw.Code, rw.Body)
+	} else if etag("/api/pass/a.gpg") != second {
+		t.Error("A failed precondition changed the file")
+	} else if rw := h.doIfMatch("DELETE", "/api/pass/a.gpg", second, nil, nil); rw.Code != http.StatusOK {
+		t.Errorf("DELETE with the current ETag: %d %s", rw.Code, rw.Body)
+	}
+
+	// directories have ETags too, which change with anything below them
+	if rw := h.do("POST", "/api/pass/dir/b.gpg", post{encryptForTest(t, "b")}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rw.Code, rw.Body)
+	}
+	dir := etag("/api/pass/dir")
+	if rw := h.do("POST", "/api/pass/dir/c.gpg", post{encryptForTest(t, "c")}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rw.Code, rw.Body)
+	} else if rw := h.doIfMatch("DELETE", "/api/pass/dir?recursive=true", dir, nil, nil); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Recursive DELETE with a stale ETag: %d %s", rw.Code, rw.Body)
+	}
+}
+
+func TestHandleDeleteRecursive(t *testing.T) {
+	h := newHandlerTest(t)
+	admin := UserFromContext(h.ctx)
+	other, key := h.addUser("other")
+	tolar2 := tolar2Keys(t)[0]
+	commit := func(f func(tx PassTxW)) {
+		tx, err := h.ps.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(tx)
+		if err := tx.Commit(CommitInfo{Message: "Test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(p string) bool {
+		tx, err := h.ps.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, _ := tx.Type(p)
+		return exists
+	}
+
+	commit(func(tx PassTxW) {
+		tx.SetRecipients("shared", []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()})
+		tx.Put("shared/a.gpg", encryptForTestTo(t, "a", tolar2, key))
+		tx.Put("shared/sub/b.gpg", encryptForTestTo(t, "b", tolar2, key))
+		tx.SetRecipients("shared/sub/secret", []string{tolar2PublicKeyID})
+		tx.Put("shared/sub/secret/c.gpg", encryptForTest(t, "c"))
+	})
+
+	if rw := h.do("DELETE", "/api/pass/?recursive=true", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("DELETE of the root directory: %d %s", rw.Code, rw.Body)
+	}
+
+	// users must be recipients of everything that gets deleted
+	h.as(other)
+	if rw := h.do("DELETE", "/api/pass/shared/sub?recursive=true", nil, nil); rw.Code != http.StatusForbidden || !bytes.Contains(rw.Body.Bytes(), []byte("shared/sub/secret/c.gpg")) {
+		t.Errorf("DELETE of a directory with a file the user can't access: %d %s", rw.Code, rw.Body)
+	} else if !exists("shared/sub/b.gpg") {
+		t.Error("A forbidden DELETE was committed")
+	} else if rw := h.do("DELETE", "/api/pass/shared/sub/secret?recursive=true", nil, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("DELETE of a directory the user can't access: %d %s", rw.Code, rw.Body)
+	}
+
+	// everything below the directory goes, including other .gpg-id files
+	h.as(admin)
+	if rw := h.do("DELETE", "/api/pass/shared?recursive=true", nil, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Recursive DELETE: %d %s", rw.Code, rw.Body)
+	}
+	for _, p := range []string{"shared", "shared/sub/b.gpg", "shared/sub/secret"} {
+		if exists(p) {
+			t.Errorf("Recursive DELETE left %s", p)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+
+	"goji.io/pat"
+
+	"golang.org/x/net/context"
+)
+
+// passSyncer returns the PassSyncer of the current PassStore, if any.
+func passSyncer(ctx context.Context) (PassSyncer, bool) {
+	s, ok := PassFromContext(ctx).(PassSyncer)
+	return s, ok
+}
+
+/*
+GET /api/remote - get the status of every remote the store syncs with
+[
+	{
+		"name": "origin",
+		"lastSync": "2016-01-02T15:04:05Z",
+		"lastError": "error message, if the last sync failed",
+		"conflicts": [
+			{
+				"path": "path/to/file.gpg",
+				"revision": "remote commit ID",
+				"time": "2016-01-02T15:04:05Z"
+			}
+		]
+	}
+]
+
+Conflicts are paths changed differently on both sides. The local version is
+kept; the remote version can be seen with GET /api/history/*?revision=<remote
+commit ID>, and restored with POST /api/restore/*.
+*/
+func handleGetRemotes(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	remotes := []RemoteStatus{}
+	if s, ok := passSyncer(ctx); ok {
+		remotes = s.Remotes()
+	}
+	if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, remotes); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
+
+/*
+POST /api/remote/:name/sync - sync with a remote now
+
+Responds with the status of the remote like GET /api/remote. If the sync
+failed, the response is 502 Bad Gateway, with the error in "lastError".
+*/
+func handlePostRemoteSync(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	name := pat.Param(ctx, "name")
+	if s, ok := passSyncer(ctx); !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if status, err := s.Sync(ctx, name); err == ErrUnknownRemote {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else {
+		code := http.StatusOK
+		if err != nil {
+			rlog(ctx, "Could not sync with remote: ", err)
+			code = http.StatusBadGateway
+		}
+		if err := RenderFromContext(ctx).JSON(rw, code, status); err != nil {
+			rlog(ctx, "Could not render JSON: ", err)
+		}
+	}
+}
+
+/*
+DELETE /api/remote/:name/conflicts - clear the reported conflicts of a remote (admin only)
+*/
+func handleDeleteRemoteConflicts(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	if !isAdmin(ctx) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if s, ok := passSyncer(ctx); !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if err := s.ClearConflicts(pat.Param(ctx, "name")); err == ErrUnknownRemote {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not clear conflicts: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+}
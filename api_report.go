@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+/*
+GET /api/report/fsck - check that every file matches its recipients (admin only)
+{
+	"files": 123,
+	"problems": [
+		{
+			"path": "full/path/to/file",
+			"kind": "missingRecipients, extraRecipients, unknownKeys, unparsable, emptyRecipients, strayFile or gpgDirectory",
+			"keyIds": ["key","ids","the","problem","is","about"],
+			"error": "why the file is unparsable"
+		}
+	]
+}
+
+"files" is the number of password files checked. Mounts are checked too, with
+their paths under the mount's directory.
+*/
+func handleGetFsckReport(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	stores := map[string]PassStore{"": PassFromContext(ctx)}
+	for name, m := range MountsFromContext(ctx) {
+		stores[name] = m.Store
+	}
+	if !isAdmin(ctx) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if report, err := fsckStores(stores, storeKeyResolver(StoreFromContext(ctx))); err != nil {
+		rlog(ctx, "Could not check store: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, report); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
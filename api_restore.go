@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"golang.org/x/net/context"
+)
+
+// reencryptResponse is sent with 409 Conflict when an operation would store
+// files that are not encrypted to their new recipients. The client should
+// reencrypt each listed file to the given recipients and repeat the request
+// with the new contents.
+type reencryptResponse struct {
+	Error     string              `json:"error"`
+	Reencrypt map[string][]string `json:"reencrypt"`
+}
+
+func renderReencrypt(ctx context.Context, rw http.ResponseWriter, reencrypt map[string][]string) {
+	res := reencryptResponse{
+		Error:     "some files must be reencrypted",
+		Reencrypt: make(map[string][]string, len(reencrypt)),
+	}
+	for f, r := range reencrypt {
+		res.Reencrypt[apiPath(ctx, f)] = r
+	}
+	if err := RenderFromContext(ctx).JSON(rw, http.StatusConflict, res); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
+
+// hasOwnRecipients determines if dir has its own .gpg-id file.
+func hasOwnRecipients(tx PassTx, dir string) bool {
+	exists, isFile := tx.Type(path.Join(dir, recipientFile))
+	return exists && isFile
+}
+
+// passSnapshot is the state of a subtree: its files, and the directories
+// that have their own recipients.
+type passSnapshot struct {
+	files      []string
+	recipients map[string][]string
+}
+
+func snapshotSubtree(tx PassTx, p string) (passSnapshot, error) {
+	snap := passSnapshot{recipients: make(map[string][]string)}
+	err := PassWalk(tx, p, func(d PassDirent) error {
+		if d.File {
+			snap.files = append(snap.files, cleanPassPath(d.Name))
+		} else if hasOwnRecipients(tx, d.Name) {
+			if r, err := tx.Recipients(d.Name); err != nil {
+				return err
+			} else {
+				snap.recipients[cleanPassPath(d.Name)] = r
+			}
+		}
+		return nil
+	})
+	return snap, err
+}
+
+// recipientsAfter determines the recipients of file f (inside the subtree at
+// root) once the subtree's own recipients are replaced with those in snap;
+// inherited is used if no directory in the subtree has its own recipients.
+func (snap passSnapshot) recipientsAfter(root, f string, inherited []string) []string {
+	for dir := cleanPassPath(path.Dir(f)); ; dir = cleanPassPath(path.Dir(dir)) {
+		if r, ok := snap.recipients[dir]; ok {
+			return r
+		} else if dir == root || dir == "" {
+			return inherited
+		}
+	}
+}
+
+// restoreForbidden finds a path affected by restoring the subtree at root
+// that keyIDs are not recipients of, either now or after the restore, or
+// returns "" if there is none. snap and oldSnap are the subtree now and at
+// the restored revision, and inherited the recipients of root's parent.
+func restoreForbidden(tx PassTx, root string, snap, oldSnap passSnapshot, inherited, keyIDs []string) (string, error) {
+	for _, f := range snap.files {
+		if r, err := tx.Recipients(f); err != nil {
+			return "", err
+		} else if !containsAny(r, keyIDs) {
+			return f, nil
+		}
+	}
+	for dir := range oldSnap.recipients {
+		if exists, _ := tx.Type(dir); !exists {
+			continue
+		} else if r, err := tx.Recipients(dir); err != nil {
+			return "", err
+		} else if !containsAny(r, keyIDs) {
+			return dir, nil
+		}
+	}
+	for dir, r := range snap.recipients {
+		if !containsAny(r, keyIDs) {
+			return dir, nil
+		}
+	}
+	for dir, r := range oldSnap.recipients {
+		if !containsAny(r, keyIDs) {
+			return dir, nil
+		}
+	}
+	for _, f := range oldSnap.files {
+		if !containsAny(oldSnap.recipientsAfter(root, f, inherited), keyIDs) {
+			return f, nil
+		}
+	}
+	return "", nil
+}
+
+/*
+POST /api/restore/* - restore a password or directory to an earlier revision
+{
+	"revision": "commit ID to restore",
+	"files": {
+		"full/path/to/file": "reencrypted contents, base64 encoded"
+	},
+	"message": "commit message"
+}
+
+The old contents are written back as a new revision, so no history is lost.
+Restoring a directory also restores the .gpg-id files inside it, and removes
+files that did not exist at that revision.
+
+The user must be a recipient of every file and directory the restore changes,
+both now and at the restored revision, or the response is 403 Forbidden.
+
+If some of the old files are not encrypted to the recipients they would have
+after the restore, the response is 409 Conflict:
+{
+	"error": "some files must be reencrypted",
+	"reencrypt": {
+		"full/path/to/file": ["key","ids","to","encrypt","to"]
+	}
+}
+The client should fetch those files from GET /api/history/*?revision=<commit
+ID>, reencrypt them, and repeat the request with the new contents in "files".
+*/
+func handlePostRestore(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Revision string            `json:"revision"`
+		Files    map[string][]byte `json:"files"`
+		Message  string            `json:"message"`
+	}
+	p := passPath(ctx)
+	ps := PassFromContext(ctx)
+	u := UserFromContext(ctx)
+	store := StoreFromContext(ctx)
+	if err := validatePassPath(p, passPathAny); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if p = cleanPassPath(p); false {
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "invalid JSON", http.StatusBadRequest)
+		return
+	} else if tx, err := ps.BeginW(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if old, err := tx.At(req.Revision); err == ErrUnknownRevision {
+		http.Error(rw, "unknown revision", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not open revision: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if oldExists, oldIsFile := old.Type(p); !oldExists {
+		http.Error(rw, "not found at revision", http.StatusNotFound)
+		return
+	} else if exists, isFile := tx.Type(p); exists && isFile != oldIsFile {
+		http.Error(rw, "can't restore a file over a directory or vice versa", http.StatusBadRequest)
+		return
+	} else if !ifMatch(r, tx, p) {
+		http.Error(rw, "precondition failed", http.StatusPreconditionFailed)
+		return
+	} else if uPubKeyIDs, err := store.GetPublicKeyIDs(u.ID); err != nil {
+		rlog(ctx, "Could not get public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if recipients, err := tx.Recipients(p); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !containsAny(recipients, uPubKeyIDs) {
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	} else if oldSnap, err := snapshotSubtree(old, p); err != nil {
+		rlog(ctx, "Could not list old files: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if inherited, err := tx.Recipients(path.Dir("/" + p)); err != nil {
+		rlog(ctx, "Could not get recipients: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		var snap passSnapshot
+		if exists && !isFile {
+			if snap, err = snapshotSubtree(tx, p); err != nil {
+				rlog(ctx, "Could not list files: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if f, err := restoreForbidden(tx, p, snap, oldSnap, inherited, uPubKeyIDs); err != nil {
+			rlog(ctx, "Could not get recipients: ", err)
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		} else if f != "" {
+			http.Error(rw, "forbidden: not a recipient of "+apiPath(ctx, "/"+f), http.StatusForbidden)
+			return
+		}
+
+		// restore the recipients of every directory in the subtree; a single
+		// file keeps the recipients it has now
+		if !oldIsFile {
+			for dir, r := range oldSnap.recipients {
+				if err := checkRecipientsCertified(ctx, r); err != nil {
+					if _, ok := err.(UncertifiedKeyError); ok {
+						http.Error(rw, err.Error(), http.StatusBadRequest)
+					} else {
+						rlog(ctx, "Could not check recipient certifications: ", err)
+						http.Error(rw, "internal server error", http.StatusInternalServerError)
+					}
+					return
+				}
+				tx.SetRecipients(dir, r)
+			}
+			for dir := range snap.recipients {
+				if _, ok := oldSnap.recipients[dir]; !ok {
+					tx.SetRecipients(dir, nil)
+				}
+			}
+		}
+
+		// remove files that didn't exist at the old revision
+		oldFiles := make(map[string]bool, len(oldSnap.files))
+		for _, f := range oldSnap.files {
+			oldFiles[f] = true
+		}
+		for _, f := range snap.files {
+			if !oldFiles[f] {
+				tx.Delete(f)
+			}
+		}
+
+		// put back the old files, collecting the ones that need reencryption
+		resolve := storeKeyResolver(store)
+		reencrypt := make(map[string][]string)
+		for _, f := range oldSnap.files {
+			want := oldSnap.recipientsAfter(p, f, inherited)
+			if c, ok := req.Files[apiPath(ctx, f)]; ok {
+				tx.Put(f, c)
+			} else if c, err := old.Get(f); err != nil {
+				rlog(ctx, "Could not get old file contents: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else if keys, err := getRecipients(bytes.NewReader(c)); err != nil || !matchKeyIDs(keys, want, resolve) {
+				reencrypt[f] = want
+			} else {
+				tx.Put(f, c)
+			}
+		}
+		if len(reencrypt) > 0 {
+			renderReencrypt(ctx, rw, reencrypt)
+			return
+		}
+
+		message := req.Message
+		if message == "" {
+			message = fmt.Sprintf("Restored %s to revision %s.", "/"+p, req.Revision)
+		}
+		if err := tx.Commit(commitInfo(ctx, OpRestore, message)); err != nil {
+			commitError(ctx, rw, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"goji.io/pat"
+)
+
+func TestHandleRestore(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Post("/api/restore/*"), mounted(handlePostRestore))
+	admin := UserFromContext(h.ctx)
+	other, key := h.addUser("other")
+	tolar2 := tolar2Keys(t)[0]
+	shared := []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()}
+	type restore struct {
+		Revision string            `json:"revision"`
+		Files    map[string][]byte `json:"files,omitempty"`
+	}
+	commit := func(f func(tx PassTxW)) string {
+		tx, err := h.ps.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(tx)
+		if err := tx.Commit(CommitInfo{Message: "Test"}); err != nil {
+			t.Fatal(err)
+		}
+		if tx, err := h.ps.Begin(); err != nil {
+			t.Fatal(err)
+		} else if revs, err := tx.History("/"); err != nil {
+			t.Fatal(err)
+		} else {
+			return revs[0].Revision
+		}
+		return ""
+	}
+	begin := func() PassTx {
+		tx, err := h.ps.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	get := func(p string) []byte {
+		c, _ := begin().Get(p)
+		return c
+	}
+
+	// a file gets its old contents back
+	first := encryptForTest(t, "first")
+	rev := commit(func(tx PassTxW) { tx.Put("dir/a.gpg", first) })
+	commit(func(tx PassTxW) { tx.Put("dir/a.gpg", encryptForTest(t, "second")) })
+	if rw := h.do("POST", "/api/restore/dir/a.gpg", restore{Revision: rev}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Restore of a file: %d %s", rw.Code, rw.Body)
+	} else if !bytes.Equal(get("dir/a.gpg"), first) {
+		t.Error("Restore of a file didn't restore its contents")
+	} else if rw := h.do("POST", "/api/restore/dir/a.gpg", restore{Revision: "unknown"}, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("Restore to an unknown revision: %d %s", rw.Code, rw.Body)
+	}
+
+	// old contents not encrypted to the file's recipients now must be
+	// reencrypted by the client
+	var res reencryptResponse
+	reencrypted := encryptForTestTo(t, "first", tolar2, key)
+	commit(func(tx PassTxW) {
+		tx.SetRecipients("dir", shared)
+		tx.Put("dir/a.gpg", encryptForTestTo(t, "second", tolar2, key))
+	})
+	if rw := h.do("POST", "/api/restore/dir/a.gpg", restore{Revision: rev}, nil); rw.Code != http.StatusConflict {
+		t.Fatalf("Restore of a file with other recipients: %d %s", rw.Code, rw.Body)
+	} else if err := json.NewDecoder(rw.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	} else if r := res.Reencrypt["dir/a.gpg"]; len(res.Reencrypt) != 1 || len(r) != 2 {
+		t.Errorf("Restore asked to reencrypt %+v", res.Reencrypt)
+	} else if rw := h.do("POST", "/api/restore/dir/a.gpg", restore{rev, map[string][]byte{"dir/a.gpg": reencrypted}}, nil); rw.Code != http.StatusOK {
+		t.Fatalf("Restore with reencrypted files: %d %s", rw.Code, rw.Body)
+	} else if !bytes.Equal(get("dir/a.gpg"), reencrypted) {
+		t.Error("Restore didn't use the reencrypted file")
+	}
+
+	// users must be recipients of everything a restore changes, both now and
+	// at the restored revision
+	h.as(other)
+	rev = commit(func(tx PassTxW) {
+		tx.SetRecipients("dir/old", []string{tolar2PublicKeyID})
+		tx.Put("dir/old/b.gpg", encryptForTest(t, "b"))
+	})
+	commit(func(tx PassTxW) {
+		tx.Delete("dir/old/b.gpg")
+		tx.SetRecipients("dir/old", nil)
+		tx.SetRecipients("dir/new", []string{tolar2PublicKeyID})
+		tx.Put("dir/new/c.gpg", encryptForTest(t, "c"))
+	})
+	if rw := h.do("POST", "/api/restore/dir", restore{Revision: rev}, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("Restore over a file the user can't access: %d %s", rw.Code, rw.Body)
+	}
+	commit(func(tx PassTxW) {
+		tx.Delete("dir/new/c.gpg")
+		tx.SetRecipients("dir/new", nil)
+	})
+	if rw := h.do("POST", "/api/restore/dir", restore{Revision: rev}, nil); rw.Code != http.StatusForbidden {
+		t.Errorf("Restore of a file the user couldn't access: %d %s", rw.Code, rw.Body)
+	} else if exists, _ := begin().Type("dir/old"); exists {
+		t.Error("A forbidden restore was committed")
+	} else if rw := h.as(admin).do("POST", "/api/restore/dir", restore{Revision: rev}, nil); rw.Code != http.StatusOK {
+		t.Errorf("Restore of a directory: %d %s", rw.Code, rw.Body)
+	} else if !hasOwnRecipients(begin(), "dir/old") {
+		t.Error("Restore of a directory didn't restore its recipients")
+	}
+}
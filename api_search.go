@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 200
+)
+
+/*
+GET /api/search?q=query&mode=mode&limit=N - search the paths of passwords
+[
+	{
+		"name": "base name of the file, minus the .gpg",
+		"path": "full/path/to/file",
+		"score": 800
+	}
+]
+
+Every word of the query must match the path of a password (minus the .gpg),
+ignoring case. "mode" is "substring", "glob" (as in path.Match, against the
+base name or the whole path) or "fuzzy" (the characters in order, with gaps);
+without it, words with *, ? or [ are globs, and others substrings or, failing
+that, fuzzy matches. The best matches (up to "limit", 20 by default) are listed
+first: matches of the base name before those of the rest of the path, and
+substrings before fuzzy matches. Only passwords encrypted to the user's keys are
+listed, including those in mounts.
+*/
+func handleGetSearch(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(ctx)
+	q := r.URL.Query().Get("q")
+	mode := r.URL.Query().Get("mode")
+	limit := defaultSearchLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err != nil || n <= 0 || n > maxSearchLimit {
+			http.Error(rw, "invalid limit", http.StatusBadRequest)
+			return
+		} else {
+			limit = n
+		}
+	}
+	if q == "" {
+		http.Error(rw, "missing query", http.StatusBadRequest)
+		return
+	} else if mode != searchAuto && mode != searchSubstring && mode != searchGlob && mode != searchFuzzy {
+		http.Error(rw, "invalid mode", http.StatusBadRequest)
+		return
+	} else if uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(u.ID); err != nil {
+		rlog(ctx, "Could not get public keys: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		// the main store's directories named like mounts are hidden by them
+		stores := map[string]PassStore{"": PassFromContext(ctx)}
+		skip := make(map[string]bool)
+		for name := range MountsFromContext(ctx) {
+			skip[name] = true
+		}
+		for _, m := range visibleMounts(ctx) {
+			stores[m.Name] = m.Store
+		}
+
+		results := []searchResult{}
+		for name, ps := range stores {
+			if tx, err := ps.Begin(); err != nil {
+				rlog(ctx, "Could not start transaction: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else if ix, err := searchIndexFor(tx); err != nil {
+				rlog(ctx, "Could not index store: ", err)
+				http.Error(rw, "internal server error", http.StatusInternalServerError)
+				return
+			} else if name == "" {
+				results = append(results, ix.search(q, mode, uPubKeyIDs, name, skip)...)
+			} else {
+				results = append(results, ix.search(q, mode, uPubKeyIDs, name, nil)...)
+			}
+		}
+		sortSearchResults(results)
+		if len(results) > limit {
+			results = results[:limit]
+		}
+		if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, results); err != nil {
+			rlog(ctx, "Could not render JSON: ", err)
+		}
+	}
+}
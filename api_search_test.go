@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandleSearch(t *testing.T) {
+	h := newHandlerTest(t)
+	pw := encryptForTest(t, "password")
+	// files the user can't decrypt wouldn't be committed, so make a revision
+	// directly
+	h.ps.revisions = append(h.ps.revisions, memRevision{files: memFiles{
+		".gpg-id":                 []byte(tolar2PublicKeyID + "\n"),
+		"staging/rds.gpg":         pw,
+		"staging/web.gpg":         pw,
+		"production/rds.gpg":      pw,
+		"production/rds-old.gpg":  pw,
+		"private/.gpg-id":         []byte(otherKeyID + "\n"),
+		"private/staging-rds.gpg": pw,
+		"team/hidden.gpg":         pw,
+		// attachments are only skipped next to their entry
+		"staging/web.attachments/ssh.gpg": pw,
+		"keys.attachments/ssh.gpg":        pw,
+	}})
+	team := NewMemPass()
+	team.revisions = append(team.revisions, memRevision{files: memFiles{
+		".gpg-id":     []byte(tolar2PublicKeyID + "\n"),
+		"rds/web.gpg": pw,
+	}})
+	h.ctx = ContextWithMounts(h.ctx, map[string]Mount{"team": {Name: "team", Store: team}})
+
+	search := func(query string) []string {
+		var results []searchResult
+		if rw := h.do("GET", "/api/search?"+query, nil, &results); rw.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", query, rw.Code, rw.Body)
+		}
+		paths := make([]string, len(results))
+		for i, r := range results {
+			paths[i] = r.Path
+		}
+		return paths
+	}
+	expect := func(query string, want ...string) {
+		got := search(query)
+		if len(got) != len(want) {
+			t.Errorf("%s: got %q; want %q", query, got, want)
+			return
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %q; want %q", query, got, want)
+				return
+			}
+		}
+	}
+
+	// exact base names first, then prefixes, then elsewhere in the path
+	expect("q=rds", "/staging/rds.gpg", "/production/rds.gpg", "/production/rds-old.gpg", "/team/rds/web.gpg")
+	expect("q=Staging+RDS", "/staging/rds.gpg")
+	expect("q=ssh", "/keys.attachments/ssh.gpg")
+	expect("q=*-old", "/production/rds-old.gpg")
+	expect("q=staging/*&mode=glob", "/staging/rds.gpg", "/staging/web.gpg")
+	expect("q=prdrds", "/production/rds.gpg", "/production/rds-old.gpg")
+	expect("q=prdrds&mode=substring")
+	expect("q=rds&limit=1", "/staging/rds.gpg")
+
+	if rw := h.do("GET", "/api/search", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("GET without a query: %d", rw.Code)
+	} else if rw := h.do("GET", "/api/search?q=rds&mode=regexp", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("GET with an unknown mode: %d", rw.Code)
+	}
+
+	// the index of a revision is kept
+	if tx, err := h.ps.Begin(); err != nil {
+		t.Fatal(err)
+	} else if v, err := tx.Version("/"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := searchIndexes.Get(v); !ok {
+		t.Error("The index of the searched revision wasn't cached")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// treeNode is a file or directory in the response of GET /api/tree/*.
+type treeNode struct {
+	Name          string      `json:"name"`
+	Path          string      `json:"path"`
+	Type          string      `json:"type"`
+	Mount         bool        `json:"mount,omitempty"`
+	Recipients    []string    `json:"recipients,omitempty"`
+	OwnRecipients bool        `json:"ownRecipients,omitempty"`
+	Version       string      `json:"version,omitempty"`
+	Modified      *time.Time  `json:"modified,omitempty"`
+	Children      []*treeNode `json:"children,omitempty"`
+	Truncated     bool        `json:"truncated,omitempty"`
+
+	depth int
+}
+
+// passTree walks the subtree of tx at root, down to maxDepth levels below it
+// (or all of them if maxDepth is negative).
+func passTree(ctx context.Context, tx PassTx, root string, maxDepth int) (*treeNode, error) {
+	root = cleanPassPath(root)
+	nodes := make(map[string]*treeNode)
+	var paths []string
+	mountNames := make(map[string]bool)
+	if root == "" && !inMount(ctx) {
+		for name := range MountsFromContext(ctx) {
+			mountNames[name] = true
+		}
+	}
+
+	err := PassWalk(tx, root, func(d PassDirent) error {
+		p := cleanPassPath(d.Name)
+		var parent *treeNode
+		if p != root {
+			// skip what GET /api/pass/* doesn't list
+			if d.File && !strings.HasSuffix(p, ".gpg") {
+				return nil
+			} else if !d.File && (isAttachmentDir(tx, p) || mountNames[p]) {
+				return filepath.SkipDir
+			}
+			dir := ""
+			if i := strings.LastIndex(p, "/"); i >= 0 {
+				dir = p[:i]
+			}
+			parent = nodes[dir]
+		}
+
+		n := &treeNode{Path: apiPath(ctx, "/"+p), Type: "file"}
+		n.Name = apiPassName(n.Path)
+		if parent != nil {
+			n.depth = parent.depth + 1
+			parent.Children = append(parent.Children, n)
+		}
+		nodes[p] = n
+		paths = append(paths, p)
+
+		if v, err := tx.Version(p); err != nil {
+			return err
+		} else {
+			n.Version = v
+		}
+		if d.File && parent != nil {
+			n.Recipients = parent.Recipients
+			return nil
+		} else if r, err := tx.Recipients(p); err != nil {
+			return err
+		} else {
+			n.Recipients = r
+		}
+		if !d.File {
+			n.Type = "dir"
+			n.OwnRecipients = hasOwnRecipients(tx, p)
+			if maxDepth >= 0 && n.depth >= maxDepth {
+				n.Truncated = true
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	revs, err := lastChanges(tx, paths)
+	if err != nil {
+		return nil, err
+	}
+	for p, n := range nodes {
+		if rev, ok := revs[p]; ok {
+			t := rev.Time
+			n.Modified = &t
+		}
+	}
+
+	top := nodes[root]
+	if len(mountNames) > 0 {
+		var mounts []*treeNode
+		for _, m := range visibleMounts(ctx) {
+			mounts = append(mounts, &treeNode{Name: m.Name, Path: "/" + m.Name, Type: "dir", Mount: true})
+		}
+		top.Children = append(mounts, top.Children...)
+	}
+	return top, nil
+}
+
+/*
+GET /api/tree/*?depth=N - get a password or directory with everything below it
+{
+	"name": "base name of the file, minus the .gpg",
+	"path": "full/path/to/file/or/directory",
+	"type": "'dir' or 'file'",
+	"recipients": ["key","ids","that","can","access"],
+	"ownRecipients": true,
+	"version": "blob or tree ID",
+	"modified": "time of the last commit that changed it",
+	"children": [
+		{
+			"name": "name of the child",
+			...
+		}
+	],
+	"truncated": true
+}
+
+Everything is read from the same revision of the store. "ownRecipients" is set
+for directories with a .gpg-id of their own, and "recipients" are those files
+are encrypted to, whether inherited or not. Directories deeper than depth
+(unlimited if not given) are "truncated", without their children. Mounts are
+listed at the root of the main store, with "mount" set and nothing more; their
+trees are at /api/tree/<mount>.
+*/
+func handleGetTree(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	p := passPath(ctx)
+	ps := PassFromContext(ctx)
+	depth := -1
+	if d := r.URL.Query().Get("depth"); d != "" {
+		if n, err := strconv.Atoi(d); err != nil || n < 0 {
+			http.Error(rw, "invalid depth", http.StatusBadRequest)
+			return
+		} else {
+			depth = n
+		}
+	}
+	if err := validatePassPath(p, passPathAny); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if tx, err := ps.Begin(); err != nil {
+		rlog(ctx, "Could not start transaction: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if exists, _ := tx.Type(p); !exists {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if tree, err := passTree(ctx, tx, p, depth); err != nil {
+		rlog(ctx, "Could not walk store: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else if err := RenderFromContext(ctx).JSON(rw, http.StatusOK, tree); err != nil {
+		rlog(ctx, "Could not render JSON: ", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHandleTree(t *testing.T) {
+	h := newHandlerTest(t)
+	pw := encryptForTest(t, "password")
+	if tx, err := h.ps.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("/own", []string{tolar2PublicKeyID})
+		for _, p := range []string{"/a.gpg", "/a.attachments/e.gpg", "/old.attachments/f.gpg", "/dir/b.gpg", "/dir/sub/c.gpg", "/own/d.gpg"} {
+			tx.Put(p, pw)
+		}
+		if err := tx.Commit(CommitInfo{Message: "Add files"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tree treeNode
+	find := func(n *treeNode, name string) *treeNode {
+		for _, c := range n.Children {
+			if c.Name == name {
+				return c
+			}
+		}
+		t.Fatalf("%s has no child %s: %+v", n.Path, name, n.Children)
+		return nil
+	}
+	if rw := h.do("GET", "/api/tree/", nil, &tree); rw.Code != http.StatusOK {
+		t.Fatalf("GET: %d %s", rw.Code, rw.Body)
+	} else if tree.Type != "dir" || len(tree.Children) != 4 || tree.Modified == nil {
+		t.Fatalf("Unexpected root: %+v", tree)
+	} else if old := find(&tree, "old.attachments"); old.Type != "dir" {
+		t.Errorf("A directory named like attachments without an entry is a %s", old.Type)
+	} else if c := find(find(find(&tree, "dir"), "sub"), "c"); c.Type != "file" || c.Path != "/dir/sub/c.gpg" || len(c.Recipients) != 1 || c.Version == "" || c.Modified == nil {
+		t.Errorf("Unexpected file: %+v", c)
+	} else if own := find(&tree, "own"); !own.OwnRecipients || find(&tree, "dir").OwnRecipients {
+		t.Error("ownRecipients isn't set only for directories with a .gpg-id")
+	}
+
+	tree = treeNode{}
+	if rw := h.do("GET", "/api/tree/dir?depth=1", nil, &tree); rw.Code != http.StatusOK {
+		t.Fatalf("GET with a depth: %d %s", rw.Code, rw.Body)
+	} else if sub := find(&tree, "sub"); !sub.Truncated || len(sub.Children) != 0 {
+		t.Errorf("A directory below the depth wasn't truncated: %+v", sub)
+	} else if rw := h.do("GET", "/api/tree/dir?depth=x", nil, nil); rw.Code != http.StatusBadRequest {
+		t.Errorf("GET with an invalid depth: %d", rw.Code)
+	} else if rw := h.do("GET", "/api/tree/missing", nil, nil); rw.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing directory: %d", rw.Code)
+	}
+}
@@ -100,3 +100,46 @@ func Auth(next goji.Handler) goji.Handler {
 		next.ServeHTTPC(ctx, rw, r)
 	})
 }
+
+// GitAuth is like Auth, for git clients: without a session cookie, it asks
+// for the user's login password with HTTP basic auth.
+func GitAuth(next goji.Handler) goji.Handler {
+	return goji.HandlerFunc(func(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+		config := ConfigFromContext(ctx)
+		var s Session
+
+		if cookie, err := r.Cookie(config.CookieName); err == nil {
+			if err := SecureCookieFromContext(ctx).Decode(config.CookieName, cookie.Value, &s); err != nil {
+				http.Error(rw, "invalid auth cookie", http.StatusBadRequest)
+				return
+			}
+		} else if id, pass, ok := r.BasicAuth(); !ok {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="pass"`)
+			http.Error(rw, "authentication required", http.StatusUnauthorized)
+			return
+		} else if u, err := GetUser(ctx, id); err != nil || bcrypt.CompareHashAndPassword(u.Password, []byte(pass)) != nil {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="pass"`)
+			http.Error(rw, "unknown user or bad password", http.StatusUnauthorized)
+			return
+		} else {
+			s = Session{
+				UserID: u.ID,
+				Time:   time.Now(),
+			}
+		}
+
+		u, err := GetUser(ctx, s.UserID)
+		if err != nil {
+			rlogf(ctx, "Got unknown user %q from auth cookie: %v", s.UserID, err)
+			http.Error(rw, "unknown user", http.StatusBadRequest)
+			return
+		}
+
+		rlogf(ctx, "Authenticated git client as %q", s.UserID)
+
+		ctx = ContextWithSession(ctx, s)
+		ctx = ContextWithUser(ctx, u)
+
+		next.ServeHTTPC(ctx, rw, r)
+	})
+}
@@ -1,15 +1,84 @@
 package main
 
+import "time"
+
 type Config struct {
 	CookieSecret []byte
 	CookieName   string
 	Dev          bool
-	DB           struct {
+	// Admins lists the IDs of users allowed to use the /api/admin endpoints.
+	Admins []string
+	DB     struct {
 		Driver string
 		DSN    string
 	}
-	Git struct {
+	// PassStore is where the passwords are kept: "git" (the default) for the
+	// repository in Git, or "sql" for the database in DB.
+	PassStore string
+	Git       struct {
 		Root   string
 		Branch string
+		// Backend is "native" to read and write the repository without the
+		// git binary, or "exec" (the default) to use it. The native backend
+		// can't sync with Remotes or serve the repository to git clients.
+		Backend string
+		// EmailDomain is the domain of the email addresses of commit authors,
+		// <user ID>@<EmailDomain>. It defaults to the host name.
+		EmailDomain string
+		// Remotes are repositories to keep the store in sync with.
+		Remotes []RemoteConfig
+	}
+	// Mounts are more stores, each served as a top-level directory of the
+	// main one.
+	Mounts      []MountConfig
+	Attachments struct {
+		// MaxSize is the largest attachment that may be uploaded, in bytes.
+		// Zero means defaultMaxAttachmentSize.
+		MaxSize int64
+	}
+	Signing struct {
+		// KeyFile is an armored private key to sign commits and .gpg-id files
+		// with. Empty disables signing.
+		KeyFile    string
+		Passphrase string
+		// TrustedKeysFile is an armored key ring of the keys (besides KeyFile's)
+		// that may sign .gpg-id files, e.g. of users who push with
+		// PASSWORD_STORE_SIGNING_KEY. If there are no trusted keys at all,
+		// signatures are not checked.
+		TrustedKeysFile string
+	}
+	Trust struct {
+		// OrgKeyID is the ID of an external public key that must have
+		// certified a recipient key before it can be added to a .gpg-id. An
+		// empty OrgKeyID disables the policy.
+		OrgKeyID string
+	}
+}
+
+type RemoteConfig struct {
+	Remote
+	// SyncInterval is the time between automatic syncs; zero disables them,
+	// leaving only syncs requested through the API.
+	SyncInterval time.Duration
+}
+
+type MountConfig struct {
+	// Name is the top-level directory the store is served as.
+	Name string
+	// PassStore is "git" (the default) for the repository in Git, or "sql"
+	// for the database in DB.
+	PassStore string
+	Git       struct {
+		Root string
+		// Branch and Backend default to those of the main repository.
+		Branch  string
+		Backend string
+	}
+	DB struct {
+		Driver string
+		DSN    string
 	}
+	// Users lists the IDs of the users who may see the mount. Everyone may if
+	// it's empty.
+	Users []string
 }
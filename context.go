@@ -20,6 +20,9 @@ const (
 	ctxSecureCookieKey
 	ctxRenderKey
 	ctxPassKey
+	ctxMountsKey
+	ctxMountKey
+	ctxPassPathKey
 )
 
 func rlog(ctx context.Context, args ...interface{}) {
@@ -79,3 +82,13 @@ func PassFromContext(ctx context.Context) PassStore {
 func ContextWithPass(parent context.Context, ps PassStore) context.Context {
 	return context.WithValue(parent, ctxPassKey, ps)
 }
+
+// MountsFromContext returns the mounts by name; there are none if the context
+// has no mount table.
+func MountsFromContext(ctx context.Context) map[string]Mount {
+	ms, _ := ctx.Value(ctxMountsKey).(map[string]Mount)
+	return ms
+}
+func ContextWithMounts(parent context.Context, ms map[string]Mount) context.Context {
+	return context.WithValue(parent, ctxMountsKey, ms)
+}
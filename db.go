@@ -34,6 +34,23 @@ CREATE TABLE IF NOT EXISTS private_keys (
 	uid TEXT NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
 	armored BLOB NOT NULL
 ); -- potentially WITHOUT ROWID
+
+
+CREATE TABLE IF NOT EXISTS change_requests (
+	id TEXT PRIMARY KEY NOT NULL,
+	uid TEXT NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+	message TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created DATETIME NOT NULL
+);
+
+
+CREATE TABLE IF NOT EXISTS change_reviewers (
+	id TEXT NOT NULL REFERENCES change_requests(id) ON DELETE CASCADE,
+	uid TEXT NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+	decision TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (id, uid)
+);
 `
 
 func initDB(driver, dsn string) (DBStore, error) {
@@ -204,6 +221,15 @@ func (s DBStore) AddExternalPublicKey(keyID string, armoredKey []byte) error {
 	return tx.Commit()
 }
 
+func (s DBStore) PutPublicKey(keyID string, armoredKey []byte) error {
+	if r, err := s.DB.Exec(`UPDATE public_keys SET armored = ? WHERE kid = ?;`, armoredKey, keyID); err != nil {
+		return err
+	} else if count, err := r.RowsAffected(); err == nil && count == 0 {
+		return ErrUnknownKey
+	}
+	return nil
+}
+
 func (s DBStore) GetUserForPublicKey(keyID string) (string, error) {
 	var userID sql.NullString
 	err := s.DB.Get(&userID, `SELECT uid FROM public_keys WHERE kid = ?;`, keyID)
@@ -292,3 +318,74 @@ func (s DBStore) GetPrivateKey(keyID string) (string, []byte, error) {
 	err := s.DB.Get(&key, `SELECT uid, armored FROM private_keys WHERE kid = ?;`, keyID)
 	return key.UserID.String, key.ArmoredKey, err
 }
+
+func (s DBStore) AddChangeRequest(c ChangeRequest) error {
+	if c.ID == "" {
+		return ErrMissingID
+	}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO change_requests (id, uid, message, status, created) VALUES (?, ?, ?, ?, ?);`,
+		c.ID, c.UserID, c.Message, c.Status, c.Created,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, r := range c.Reviewers {
+		if _, err := tx.Exec(`INSERT INTO change_reviewers (id, uid, decision) VALUES (?, ?, ?);`, c.ID, r.UserID, r.Decision); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s DBStore) GetChangeRequest(id string) (ChangeRequest, error) {
+	var c ChangeRequest
+	if err := s.DB.Get(&c, `SELECT id, uid, message, status, created FROM change_requests WHERE id = ?;`, id); err != nil {
+		return c, err
+	}
+	err := s.DB.Select(&c.Reviewers, `SELECT uid, decision FROM change_reviewers WHERE id = ? ORDER BY uid;`, id)
+	return c, err
+}
+
+func (s DBStore) ListChangeRequests(userID string) ([]ChangeRequest, error) {
+	var ids []string
+	if err := s.DB.Select(&ids, `SELECT id FROM change_requests
+	                             WHERE uid = ? OR id IN (SELECT id FROM change_reviewers WHERE uid = ?)
+	                             ORDER BY created DESC, id;`,
+		userID, userID,
+	); err != nil {
+		return nil, err
+	}
+
+	ret := make([]ChangeRequest, 0, len(ids))
+	for _, id := range ids {
+		if c, err := s.GetChangeRequest(id); err != nil {
+			return nil, err
+		} else {
+			ret = append(ret, c)
+		}
+	}
+	return ret, nil
+}
+
+func (s DBStore) SetChangeRequestStatus(id, from, status string) error {
+	if r, err := s.DB.Exec(`UPDATE change_requests SET status = ? WHERE id = ? AND status = ?;`, status, id, from); err != nil {
+		return err
+	} else if count, err := r.RowsAffected(); err == nil && count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s DBStore) SetChangeReview(id, userID, decision string) error {
+	if r, err := s.DB.Exec(`UPDATE change_reviewers SET decision = ? WHERE id = ? AND uid = ?;`, decision, id, userID); err != nil {
+		return err
+	} else if count, err := r.RowsAffected(); err == nil && count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
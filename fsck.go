@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Kinds of FsckProblem.
+const (
+	// FsckMissingRecipients is a file that isn't encrypted to some of its
+	// recipients.
+	FsckMissingRecipients = "missingRecipients"
+	// FsckExtraRecipients is a file encrypted to keys of no recipient.
+	FsckExtraRecipients = "extraRecipients"
+	// FsckUnknownKeys is a .gpg-id naming keys the server doesn't have, so
+	// their subkeys can't be told apart from extra recipients.
+	FsckUnknownKeys = "unknownKeys"
+	// FsckUnparsable is a file that isn't an OpenPGP encrypted message.
+	FsckUnparsable = "unparsable"
+	// FsckEmptyRecipients is a .gpg-id without any recipients.
+	FsckEmptyRecipients = "emptyRecipients"
+	// FsckStrayFile is a file whose name doesn't end in .gpg.
+	FsckStrayFile = "strayFile"
+	// FsckGpgDirectory is a directory whose name ends in .gpg.
+	FsckGpgDirectory = "gpgDirectory"
+	// FsckBadRecipients is a .gpg-id that can't be read as the recipients of
+	// the files below it, such as one without a trusted signature.
+	FsckBadRecipients = "badRecipients"
+)
+
+// FsckProblem is an inconsistency that fsckPass found in a store, such as a
+// file encrypted with pass and pushed before the server checked pushes.
+type FsckProblem struct {
+	Path string `json:"path"`
+	// Kind is one of the Fsck constants.
+	Kind string `json:"kind"`
+	// KeyIDs are the recipients or keys the problem is about, if any.
+	KeyIDs []string `json:"keyIds,omitempty"`
+	// Error describes why a file is unparsable, or its recipients are bad.
+	Error string `json:"error,omitempty"`
+}
+
+func (p FsckProblem) String() string {
+	var what string
+	switch p.Kind {
+	case FsckMissingRecipients:
+		what = fmt.Sprintf("not encrypted to recipients %v", p.KeyIDs)
+	case FsckExtraRecipients:
+		what = fmt.Sprintf("encrypted to keys of no recipient %v", p.KeyIDs)
+	case FsckUnknownKeys:
+		what = fmt.Sprintf("no public key for recipients %v", p.KeyIDs)
+	case FsckUnparsable:
+		what = "not an OpenPGP encrypted file: " + p.Error
+	case FsckEmptyRecipients:
+		what = "empty " + recipientFile
+	case FsckStrayFile:
+		what = "not a .gpg file"
+	case FsckGpgDirectory:
+		what = "directory named like a .gpg file"
+	case FsckBadRecipients:
+		what = "bad recipients: " + p.Error
+	default:
+		what = p.Kind
+	}
+	return "/" + p.Path + ": " + what
+}
+
+// FsckReport is the result of checking a store with fsckPass.
+type FsckReport struct {
+	// Files is the number of files checked.
+	Files    int           `json:"files"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// fsckPass walks tx, checking that every file is encrypted to exactly the
+// recipients of its directory, as resolve knows their keys.
+func fsckPass(tx PassTx, resolve KeyResolver) (FsckReport, error) {
+	report := FsckReport{Problems: []FsckProblem{}}
+	add := func(p FsckProblem) {
+		report.Problems = append(report.Problems, p)
+	}
+	badRecipients := make(map[string]bool)
+
+	err := PassWalk(tx, "/", func(d PassDirent) error {
+		p := cleanPassPath(d.Name)
+		if !d.File {
+			if strings.HasSuffix(p, ".gpg") {
+				add(FsckProblem{Path: p, Kind: FsckGpgDirectory})
+			}
+			r := path.Join(p, recipientFile)
+			if exists, isFile := tx.Type(r); !exists || !isFile {
+				return nil
+			} else if c, err := tx.Get(r); err != nil {
+				return err
+			} else if recipients := splitRecipients(c); len(recipients) == 0 {
+				add(FsckProblem{Path: r, Kind: FsckEmptyRecipients})
+			} else {
+				var unknown []string
+				for _, k := range recipients {
+					if resolve == nil || resolve(k) == nil {
+						unknown = append(unknown, k)
+					}
+				}
+				if len(unknown) > 0 {
+					add(FsckProblem{Path: r, Kind: FsckUnknownKeys, KeyIDs: unknown})
+				}
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(p, ".gpg") {
+			add(FsckProblem{Path: p, Kind: FsckStrayFile})
+			return nil
+		}
+		report.Files++
+		c, err := tx.Get(p)
+		if err != nil {
+			return err
+		}
+		recipients, err := tx.Recipients(p)
+		if serr, ok := err.(SignatureError); ok {
+			// reported once, for the .gpg-id of every file below it
+			if r := cleanPassPath(serr.Path); !badRecipients[r] {
+				badRecipients[r] = true
+				add(FsckProblem{Path: r, Kind: FsckBadRecipients, Error: serr.Err.Error()})
+			}
+			return nil
+		} else if err != nil {
+			add(FsckProblem{Path: p, Kind: FsckBadRecipients, Error: err.Error()})
+			return nil
+		}
+		keys, err := getRecipients(bytes.NewReader(c))
+		if err == nil && len(keys) == 0 {
+			err = errors.New("not encrypted to any key")
+		}
+		if err != nil {
+			add(FsckProblem{Path: p, Kind: FsckUnparsable, Error: err.Error()})
+			return nil
+		}
+
+		owner := keyOwners(recipients, resolve)
+		found := make(map[string]bool)
+		var missing, extra []string
+		for _, k := range keys {
+			if r, ok := owner[normalizeKeyID(k)]; ok {
+				found[r] = true
+			} else {
+				extra = append(extra, k)
+			}
+		}
+		for _, r := range recipients {
+			if r != "" && !found[normalizeKeyID(r)] {
+				missing = append(missing, r)
+			}
+		}
+		if len(missing) > 0 {
+			add(FsckProblem{Path: p, Kind: FsckMissingRecipients, KeyIDs: missing})
+		}
+		if len(extra) > 0 {
+			add(FsckProblem{Path: p, Kind: FsckExtraRecipients, KeyIDs: extra})
+		}
+		return nil
+	})
+	return report, err
+}
+
+// splitRecipients returns the recipients listed in the contents of a .gpg-id
+// file.
+func splitRecipients(c []byte) []string {
+	var ret []string
+	for _, l := range strings.Split(string(c), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// fsckCommand checks the store of the server and its mounts, printing the
+// problems it finds. It fails if there are any.
+func fsckCommand(config Config) int {
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "fsck: %v\n", err)
+		return 1
+	}
+
+	db, err := initDB(config.DB.Driver, config.DB.DSN)
+	if err != nil {
+		return fail(err)
+	}
+	var ps PassStore
+	if config.PassStore == "sql" {
+		if sp, err := NewSQLPass(db); err != nil {
+			return fail(err)
+		} else {
+			ps = sp
+		}
+	} else {
+		newPass := NewGitPass
+		if config.Git.Backend == "native" {
+			newPass = NewNativeGitPass
+		}
+		// checking a store mustn't create one
+		if _, err := os.Stat(config.Git.Root); err != nil {
+			return fail(err)
+		} else if g, err := newPass(config.Git.Root, config.Git.Branch, false); err != nil {
+			return fail(err)
+		} else if signer, trusted, err := loadSigningConfig(config); err != nil {
+			return fail(err)
+		} else {
+			g.SetSigningKey(signer)
+			g.SetTrustedKeys(trusted)
+			ps = g
+		}
+	}
+	stores := map[string]PassStore{"": ps}
+	if mounts, err := openMounts(config, db); err != nil {
+		return fail(err)
+	} else {
+		for name, m := range mounts {
+			stores[name] = m.Store
+		}
+	}
+
+	report, err := fsckStores(stores, storeKeyResolver(db))
+	if err != nil {
+		return fail(err)
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("checked %d files, found %d problems\n", report.Files, len(report.Problems))
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// fsckStores checks several stores, by the directory they are mounted at
+// (the empty string for the main store), in a single report.
+func fsckStores(stores map[string]PassStore, resolve KeyResolver) (FsckReport, error) {
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := FsckReport{Problems: []FsckProblem{}}
+	for _, name := range names {
+		tx, err := stores[name].Begin()
+		if err != nil {
+			return report, err
+		}
+		r, err := fsckPass(tx, resolve)
+		if err != nil {
+			return report, fmt.Errorf("/%s: %v", name, err)
+		}
+		report.Files += r.Files
+		for _, p := range r.Problems {
+			p.Path = path.Join(name, p.Path)
+			report.Problems = append(report.Problems, p)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestFsck(t *testing.T) {
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+
+	// the store wouldn't commit most of these, so make them a revision
+	// directly
+	pw := encryptForTest(t, "password")
+	m := NewMemPass()
+	m.revisions = append(m.revisions, memRevision{files: memFiles{
+		".gpg-id":       []byte(tolar2PublicKeyID + "\n"),
+		"ok.gpg":        pw,
+		"plain.gpg":     []byte("plain"),
+		"README":        []byte("readme"),
+		"dir.gpg/a.gpg": pw,
+		"other/.gpg-id": []byte("DEADBEEFDEADBEEF\n"),
+		"other/a.gpg":   pw,
+		"empty/.gpg-id": []byte("\n"),
+		"empty/a.gpg":   pw,
+	}})
+
+	tx, err := m.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := fsckPass(tx, storeKeyResolver(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range report.Problems {
+		got = append(got, p.Path+" "+p.Kind)
+	}
+	sort.Strings(got)
+	expected := []string{
+		"README " + FsckStrayFile,
+		"dir.gpg " + FsckGpgDirectory,
+		"empty/.gpg-id " + FsckEmptyRecipients,
+		"empty/a.gpg " + FsckExtraRecipients,
+		"other/.gpg-id " + FsckUnknownKeys,
+		"other/a.gpg " + FsckExtraRecipients,
+		"other/a.gpg " + FsckMissingRecipients,
+		"plain.gpg " + FsckUnparsable,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected problems:\n%q\nexpected\n%q", got, expected)
+	} else if report.Files != 5 {
+		t.Errorf("Checked %d files, expected 5", report.Files)
+	}
+	for _, p := range report.Problems {
+		if p.Kind == FsckMissingRecipients && !reflect.DeepEqual(p.KeyIDs, []string{"DEADBEEFDEADBEEF"}) {
+			t.Errorf("Unexpected missing recipients: %v", p.KeyIDs)
+		}
+	}
+
+	// mounted stores are reported under their directory
+	if report, err := fsckStores(map[string]PassStore{"": NewMemPass(), "team": m}, storeKeyResolver(db)); err != nil {
+		t.Fatal(err)
+	} else if len(report.Problems) != len(expected) || report.Problems[0].Path[:5] != "team/" {
+		t.Errorf("Unexpected problems in mount: %+v", report.Problems)
+	}
+}
+
+func TestFsckSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	key, err := openpgp.NewEntity("pass", "", "pass@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGitPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetKeyResolver(storeKeyResolver(db))
+	g.SetSigningKey(key)
+	g.SetTrustedKeys(openpgp.EntityList{key})
+	if tx, err := g.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		tx.SetRecipients("/own", []string{tolar2PublicKeyID})
+		tx.Put("/a.gpg", encryptForTest(t, "a"))
+		tx.Put("/own/b.gpg", encryptForTest(t, "b"))
+		tx.Put("/own/c.gpg", encryptForTest(t, "c"))
+		if err := tx.Commit(CommitInfo{UserID: "test", Message: "Set recipients"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// recipients changed behind the server's back
+	u := pushForTest(t, g, "refs/heads/master", map[string][]byte{"own/.gpg-id": []byte(tolar2PublicKeyID + "\n" + tolar2PublicKeyID)})
+	if err := g.git("update-ref", "refs/heads/master", u.New, u.Old); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := g.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := fsckPass(tx, storeKeyResolver(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range report.Problems {
+		got = append(got, p.Path+" "+p.Kind)
+	}
+	if expected := []string{"own/.gpg-id " + FsckBadRecipients}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected problems:\n%q\nexpected\n%q", got, expected)
+	} else if report.Files != 3 {
+		t.Errorf("Checked %d files, expected 3", report.Files)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"goji.io"
+
+	"golang.org/x/net/context"
+)
+
+// gitHTTPServer is implemented by PassStores whose repository can be served
+// to git clients.
+type gitHTTPServer interface {
+	// HTTPBackend returns a handler for git's smart HTTP protocol, serving the
+	// repository at prefix to userID.
+	HTTPBackend(prefix, userID string) (http.Handler, error)
+}
+
+// RepoName is the name of the repository in git URLs: it's cloned from
+// /git/<RepoName>.
+func (g *GitPass) RepoName() string {
+	return filepath.Base(g.repoRoot)
+}
+
+// HTTPBackend runs git http-backend, so the repositories of the native
+// backend (which have no pre-receive hook to check pushes) aren't served.
+func (g *GitPass) HTTPBackend(prefix, userID string) (http.Handler, error) {
+	if g.isNative() {
+		return nil, ErrNativeUnsupported
+	}
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, err
+	}
+	root, err := filepath.Abs(g.repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Root: prefix,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			// REMOTE_USER enables receive-pack, and tells the pre-receive hook
+			// who is pushing
+			"REMOTE_USER=" + userID,
+			"GPM_WORKDIR=" + wd,
+		},
+		InheritEnv: []string{"PATH"},
+	}, nil
+}
+
+/*
+GET, POST /git/<repository>/* - git smart HTTP
+
+Clone with git clone http://<user>@<host>/git/password-store.git; the
+password is the user's login password. Pushes are checked like API requests
+by the repository's pre-receive hook (see preReceive).
+*/
+func handleGit(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	u := UserFromContext(ctx)
+	if s, ok := PassFromContext(ctx).(interface {
+		gitHTTPServer
+		RepoName() string
+	}); !ok {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if prefix := "/git/" + s.RepoName(); r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if h, err := s.HTTPBackend(prefix, u.ID); err == ErrNativeUnsupported {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rlog(ctx, "Could not start git: ", err)
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	} else {
+		h.ServeHTTP(rw, r)
+	}
+}
+
+// unlessPrefix applies middleware mw to all requests except those for paths
+// starting with prefix.
+func unlessPrefix(prefix string, mw func(goji.Handler) goji.Handler) func(goji.Handler) goji.Handler {
+	return func(next goji.Handler) goji.Handler {
+		wrapped := mw(next)
+		return goji.HandlerFunc(func(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTPC(ctx, rw, r)
+			} else {
+				wrapped.ServeHTTPC(ctx, rw, r)
+			}
+		})
+	}
+}
@@ -35,35 +35,62 @@ func main() {
 		CookieSecret: []byte("alskjdlkfaj zxcxvnafsflkasj rewoiiw"),
 		CookieName:   "pass",
 		Dev:          true,
+		Admins:       []string{"tolar2"},
 	}
 	config.DB.DSN = "file:db.db?cache=shared&mode=rwc"
 	config.DB.Driver = "sqlite3"
 	config.Git.Root = "password-store.git"
 	config.Git.Branch = "master"
 
+	// the server doubles as the repository's pre-receive hook
+	if len(os.Args) > 1 && os.Args[1] == "pre-receive" {
+		os.Exit(preReceive(config))
+	}
+	// moving the passwords between a git repository and the database
+	if len(os.Args) == 3 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		os.Exit(migrateCommand(config, os.Args[1], os.Args[2]))
+	}
+	// checking that the files match their recipients
+	if len(os.Args) == 2 && os.Args[1] == "fsck" {
+		os.Exit(fsckCommand(config))
+	}
+	// signing the .gpg-id files of a store that had no signing key
+	if len(os.Args) == 2 && os.Args[1] == "sign-recipients" {
+		os.Exit(signRecipientsCommand(config))
+	}
+
 	sc := securecookie.New(config.CookieSecret, nil)
 	sc.SetSerializer(securecookie.JSONEncoder{})
 
 	rootCtx := context.Background()
 	rootCtx = ContextWithConfig(rootCtx, config)
-	if db, err := initDB(config.DB.Driver, config.DB.DSN); err != nil {
+	db, err := initDB(config.DB.Driver, config.DB.DSN)
+	if err != nil {
 		log.Fatal("Could not open database: ", err)
 	} else {
 		addDefaults(db)
 		rootCtx = ContextWithStore(rootCtx, db)
 	}
-	if ps, err := NewGitPass("password-store.git", "master", config.Dev); err != nil {
-		log.Fatal("Could not open git repo: ", err)
+	var ps PassStore
+	if config.PassStore == "sql" {
+		if sp, err := NewSQLPass(db); err != nil {
+			log.Fatal("Could not open the password database: ", err)
+		} else {
+			sp.SetKeyResolver(storeKeyResolver(db))
+			ps = sp
+		}
 	} else {
-		if tx, err := ps.BeginW(); err != nil {
-			log.Fatal(err)
-		} else if rs, err := tx.Recipients("/"); err != nil || len(rs) == 0 {
-			tx.SetRecipients("/", []string{tolar2PublicKeyID})
-			if err := tx.Commit("admin", "Set initial recipients"); err != nil {
-				log.Fatal(err)
-			}
+		ps = openGitPass(config, db)
+	}
+	setInitialRecipients(ps)
+	rootCtx = ContextWithPass(rootCtx, ps)
+	if mounts, err := openMounts(config, db); err != nil {
+		log.Fatal("Could not open mounts: ", err)
+	} else {
+		for _, m := range mounts {
+			setInitialRecipients(m.Store)
 		}
-		rootCtx = ContextWithPass(rootCtx, ps)
+		rootCtx = ContextWithMounts(rootCtx, mounts)
 	}
 	rootCtx = ContextWithSecureCookie(rootCtx, sc)
 	rootCtx = ContextWithRender(rootCtx, render.New(render.Options{
@@ -81,11 +108,13 @@ func main() {
 	if config.Dev {
 		log.Print("[warning] Dev mode enabled: disabling CSRF protection")
 	} else {
-		mux.UseC(csrf.Protect(
+		// git clients can't send CSRF tokens; their POSTs have content types
+		// that browsers won't send cross-origin without CORS anyway
+		mux.UseC(unlessPrefix("/git/", csrf.Protect(
 			config.CookieSecret,
 			csrf.RequestHeader("X-XSRF-TOKEN"),
 			csrf.CookieName("XSRF-TOKEN"),
-		))
+		)))
 	}
 
 	apiMux.UseC(Auth)
@@ -116,16 +145,53 @@ func main() {
 	apiMux.HandleFuncC(pat.Delete("/user/:userID/privateKey/:keyID"), handleDeleteUserPrivateKey)
 
 	// password-related endpoints
-	apiMux.HandleFuncC(pat.Get("/pass/*"), handleGetPass)
-	apiMux.HandleFuncC(pat.Post("/pass/*"), handlePostPass) // always POST (even for edits)
-	apiMux.HandleFuncC(pat.Delete("/pass/*"), handleDeletePass)
+	apiMux.HandleFuncC(pat.Get("/pass/*"), mounted(handleGetPass))
+	apiMux.HandleFuncC(pat.Post("/pass/*"), mounted(handlePostPass)) // always POST (even for edits)
+	apiMux.HandleFuncC(pat.Delete("/pass/*"), mounted(handleDeletePass))
+	apiMux.HandleFuncC(pat.Get("/tree/*"), mounted(handleGetTree))
+	apiMux.HandleFuncC(pat.Get("/search"), handleGetSearch)
+
+	apiMux.HandleFuncC(pat.Get("/passPerm/*"), mounted(handleGetPerm))
+	apiMux.HandleFuncC(pat.Post("/passPerm/*"), mounted(handlePostPerm)) // always POST (even for edits)
+
+	apiMux.HandleFuncC(pat.Get("/history/*"), mounted(handleGetHistory))
+	apiMux.HandleFuncC(pat.Post("/restore/*"), mounted(handlePostRestore))
+	apiMux.HandleFuncC(pat.Post("/move"), handlePostMove)
+	apiMux.HandleFuncC(pat.Post("/dir/*"), mounted(handlePostDir))
+	apiMux.HandleFuncC(pat.Post("/batch"), handlePostBatch)
+
+	apiMux.HandleFuncC(pat.Get("/attachment/*"), mounted(handleGetAttachment))
+	apiMux.HandleFuncC(pat.Post("/attachment/*"), mounted(handlePostAttachment))
+	apiMux.HandleFuncC(pat.Delete("/attachment/*"), mounted(handleDeleteAttachment))
+
+	// change requests
+	apiMux.HandleFuncC(pat.Get("/change"), handleGetChanges)
+	apiMux.HandleFuncC(pat.Post("/change"), handlePostChange)
+	apiMux.HandleFuncC(pat.Get("/change/:id"), handleGetChange)
+	apiMux.HandleFuncC(pat.Get("/change/:id/diff"), handleGetChangeDiff)
+	apiMux.HandleFuncC(pat.Post("/change/:id/approve"), handlePostChangeApprove)
+	apiMux.HandleFuncC(pat.Post("/change/:id/reject"), handlePostChangeReject)
+	apiMux.HandleFuncC(pat.Post("/change/:id/merge"), handlePostChangeMerge)
+
+	// remote-related endpoints
+	apiMux.HandleFuncC(pat.Get("/remote"), handleGetRemotes)
+	apiMux.HandleFuncC(pat.Post("/remote/:name/sync"), handlePostRemoteSync)
+	apiMux.HandleFuncC(pat.Delete("/remote/:name/conflicts"), handleDeleteRemoteConflicts)
+
+	// reports
+	apiMux.HandleFuncC(pat.Get("/report/fsck"), handleGetFsckReport)
+
+	// admin endpoints
+	apiMux.HandleFuncC(pat.Post("/admin/certifiedKey"), handlePostCertifiedKey)
 
-	apiMux.HandleFuncC(pat.Get("/passPerm/*"), handleGetPerm)
-	apiMux.HandleFuncC(pat.Post("/passPerm/*"), handlePostPerm) // always POST (even for edits)
+	gitMux := goji.SubMux()
+	gitMux.UseC(GitAuth)
+	gitMux.HandleFuncC(pat.New("/*"), handleGit)
 
 	mux.HandleFuncC(pat.Get("/logout"), GetLogout)
 	mux.HandleFuncC(pat.Post("/login"), PostLogin)
 	mux.HandleC(pat.New("/api/*"), apiMux)
+	mux.HandleC(pat.New("/git/*"), gitMux)
 
 	mux.Handle(pat.New("/*"), http.FileServer(http.Dir("app/")))
 
@@ -138,3 +204,63 @@ func main() {
 		mux.ServeHTTPC(rootCtx, w, r)
 	})))
 }
+
+// setInitialRecipients gives a new store recipients, exiting if it can't or
+// if the recipients of the store can't be read.
+func setInitialRecipients(ps PassStore) {
+	if tx, err := ps.BeginW(); err != nil {
+		log.Fatal(err)
+	} else if rs, err := tx.Recipients("/"); err != nil {
+		if _, ok := err.(SignatureError); ok {
+			log.Fatalf("Could not read the recipients of the store: %v (to sign the existing %s files, run %s sign-recipients)", err, recipientFile, os.Args[0])
+		}
+		log.Fatal("Could not read the recipients of the store: ", err)
+	} else if len(rs) == 0 {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		if err := tx.Commit(CommitInfo{Message: "Set initial recipients"}); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// openGitPass opens the repository in config.Git for the server, exiting if
+// it can't.
+func openGitPass(config Config, db DBStore) *GitPass {
+	newPass := NewGitPass
+	if config.Git.Backend == "native" {
+		newPass = NewNativeGitPass
+	}
+	ps, err := newPass(config.Git.Root, config.Git.Branch, config.Dev)
+	if err != nil {
+		log.Fatal("Could not open git repo: ", err)
+	}
+	ps.SetKeyResolver(storeKeyResolver(db))
+	ps.SetEmailDomain(config.Git.EmailDomain)
+	if signer, trusted, err := loadSigningConfig(config); err != nil {
+		log.Fatal("Could not load signing keys: ", err)
+	} else {
+		ps.SetSigningKey(signer)
+		ps.SetTrustedKeys(trusted)
+	}
+	if exe, err := os.Executable(); err != nil {
+		log.Fatal("Could not find executable: ", err)
+	} else if err := ps.InstallPreReceiveHook(exe); err == ErrNativeUnsupported {
+		log.Print("[warning] The native git backend doesn't serve the repository to git clients")
+	} else if err != nil {
+		log.Fatal("Could not install pre-receive hook: ", err)
+	}
+	// remote changes are checked like pushes, which needs the config and
+	// the database
+	ctx := context.Background()
+	ctx = ContextWithConfig(ctx, config)
+	ctx = ContextWithStore(ctx, db)
+	for _, r := range config.Git.Remotes {
+		if err := ps.AddRemote(r.Remote); err != nil {
+			log.Fatalf("Could not add remote %s: %v", r.Name, err)
+		}
+		if r.SyncInterval > 0 {
+			go ps.SyncPeriodically(ctx, r.Name, r.SyncInterval)
+		}
+	}
+	return ps
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"goji.io"
+	"goji.io/pattern"
+	"golang.org/x/net/context"
+)
+
+// Mount is a PassStore that the API serves as a top-level directory of the
+// main store, hiding any directory of the same name in it.
+type Mount struct {
+	Name  string
+	Store PassStore
+	// Users lists the IDs of the users who may see the mount; everyone may
+	// if it's empty.
+	Users []string
+}
+
+func (m Mount) visibleTo(u User) bool {
+	return len(m.Users) == 0 || containsAny(m.Users, []string{u.ID})
+}
+
+// openMounts opens the stores in config.Mounts. Like the main store, they
+// find recipient keys in db.
+func openMounts(config Config, db DBStore) (map[string]Mount, error) {
+	mounts := make(map[string]Mount, len(config.Mounts))
+	for _, mc := range config.Mounts {
+		name := cleanPassPath(mc.Name)
+		if err := validatePassPath(mc.Name, passPathDir); err != nil || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid mount name %q", mc.Name)
+		} else if _, ok := mounts[name]; ok {
+			return nil, fmt.Errorf("mount %s is configured twice", name)
+		}
+
+		var ps PassStore
+		if mc.PassStore == "sql" {
+			if mdb, err := initDB(mc.DB.Driver, mc.DB.DSN); err != nil {
+				return nil, fmt.Errorf("mount %s: %v", name, err)
+			} else if sp, err := NewSQLPass(mdb); err != nil {
+				return nil, fmt.Errorf("mount %s: %v", name, err)
+			} else {
+				sp.SetKeyResolver(storeKeyResolver(db))
+				ps = sp
+			}
+		} else {
+			newPass := NewGitPass
+			if backend := mc.Git.Backend; backend == "native" || backend == "" && config.Git.Backend == "native" {
+				newPass = NewNativeGitPass
+			}
+			branch := mc.Git.Branch
+			if branch == "" {
+				branch = config.Git.Branch
+			}
+			g, err := newPass(mc.Git.Root, branch, config.Dev)
+			if err != nil {
+				return nil, fmt.Errorf("mount %s: %v", name, err)
+			}
+			g.SetKeyResolver(storeKeyResolver(db))
+			g.SetEmailDomain(config.Git.EmailDomain)
+			if signer, trusted, err := loadSigningConfig(config); err != nil {
+				return nil, err
+			} else {
+				g.SetSigningKey(signer)
+				g.SetTrustedKeys(trusted)
+			}
+			ps = g
+		}
+		mounts[name] = Mount{Name: name, Store: ps, Users: mc.Users}
+	}
+	return mounts, nil
+}
+
+// findMount returns the mount that the API path p is in, and p relative to
+// the mount.
+func findMount(ctx context.Context, p string) (Mount, string, bool) {
+	name := strings.SplitN(cleanPassPath(p), "/", 2)[0]
+	m, ok := MountsFromContext(ctx)[name]
+	if !ok || name == "" {
+		return Mount{}, "", false
+	}
+	rel := strings.TrimPrefix(strings.TrimLeft(p, "/"), name)
+	if rel == "" {
+		rel = "/"
+	}
+	return m, rel, true
+}
+
+// visibleMounts returns the mounts the current user may see, by name.
+func visibleMounts(ctx context.Context) []Mount {
+	mounts := MountsFromContext(ctx)
+	names := make([]string, 0, len(mounts))
+	for name, m := range mounts {
+		if m.visibleTo(UserFromContext(ctx)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ret := make([]Mount, len(names))
+	for i, name := range names {
+		ret[i] = mounts[name]
+	}
+	return ret
+}
+
+// mounted serves requests of h's endpoint (one with a path to a password or
+// directory as its wildcard) for paths in a mount with the mount's store, and
+// the path relative to it, in the context. Mounts the user may not see are
+// not found.
+func mounted(h goji.HandlerFunc) goji.HandlerFunc {
+	return func(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+		if m, rel, ok := findMount(ctx, pattern.Path(ctx)); !ok {
+			h(ctx, rw, r)
+		} else if !m.visibleTo(UserFromContext(ctx)) {
+			http.Error(rw, "not found", http.StatusNotFound)
+		} else {
+			ctx = ContextWithPass(ctx, m.Store)
+			ctx = context.WithValue(ctx, ctxMountKey, m)
+			ctx = context.WithValue(ctx, ctxPassPathKey, rel)
+			h(ctx, rw, r)
+		}
+	}
+}
+
+// passPath returns the path a request of a mounted endpoint is for, in the
+// store of the context.
+func passPath(ctx context.Context) string {
+	if p, ok := ctx.Value(ctxPassPathKey).(string); ok {
+		return p
+	}
+	return pattern.Path(ctx)
+}
+
+// apiPath turns p, a path in the store of the context (with or without a
+// leading slash), into the path the API knows it by.
+func apiPath(ctx context.Context, p string) string {
+	m, ok := ctx.Value(ctxMountKey).(Mount)
+	if !ok {
+		return p
+	} else if strings.HasPrefix(p, "/") {
+		return path.Join("/", m.Name, p)
+	}
+	return path.Join(m.Name, p)
+}
+
+// inMount checks if a request is for a path in a mount.
+func inMount(ctx context.Context) bool {
+	_, ok := ctx.Value(ctxMountKey).(Mount)
+	return ok
+}
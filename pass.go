@@ -2,21 +2,26 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/speedata/gogit"
+	"golang.org/x/crypto/openpgp"
 )
 
 const (
-	recipientFile   = ".gpg-id"
+	recipientFile = ".gpg-id"
+	// placeholderFile keeps otherwise empty directories in the repository.
+	placeholderFile = ".keep"
 	gitVerboseDeubg = false
 )
 
@@ -24,6 +29,28 @@ type GitPass struct {
 	repoRoot string
 	branch   string
 	debug    bool
+	backend  gitBackend
+	keys     KeyResolver
+	// emailDomain is the domain of authors' email addresses
+	emailDomain string
+	signer      *openpgp.Entity
+	trusted     openpgp.EntityList
+
+	// repo is reused by transactions until the branch moves away from
+	// repoTip
+	repoMu  sync.Mutex
+	repo    *gogit.Repository
+	repoTip string
+	indexes *lruCache
+
+	// writes are committed by a single writer goroutine
+	writerOnce sync.Once
+	writes     chan *pendingCommit
+
+	remoteMu sync.Mutex
+	remotes  map[string]*gitRemote
+	// syncMu serializes syncs with remotes
+	syncMu sync.Mutex
 }
 
 type GitError struct {
@@ -62,17 +89,37 @@ func (g *GitPass) git(args ...string) error {
 }
 
 func (g *GitPass) gitO(args ...string) ([]byte, error) {
+	b, err := g.gitB(args...)
+	return bytes.TrimSpace(b), err
+}
+
+// gitB is like gitO, but returns the output unchanged (for binary data).
+func (g *GitPass) gitB(args ...string) ([]byte, error) {
 	var stdout, stderr bytes.Buffer
 	cmd := g.gitHelper(args...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	if err := cmd.Run(); err != nil {
-		return bytes.TrimSpace(stdout.Bytes()), GitError{err, stderr.Bytes()}
+		return stdout.Bytes(), GitError{err, stderr.Bytes()}
 	}
-	return bytes.TrimSpace(stdout.Bytes()), nil
+	return stdout.Bytes(), nil
 }
 
+// NewGitPass opens the bare repository at root, creating it if necessary. It
+// writes with the git binary, which must be in PATH.
 func NewGitPass(root, branch string, debug bool) (*GitPass, error) {
+	return newGitPass(root, branch, debug, execGit{})
+}
+
+// NewNativeGitPass is like NewGitPass, but reads and writes the repository
+// without the git binary. Syncing with remotes, serving the repository over
+// HTTP and checking pushes still need it, so they return
+// ErrNativeUnsupported.
+func NewNativeGitPass(root, branch string, debug bool) (*GitPass, error) {
+	return newGitPass(root, branch, debug, nativeGit{})
+}
+
+func newGitPass(root, branch string, debug bool, backend gitBackend) (*GitPass, error) {
 	if branch == "" {
 		branch = "master"
 	}
@@ -80,18 +127,12 @@ func NewGitPass(root, branch string, debug bool) (*GitPass, error) {
 		repoRoot: root,
 		branch:   branch,
 		debug:    debug,
+		backend:  backend,
+		indexes:  newLRUCache(indexCacheSize),
 	}
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		// try to automatically create it
-		if err := os.MkdirAll(root, 0700); err != nil {
-			return nil, err
-		} else if err := g.git("init", "--bare", "."); err != nil {
-			return nil, err
-		} else if b, err := g.gitO("mktree"); err != nil {
-			return nil, err
-		} else if b, err := g.gitO("commit-tree", string(b), "-m", "Initial Commit"); err != nil {
-			return nil, err
-		} else if err := g.git("update-ref", "refs/heads/"+g.branch, string(b)); err != nil {
+		if err := backend.initRepository(g); err != nil {
 			return nil, err
 		}
 	}
@@ -99,12 +140,25 @@ func NewGitPass(root, branch string, debug bool) (*GitPass, error) {
 	return g, nil
 }
 
+// SetEmailDomain sets the domain of the email addresses of commit authors,
+// which are <user ID>@<domain>. It defaults to the host name.
+func (g *GitPass) SetEmailDomain(domain string) {
+	g.emailDomain = domain
+}
+
+// SetKeyResolver sets the function used to find the subkeys of recipients
+// when verifying that files are encrypted to the right keys.
+func (g *GitPass) SetKeyResolver(r KeyResolver) {
+	g.keys = r
+}
+
 type gitPassTx struct {
 	g      *GitPass
 	repo   *gogit.Repository
 	branch string
 	commit *gogit.Commit
 	root   *gogit.Tree
+	index  *passIndex
 }
 
 type gitPassTxW struct {
@@ -115,52 +169,59 @@ type gitPassTxW struct {
 	changedPasswords map[string][]byte
 	// a slice of zero length indicates removal
 	changedRecipients map[string][]string
+	// directories created with Mkdir
+	createdDirs map[string]bool
+	// files written with PutStream, which are already in the repository
+	streamed map[string]streamedFile
+	// signatures of the changed recipients, made by Commit
+	signatures map[string][]byte
+
+	// view is what the transaction reads
+	view *passOverlay
+	// merge is the second parent of the commit, when merging a proposal
+	merge string
 }
 
 func (g *GitPass) Begin() (PassTx, error) {
+	return g.begin()
+}
+
+// begin starts a read-only transaction at the current tip of the branch.
+func (g *GitPass) begin() (*gitPassTx, error) {
 	tx := &gitPassTx{
 		g:      g,
 		branch: g.branch,
 	}
 
-	if repo, err := gogit.OpenRepository(g.repoRoot); err != nil {
-		return nil, err
-	} else if _, err := repo.LookupReference("refs/heads/" + g.branch); err != nil {
+	if repo, c, err := g.tip(); err != nil {
 		return nil, err
 	} else {
 		tx.repo = repo
-	}
-
-	if ref, err := tx.repo.LookupReference("refs/heads/" + g.branch); err != nil {
-		return nil, err
-	} else if c, err := tx.repo.LookupCommit(ref.Oid); err != nil {
-		return nil, err
-	} else {
 		tx.commit = c
 		tx.root = c.Tree
+		tx.index = g.index(repo, c)
 		return tx, nil
 	}
 }
 
 func (g *GitPass) BeginW() (PassTxW, error) {
-	if txr, err := g.Begin(); err != nil {
+	if txr, err := g.begin(); err != nil {
 		return nil, err
 	} else {
-		return &gitPassTxW{
-			gitPassTx:         txr.(*gitPassTx),
+		tx := &gitPassTxW{
+			gitPassTx:         txr,
 			changedPasswords:  make(map[string][]byte),
 			changedRecipients: make(map[string][]string),
-		}, nil
+			createdDirs:       make(map[string]bool),
+			streamed:          make(map[string]streamedFile),
+		}
+		tx.view = &passOverlay{txr, tx.pending}
+		return tx, nil
 	}
 }
 
 func (tx *gitPassTx) clean(p string) string {
-	p = path.Clean(p)
-	if p == "." {
-		return ""
-	} else {
-		return strings.TrimPrefix(p, "/")
-	}
+	return cleanPassPath(p)
 }
 
 func (tx *gitPassTx) getFile(p string) (*gogit.TreeEntry, error) {
@@ -168,27 +229,15 @@ func (tx *gitPassTx) getFile(p string) (*gogit.TreeEntry, error) {
 		log.Printf("getFile(%q)", p)
 		defer log.Printf("getFile(%q) done", p)
 	}
-	if p == "" {
-		return &gogit.TreeEntry{
-			Type:     gogit.ObjectTree,
-			Id:       tx.root.Oid,
-			Filemode: gogit.FileModeTree,
-			Name:     "",
-		}, nil
+	return tx.index.entry(p)
+}
+
+func (tx *gitPassTx) Version(p string) (string, error) {
+	p = tx.clean(p)
+	if te, err := tx.getFile(p); err != nil {
+		return "", err
 	} else {
-		dir, file := path.Split(p)
-		dir = tx.clean(dir)
-		if parent, err := tx.getFile(dir); err != nil {
-			return nil, err
-		} else if parent.Type != gogit.ObjectTree {
-			return nil, os.ErrNotExist
-		} else if t, err := tx.repo.LookupTree(parent.Id); err != nil {
-			return nil, err
-		} else if te := t.EntryByName(file); te == nil {
-			return nil, os.ErrNotExist
-		} else {
-			return te, nil
-		}
+		return te.Id.String(), nil
 	}
 }
 
@@ -219,11 +268,11 @@ func (tx *gitPassTx) List(p string) ([]PassDirent, error) {
 		return nil, err
 	} else if te.Type != gogit.ObjectTree {
 		return nil, os.ErrInvalid
-	} else if t, err := tx.repo.LookupTree(te.Id); err != nil {
+	} else if d, err := tx.index.dir(p); err != nil {
 		return nil, err
 	} else {
-		ret := make([]PassDirent, 0, len(t.TreeEntries))
-		for _, te := range t.TreeEntries {
+		ret := make([]PassDirent, 0, len(d.tree.TreeEntries))
+		for _, te := range d.tree.TreeEntries {
 			// ignore dot files
 			if strings.HasPrefix(te.Name, ".") {
 				continue
@@ -270,11 +319,29 @@ func (tx *gitPassTx) recipients(p string, override map[string][]string) ([]strin
 		defer log.Printf("recipients(%q) done", p)
 	}
 
-	// TODO: make this faster (each getFile starts from the root...)
+	// without overrides, the recipients only depend on the commit
+	if len(override) > 0 {
+		return tx.lookupRecipients(p, override)
+	} else if r, ok := tx.index.cachedRecipients(p); ok {
+		return r.keyIDs, r.err
+	}
+	keyIDs, err := tx.lookupRecipients(p, nil)
+	tx.index.cacheRecipients(p, keyIDs, err)
+	return keyIDs, err
+}
+
+func (tx *gitPassTx) lookupRecipients(p string, override map[string][]string) ([]string, error) {
 	r := path.Join(p, recipientFile)
-	if s := override[r]; len(s) > 0 {
+	s, overridden := override[r]
+	if len(s) > 0 {
 		return s, nil
-	} else if b, err := tx.get(r); err == nil {
+	} else if b, err := tx.get(r); !overridden && err == nil {
+		// refuse recipients that the server (or another trusted key) didn't
+		// sign
+		sig, _ := tx.get(r + ".sig")
+		if err := tx.g.checkRecipientsSignature(r, b, sig); err != nil {
+			return nil, err
+		}
 		return strings.Split(strings.TrimSpace(string(b)), "\n"), nil
 	} else if p != "" {
 		dir, _ := path.Split(p)
@@ -304,8 +371,10 @@ func (tx *gitPassTx) getAffectedFiles(p string, override map[string][]string) ([
 		if !d.File {
 			// directory; check if it has a .gpg-id
 			r := path.Join(d.Name, recipientFile)
-			if s := override[r]; len(s) > 0 {
+			if s, overridden := override[r]; len(s) > 0 {
 				return filepath.SkipDir
+			} else if overridden {
+				return nil
 			} else if te, err := tx.getFile(r); err == nil && te.Type == gogit.ObjectBlob {
 				return filepath.SkipDir
 			} else {
@@ -352,10 +421,10 @@ func (tx *gitPassTx) Walk(p string, fn PassWalkFn) error {
 		}
 
 		if te.Type == gogit.ObjectTree {
-			if t, err := tx.repo.LookupTree(te.Id); err != nil {
+			if d, err := tx.index.dir(p); err != nil {
 				return err
 			} else {
-				for _, te := range t.TreeEntries {
+				for _, te := range d.tree.TreeEntries {
 					if strings.HasPrefix(te.Name, ".") {
 						continue
 					}
@@ -380,78 +449,397 @@ func (tx *gitPassTxW) Put(p string, contents []byte) {
 		contents = []byte{} // nil slices are distinct from zero-length
 	}
 	tx.changedPasswords[p] = contents
+	delete(tx.streamed, p)
 	return
 }
 
 func (tx *gitPassTxW) Delete(p string) {
 	p = tx.clean(p)
+	// deletions are committed before writes, so forget the earlier writes
+	// that this deletes
+	for q := range tx.changedPasswords {
+		if below(q, p) {
+			delete(tx.changedPasswords, q)
+		}
+	}
+	for q := range tx.streamed {
+		if q == p || below(q, p) {
+			delete(tx.streamed, q)
+		}
+	}
+	for r := range tx.changedRecipients {
+		if below(r, p) {
+			delete(tx.changedRecipients, r)
+		}
+	}
+	for dir := range tx.createdDirs {
+		if dir == p || below(dir, p) {
+			delete(tx.createdDirs, dir)
+		}
+	}
 	tx.changedPasswords[p] = nil
 	return
 }
 
-func (tx *gitPassTxW) verify() error {
-	// TODO(tolar2): actually verify...
+func (tx *gitPassTxW) Mkdir(p string) {
+	p = tx.clean(p)
+	if exists, _ := tx.Type(p); !exists {
+		tx.createdDirs[p] = true
+	}
+	return
+}
+
+func (tx *gitPassTxW) Move(src, dst string) error {
+	src, dst = tx.clean(src), tx.clean(dst)
+	if src == "" || dst == "" || dst == src || strings.HasPrefix(dst, src+"/") {
+		return os.ErrInvalid
+	} else if exists, _ := tx.Type(dst); exists {
+		return os.ErrExist
+	}
+	files, err := tx.view.subtree(src)
+	if err != nil {
+		return err
+	}
+
+	// A move deletes src and writes everything in it (including recipients
+	// and empty directories) at dst, so that the moved files are verified at
+	// their new paths and can be replaced with Put.
+	recipients := make(map[string][]string)
+	streamed := make(map[string]streamedFile)
+	for rel := range files {
+		if f, ok := tx.streamed[path.Join(src, rel)]; ok {
+			// files contains its placeholder contents
+			streamed[rel] = f
+		}
+		if path.Base(rel) == recipientFile {
+			// read through Recipients, which checks signatures
+			if r, err := tx.Recipients(path.Join(src, path.Dir(rel))); err != nil {
+				return err
+			} else {
+				recipients[rel] = r
+			}
+		}
+	}
+	tx.Delete(src)
+	for rel, contents := range files {
+		to := path.Join(dst, rel)
+		switch path.Base(rel) {
+		case recipientFile:
+			tx.changedRecipients[to] = recipients[rel]
+		case placeholderFile:
+			tx.createdDirs[tx.clean(path.Dir(to))] = true
+		default:
+			if f, ok := streamed[rel]; ok {
+				tx.streamed[to] = f
+			} else {
+				tx.changedPasswords[to] = contents
+			}
+		}
+	}
 	return nil
 }
 
-var (
-	angleBracketRemover = strings.NewReplacer("<", "", ">", "")
-)
+// pending returns the changes for the transaction's view.
+func (tx *gitPassTxW) pending() map[string][]byte {
+	ret := make(map[string][]byte)
+	for _, p := range tx.changedPaths() {
+		ret[p] = tx.change(p)
+	}
+	return ret
+}
 
-func (tx *gitPassTxW) Commit(userName, message string) error {
-	if err := tx.verify(); err != nil {
-		return err
+func (tx *gitPassTxW) Type(p string) (exists bool, file bool) {
+	return tx.view.Type(p)
+}
+
+func (tx *gitPassTxW) Version(p string) (string, error) {
+	return tx.view.Version(p)
+}
+
+func (tx *gitPassTxW) List(p string) ([]PassDirent, error) {
+	return tx.view.List(p)
+}
+
+func (tx *gitPassTxW) Get(p string) ([]byte, error) {
+	if f, ok := tx.streamed[tx.clean(p)]; ok {
+		return tx.readBlob(f.id)
+	}
+	return tx.view.Get(p)
+}
+
+func (tx *gitPassTxW) Recipients(p string) ([]string, error) {
+	return tx.view.Recipients(p)
+}
+
+func (tx *gitPassTxW) GetAffectedFiles(p string) ([]string, error) {
+	return tx.view.GetAffectedFiles(p)
+}
+
+func (tx *gitPassTxW) Walk(p string, fn PassWalkFn) error {
+	return tx.view.Walk(p, fn)
+}
+
+// parentIsFile determines if dir or any of its parents is a file.
+func parentIsFile(tx PassTx, dir string) bool {
+	for ; dir != "" && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if exists, isFile := tx.Type(dir); exists && isFile {
+			return true
+		}
 	}
+	return false
+}
 
-	if message == "" {
-		message = "Update passwords"
+// verify checks the pending changes before they are committed. Every changed
+// path must pass validatePassPath, and every written file must be encrypted
+// to exactly the recipients it will have after the commit. Any file whose
+// recipients change must be rewritten (or deleted) as well.
+func (tx *gitPassTxW) verify() error {
+	for p, contents := range tx.changedPasswords {
+		if contents == nil {
+			if err := validatePassPath(p, passPathAny); err != nil {
+				return err
+			}
+			continue
+		}
+		dir := tx.clean(path.Dir(p))
+		if err := validatePassPath(p, writtenPathKind(tx.gitPassTx, p)); err != nil {
+			return err
+		} else if exists, isFile := tx.gitPassTx.Type(p); exists && !isFile {
+			return VerifyError{p, "is a directory"}
+		} else if parentIsFile(tx.gitPassTx, dir) {
+			return VerifyError{p, "parent is a file"}
+		} else if recipients, err := tx.recipients(dir, tx.changedRecipients); err != nil {
+			return err
+		} else if err := verifyCiphertext(p, contents, recipients, tx.g.keys); err != nil {
+			return err
+		}
+	}
+	for p, f := range tx.streamed {
+		dir := tx.clean(path.Dir(p))
+		if err := validatePassPath(p, writtenPathKind(tx.gitPassTx, p)); err != nil {
+			return err
+		} else if exists, isFile := tx.gitPassTx.Type(p); exists && !isFile {
+			return VerifyError{p, "is a directory"}
+		} else if parentIsFile(tx.gitPassTx, dir) {
+			return VerifyError{p, "parent is a file"}
+		} else if recipients, err := tx.recipients(dir, tx.changedRecipients); err != nil {
+			return err
+		} else if len(recipients) == 0 {
+			return VerifyError{p, "no recipients configured"}
+		} else if !matchKeyIDs(f.keys, recipients, tx.g.keys) {
+			return VerifyError{p, fmt.Sprintf("encrypted to %v, expected %v", f.keys, recipients)}
+		}
 	}
 
-	cmd := tx.g.gitHelper("fast-import")
-	pw, err := cmd.StdinPipe()
-	if err != nil {
-		return err
+	for dir := range tx.createdDirs {
+		if err := validatePassPath(dir, passPathDir); err != nil {
+			return err
+		} else if parentIsFile(tx.gitPassTx, dir) {
+			return VerifyError{dir, "parent is a file"}
+		}
 	}
 
-	if err := cmd.Start(); err != nil {
-		return err
+	for r, recipients := range tx.changedRecipients {
+		dir := tx.clean(path.Dir(r))
+		if err := validatePassPath(dir, passPathDir); err != nil {
+			return err
+		} else if exists, isFile := tx.gitPassTx.Type(dir); exists && isFile {
+			return VerifyError{dir, "is a file"}
+		} else if len(recipients) == 0 && dir == "" {
+			return VerifyError{"/", "the root directory must have recipients"}
+		} else if !exists {
+			// new directory; nothing can be affected yet
+			continue
+		} else if affected, err := tx.getAffectedFiles(dir, tx.changedRecipients); err != nil {
+			return err
+		} else {
+			for _, f := range affected {
+				_, streamed := tx.streamed[f]
+				if _, ok := tx.changedPasswords[f]; !ok && !streamed {
+					return VerifyError{f, "must be reencrypted to the new recipients of " + dir}
+				}
+			}
+		}
 	}
+	return nil
+}
 
-	var w io.Writer = pw
-	// var w io.Writer = io.MultiWriter(pw, os.Stdout)
-	// var w io.Writer = os.Stdout
+var (
+	// identRemover removes what can't appear in the name or email address of
+	// a commit's author or committer.
+	identRemover = strings.NewReplacer("<", "", ">", "", "\n", "", "\r", "")
+)
 
-	userName = angleBracketRemover.Replace(userName)
+// commitIdents returns the author and committer of a commit made for info,
+// as "name <email> time zone". The user in info is the author (with an email
+// address made from their ID and the email domain), and the server is the
+// committer. Without a user, the author is the empty string.
+func (g *GitPass) commitIdents(info CommitInfo) (author, committer string) {
 	hostName, err := os.Hostname()
 	if err != nil {
 		hostName = "localhost"
 	}
-
-	fmt.Fprintf(w, "commit refs/heads/%s\n", tx.branch)
+	domain := g.emailDomain
+	if domain == "" {
+		domain = hostName
+	}
 	now := time.Now()
-	fmt.Fprintf(w, "committer %s <pass@%s> %d %s\n", userName, hostName, now.Unix(), now.Format("-0700"))
-	fmt.Fprintf(w, "data %d\n%s\n", len(message), message)
-	fmt.Fprintf(w, "from %s\n", tx.commit.Oid)
+	when := fmt.Sprintf("%d %s", now.Unix(), now.Format("-0700"))
 
-	for n, r := range tx.changedRecipients {
-		b := strings.Join(r, "\n")
-		fmt.Fprintf(w, "M 644 inline %s\n", n)
-		fmt.Fprintf(w, "data %d\n%s\n", len(b), b)
+	if info.UserID != "" {
+		name := info.UserName
+		if name == "" {
+			name = info.UserID
+		}
+		id := strings.Join(strings.Fields(identRemover.Replace(info.UserID)), "")
+		author = fmt.Sprintf("%s <%s@%s> %s", identRemover.Replace(name), id, domain, when)
 	}
+	committer = fmt.Sprintf("pass <pass@%s> %s", hostName, when)
+	return author, committer
+}
 
-	for n, pass := range tx.changedPasswords {
-		if pass == nil {
-			fmt.Fprintf(w, "D %s\n", n)
-		} else {
-			fmt.Fprintf(w, "M 644 inline %s\n", n)
-			fmt.Fprintf(w, "data %d\n", len(pass))
-			w.Write(pass)
-			fmt.Fprint(w, "\n")
+// touchedPaths lists the paths whose contents the transaction depends on:
+// every changed path, the .gpg-id files that determine its recipients, and
+// the directories whose recipients it changes, as a whole, since files added
+// to them meanwhile would be encrypted to the old recipients.
+func (tx *gitPassTxW) touchedPaths() []string {
+	seen := make(map[string]bool)
+	var ret []string
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			ret = append(ret, p)
+		}
+	}
+	for _, p := range tx.changedPaths() {
+		add(p)
+		for dir := tx.clean(path.Dir(p)); ; dir = tx.clean(path.Dir(dir)) {
+			add(path.Join(dir, recipientFile))
+			if dir == "" {
+				break
+			}
 		}
 	}
-	fmt.Fprint(w, "done\n")
+	for _, dir := range tx.rekeyedDirs() {
+		add(dir)
+	}
+	return ret
+}
+
+// rekeyedDirs lists the directories whose recipients the transaction
+// changes.
+func (tx *gitPassTxW) rekeyedDirs() []string {
+	ret := make([]string, 0, len(tx.changedRecipients))
+	for p := range tx.changedRecipients {
+		ret = append(ret, tx.clean(path.Dir(p)))
+	}
+	return ret
+}
+
+// changedPaths lists every path written or deleted by the transaction.
+func (tx *gitPassTxW) changedPaths() []string {
+	ret := make([]string, 0, len(tx.changedPasswords)+len(tx.streamed)+len(tx.changedRecipients)+len(tx.createdDirs))
+	for p := range tx.changedPasswords {
+		ret = append(ret, p)
+	}
+	for p := range tx.streamed {
+		ret = append(ret, p)
+	}
+	for p := range tx.changedRecipients {
+		// changing a .gpg-id invalidates its signature
+		ret = append(ret, p, p+".sig")
+	}
+	for p := range tx.createdDirs {
+		ret = append(ret, path.Join(p, placeholderFile))
+	}
+	return ret
+}
 
-	pw.Close()
+// change returns the new contents of a path listed by changedPaths, or nil
+// if the transaction deletes it.
+func (tx *gitPassTxW) change(p string) []byte {
+	if r, ok := tx.changedRecipients[p]; ok {
+		if len(r) == 0 {
+			return nil
+		}
+		return []byte(strings.Join(r, "\n"))
+	} else if c, ok := tx.changedPasswords[p]; ok {
+		return c
+	} else if f, ok := tx.streamed[p]; ok {
+		return f.placeholder()
+	} else if strings.HasSuffix(p, "/"+recipientSigFile) || p == recipientSigFile {
+		return tx.signatures[p]
+	}
+	return []byte{} // placeholder of a created directory
+}
 
-	return cmd.Wait()
+// checkRebase checks that the transaction can be committed on top of tip,
+// after other transactions that change the paths in pending: none of the
+// paths it touches may have changed since it began. Otherwise, ErrConflict is
+// returned.
+func (tx *gitPassTxW) checkRebase(tip *gitPassTx, pending map[string]bool) error {
+	moved := !tip.commit.Oid.Equal(tx.commit.Oid)
+	for _, p := range tx.touchedPaths() {
+		if pending[p] || moved && tx.entryID(p) != tip.entryID(p) {
+			if tx.g.debug {
+				log.Printf("Not rebasing onto %s: %s changed", tip.commit.Oid, p)
+			}
+			return ErrConflict
+		}
+	}
+	// pending has the files the transactions before this one change, so
+	// check for any in the rekeyed directories
+	for _, dir := range tx.rekeyedDirs() {
+		for q := range pending {
+			if dir == "" || strings.HasPrefix(q, dir+"/") {
+				return ErrConflict
+			}
+		}
+	}
+	return nil
+}
+
+// entryID returns the object ID of p, or the empty string if p does not
+// exist.
+func (tx *gitPassTx) entryID(p string) string {
+	if te, err := tx.getFile(p); err != nil {
+		return ""
+	} else {
+		return te.Id.String()
+	}
+}
+
+const maxCommitAttempts = 5
+
+func (tx *gitPassTxW) Commit(info CommitInfo) error {
+	if err := tx.verify(); err != nil {
+		return err
+	} else if tx.signatures, err = tx.signRecipients(); err != nil {
+		return err
+	}
+
+	return tx.g.queueCommit(tx, info)
+}
+
+var errRefMoved = errors.New("ref moved during commit")
+
+// importedCommit returns the commit of the transaction for importCommits.
+func (tx *gitPassTxW) importedCommit(info CommitInfo) importedCommit {
+	if info.Message == "" {
+		info.Message = "Update passwords"
+	}
+
+	c := importedCommit{info: info, merge: tx.merge}
+	paths := tx.changedPaths()
+	sort.Strings(paths)
+	for _, n := range paths {
+		if f, ok := tx.streamed[n]; ok {
+			c.files = append(c.files, importedFile{path: n, mode: "100644", id: f.id})
+		} else if contents := tx.change(n); contents == nil {
+			c.deletes = append(c.deletes, n)
+		} else {
+			c.files = append(c.files, importedFile{path: n, mode: "100644", contents: contents})
+		}
+	}
+	return c
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/speedata/gogit"
+)
+
+var (
+	// ErrUnknownProposal is returned by PassProposer for proposals that don't
+	// exist.
+	ErrUnknownProposal = errors.New("unknown proposal")
+	// ErrProposalExists is returned by PassProposer.Propose if the ID is
+	// taken.
+	ErrProposalExists = errors.New("proposal already exists")
+)
+
+// PassProposer is implemented by PassStores that can set the changes of a
+// write transaction aside as a proposal, instead of committing them, to be
+// merged later (e.g. once they have been reviewed).
+type PassProposer interface {
+	// Propose verifies the changes of tx like Commit would, and keeps them
+	// as the proposal id, based on the revision tx began at. id may only
+	// contain letters, digits and dashes.
+	Propose(tx PassTxW, id string, info CommitInfo) error
+	// Proposal returns the store as of the revision the proposal id is
+	// based on, the store with the proposal's changes, and the paths
+	// (including .gpg-id files) that differ between them.
+	Proposal(id string) (base, proposed PassTx, changed []string, err error)
+	// BeginMerge starts a write transaction that makes the changes of the
+	// proposal id on top of the current revision. If anything the proposal
+	// touches has changed since its base, ErrConflict is returned.
+	BeginMerge(id string) (PassTxW, error)
+}
+
+// proposalRef returns the ref of the commit of a proposal.
+func proposalRef(id string) string {
+	return "refs/changes/" + id
+}
+
+func validProposalID(id string) bool {
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return id != ""
+}
+
+// Propose commits tx to refs/changes/<id>, leaving the branch alone.
+func (g *GitPass) Propose(ptx PassTxW, id string, info CommitInfo) error {
+	tx, ok := ptx.(*gitPassTxW)
+	if !ok || tx.g != g {
+		return errors.New("not a transaction of this store")
+	} else if !validProposalID(id) {
+		return errors.New("invalid proposal ID")
+	} else if err := tx.verify(); err != nil {
+		return err
+	} else if tx.signatures, err = tx.signRecipients(); err != nil {
+		return err
+	}
+
+	// creating the ref at the base first claims the ID
+	base := tx.commit.Oid.String()
+	if err := updateRef(g.repoRoot, proposalRef(id), base, ""); err == errRefMoved {
+		return ErrProposalExists
+	} else if err != nil {
+		return err
+	}
+	if err := g.backend.importCommits(g, proposalRef(id), base, []importedCommit{tx.importedCommit(info)}); err != nil {
+		os.Remove(filepath.Join(g.repoRoot, filepath.FromSlash(proposalRef(id))))
+		return err
+	}
+	return nil
+}
+
+func (g *GitPass) Proposal(id string) (PassTx, PassTx, []string, error) {
+	base, proposed, changed, err := g.proposal(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return base, proposed, changed, nil
+}
+
+func (g *GitPass) proposal(id string) (*gitPassTx, *gitPassTx, []string, error) {
+	if !validProposalID(id) {
+		return nil, nil, nil, ErrUnknownProposal
+	}
+	// the proposal isn't on the branch, so the cached repository may not
+	// know its objects
+	repo, err := gogit.OpenRepository(g.repoRoot)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ref, err := repo.LookupReference(proposalRef(id))
+	if err != nil {
+		return nil, nil, nil, ErrUnknownProposal
+	}
+	c, err := repo.LookupCommit(ref.Oid)
+	if err != nil {
+		return nil, nil, nil, err
+	} else if c.ParentCount() == 0 {
+		return nil, nil, nil, ErrUnknownProposal
+	}
+	b := c.Parent(0)
+	if b == nil {
+		return nil, nil, nil, errors.New("could not read the base of proposal " + id)
+	}
+
+	tx := &gitPassTx{g: g, repo: repo, branch: g.branch}
+	var changed []string
+	if err := diffTrees(repo, b.Tree, c.Tree, "", &changed); err != nil {
+		return nil, nil, nil, err
+	}
+	sort.Strings(changed)
+	return tx.at(b), tx.at(c), changed, nil
+}
+
+// diffTrees adds the paths of the files that differ between the trees a and
+// b (either of which may be nil) to changed, below the directory prefix.
+func diffTrees(repo *gogit.Repository, a, b *gogit.Tree, prefix string, changed *[]string) error {
+	entries := make(map[string][2]*gogit.TreeEntry)
+	if a != nil {
+		for _, te := range a.TreeEntries {
+			e := entries[te.Name]
+			e[0] = te
+			entries[te.Name] = e
+		}
+	}
+	if b != nil {
+		for _, te := range b.TreeEntries {
+			e := entries[te.Name]
+			e[1] = te
+			entries[te.Name] = e
+		}
+	}
+
+	subtree := func(te *gogit.TreeEntry) (*gogit.Tree, error) {
+		if te == nil || te.Type != gogit.ObjectTree {
+			return nil, nil
+		}
+		return repo.LookupTree(te.Id)
+	}
+	for name, e := range entries {
+		p := path.Join(prefix, name)
+		if e[0] != nil && e[1] != nil && e[0].Id.Equal(e[1].Id) && e[0].Filemode == e[1].Filemode {
+			continue
+		}
+		for _, te := range e {
+			if te != nil && te.Type != gogit.ObjectTree {
+				*changed = append(*changed, p)
+				break
+			}
+		}
+		if ta, err := subtree(e[0]); err != nil {
+			return err
+		} else if tb, err := subtree(e[1]); err != nil {
+			return err
+		} else if ta != nil || tb != nil {
+			if err := diffTrees(repo, ta, tb, p, changed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BeginMerge makes the changes of the proposal in a transaction whose commit
+// has the proposal's commit as its second parent.
+func (g *GitPass) BeginMerge(id string) (PassTxW, error) {
+	base, proposed, changed, err := g.proposal(id)
+	if err != nil {
+		return nil, err
+	}
+	ptx, err := g.BeginW()
+	if err != nil {
+		return nil, err
+	}
+	tx := ptx.(*gitPassTxW)
+
+	// like checkRebase, but against the proposal's base
+	for _, p := range changed {
+		// the files added to a directory since were not reencrypted to its
+		// new recipients
+		if dir := tx.clean(path.Dir(p)); path.Base(p) == recipientFile && base.entryID(dir) != tx.gitPassTx.entryID(dir) {
+			return nil, ErrConflict
+		}
+		for q := p; ; q = tx.clean(path.Dir(q)) {
+			r := q
+			if q != p {
+				r = path.Join(q, recipientFile)
+			}
+			if base.entryID(r) != tx.gitPassTx.entryID(r) {
+				return nil, ErrConflict
+			} else if q == "" {
+				break
+			}
+		}
+	}
+
+	for _, p := range changed {
+		dir, name := tx.clean(path.Dir(p)), path.Base(p)
+		exists, _ := proposed.Type(p)
+		switch {
+		case name == recipientSigFile:
+			// Commit signs the new .gpg-id again
+		case name == recipientFile:
+			var recipients []string
+			if exists {
+				c, err := proposed.Get(p)
+				if err != nil {
+					return nil, err
+				}
+				recipients = strings.Split(strings.TrimSpace(string(c)), "\n")
+			}
+			tx.SetRecipients(dir, recipients)
+		case name == placeholderFile:
+			if exists {
+				tx.Mkdir(dir)
+			} else if e, _ := proposed.Type(dir); e {
+				// the directory isn't empty anymore
+			} else if l, err := tx.List(dir); err == nil && len(l) == 0 {
+				tx.Delete(dir)
+			}
+		case exists:
+			c, err := proposed.Get(p)
+			if err != nil {
+				return nil, err
+			}
+			tx.Put(p, c)
+		default:
+			tx.Delete(p)
+		}
+	}
+	tx.merge = proposed.commit.Oid.String()
+	return tx, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGitPassProposals(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-proposals")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := initDB("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDefaults(db)
+		g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.SetKeyResolver(storeKeyResolver(db))
+		commit := func(f func(tx PassTxW)) {
+			tx, err := g.BeginW()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(tx)
+			if err := tx.Commit(CommitInfo{UserID: "test", Message: "commit"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		propose := func(id string, f func(tx PassTxW)) error {
+			tx, err := g.BeginW()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(tx)
+			return g.Propose(tx, id, CommitInfo{UserID: "test", Message: "proposal " + id})
+		}
+		get := func(p string) string {
+			tx, err := g.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, _ := tx.Get(p)
+			return string(c)
+		}
+
+		a, b, c := encryptForTest(t, "a"), encryptForTest(t, "b"), encryptForTest(t, "c")
+		commit(func(tx PassTxW) {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			tx.Put("a.gpg", a)
+			tx.Put("b.gpg", b)
+		})
+
+		// proposing leaves the branch alone
+		if err := propose("one", func(tx PassTxW) {
+			tx.Put("dir/c.gpg", c)
+			tx.Delete("b.gpg")
+		}); err != nil {
+			t.Fatal(err)
+		} else if get("b.gpg") != string(b) || get("dir/c.gpg") != "" {
+			t.Fatal("Propose changed the branch")
+		} else if err := propose("one", func(tx PassTxW) { tx.Put("d.gpg", c) }); err != ErrProposalExists {
+			t.Fatalf("Proposing with a taken ID: %v", err)
+		} else if err := propose("bad/id", func(tx PassTxW) { tx.Put("d.gpg", c) }); err == nil {
+			t.Fatal("Proposing with an invalid ID succeeded")
+		} else if err := propose("plain", func(tx PassTxW) { tx.Put("d.gpg", []byte("plain")) }); err == nil {
+			t.Fatal("Proposing an unencrypted file succeeded")
+		}
+
+		if _, _, _, err := g.Proposal("missing"); err != ErrUnknownProposal {
+			t.Fatalf("Proposal of a missing ID: %v", err)
+		} else if base, proposed, changed, err := g.Proposal("one"); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(changed, []string{"b.gpg", "dir/c.gpg"}) {
+			t.Fatalf("Unexpected changes: %q", changed)
+		} else if exists, _ := base.Type("b.gpg"); !exists {
+			t.Error("The base of the proposal lacks b.gpg")
+		} else if got, err := proposed.Get("dir/c.gpg"); err != nil || !bytes.Equal(got, c) {
+			t.Errorf("The proposal lacks dir/c.gpg: %v", err)
+		}
+
+		// unrelated changes since don't conflict
+		commit(func(tx PassTxW) { tx.Put("a.gpg", c) })
+		if tx, err := g.BeginMerge("one"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(CommitInfo{UserID: "test", Message: "merge"}); err != nil {
+			t.Fatal(err)
+		} else if get("a.gpg") != string(c) || get("b.gpg") != "" || get("dir/c.gpg") != string(c) {
+			t.Fatal("Unexpected contents after merging")
+		} else if parents, err := g.gitB("rev-list", "--parents", "-n", "1", "refs/heads/master"); err != nil {
+			t.Fatal(err)
+		} else if n := len(strings.Fields(string(parents))); n != 3 {
+			t.Fatalf("Merge commit has %d parents", n-1)
+		}
+
+		// changes to the same files do
+		if err := propose("two", func(tx PassTxW) { tx.Put("a.gpg", a) }); err != nil {
+			t.Fatal(err)
+		}
+		commit(func(tx PassTxW) { tx.Put("a.gpg", b) })
+		if _, err := g.BeginMerge("two"); err != ErrConflict {
+			t.Fatalf("Merging a conflicting proposal: %v", err)
+		}
+
+		// and so do changes to their recipients
+		if err := propose("three", func(tx PassTxW) { tx.Put("dir/d.gpg", a) }); err != nil {
+			t.Fatal(err)
+		}
+		commit(func(tx PassTxW) {
+			tx.SetRecipients("dir", []string{tolar2PublicKeyID})
+			tx.Put("dir/c.gpg", c)
+		})
+		if _, err := g.BeginMerge("three"); err != ErrConflict {
+			t.Fatalf("Merging a proposal whose recipients changed: %v", err)
+		}
+
+		// and so do new files in a directory whose recipients it changes
+		commit(func(tx PassTxW) { tx.Put("own/e.gpg", a) })
+		if err := propose("four", func(tx PassTxW) {
+			tx.SetRecipients("own", []string{tolar2PublicKeyID})
+			tx.Put("own/e.gpg", b)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		commit(func(tx PassTxW) { tx.Put("own/f.gpg", c) })
+		if _, err := g.BeginMerge("four"); err != ErrConflict {
+			t.Fatalf("Merging a proposal that changes the recipients of a changed directory: %v", err)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"container/heap"
+
+	"github.com/speedata/gogit"
+)
+
+// at returns a read-only transaction at commit c. Its index isn't cached,
+// since history walks visit many commits once each.
+func (tx *gitPassTx) at(c *gogit.Commit) *gitPassTx {
+	return &gitPassTx{
+		g:      tx.g,
+		repo:   tx.repo,
+		branch: tx.branch,
+		commit: c,
+		root:   c.Tree,
+		index:  newPassIndex(tx.repo, c),
+	}
+}
+
+// commitQueue orders commits newest first, like git log.
+type commitQueue []*gogit.Commit
+
+func (q commitQueue) Len() int      { return len(q) }
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].Committer.When.After(q[j].Committer.When)
+}
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*gogit.Commit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// walkCommits calls fn for every commit reachable from start, newest first.
+// If fn returns a non-nil slice, only those parents are followed; otherwise
+// all parents are. The walk stops early if fn returns false.
+func (tx *gitPassTx) walkCommits(start *gogit.Commit, fn func(c *gogit.Commit, parents []*gogit.Commit) ([]*gogit.Commit, bool)) {
+	seen := map[string]bool{start.Oid.String(): true}
+	q := &commitQueue{start}
+	for q.Len() > 0 {
+		c := heap.Pop(q).(*gogit.Commit)
+		parents := make([]*gogit.Commit, 0, c.ParentCount())
+		for i := 0; i < c.ParentCount(); i++ {
+			if pc := c.Parent(i); pc != nil {
+				parents = append(parents, pc)
+			}
+		}
+		follow, more := fn(c, parents)
+		if !more {
+			return
+		}
+		if follow == nil {
+			follow = parents
+		}
+		for _, pc := range follow {
+			if id := pc.Oid.String(); !seen[id] {
+				seen[id] = true
+				heap.Push(q, pc)
+			}
+		}
+	}
+}
+
+func (tx *gitPassTx) History(p string) ([]PassRevision, error) {
+	p = tx.clean(p)
+
+	// Like git log, a commit is only reported if p differs from all of its
+	// parents; if it is the same as one, only that parent is followed.
+	var ret []PassRevision
+	tx.walkCommits(tx.commit, func(c *gogit.Commit, parents []*gogit.Commit) ([]*gogit.Commit, bool) {
+		id := tx.at(c).entryID(p)
+		for _, pc := range parents {
+			if tx.at(pc).entryID(p) == id {
+				return []*gogit.Commit{pc}, true
+			}
+		}
+		if id != "" || len(parents) > 0 {
+			ret = append(ret, commitRevision(c, id))
+		}
+		return nil, true
+	})
+	return ret, nil
+}
+
+// LastChanges follows the history of every path at once, like History
+// would, until each has a change.
+func (tx *gitPassTx) LastChanges(paths []string) (map[string]PassRevision, error) {
+	ret := make(map[string]PassRevision, len(paths))
+	// the paths whose history reaches each commit, and the commits' views
+	pending := make(map[string][]string)
+	views := make(map[string]*gitPassTx)
+	view := func(c *gogit.Commit) *gitPassTx {
+		if v, ok := views[c.Oid.String()]; ok {
+			return v
+		}
+		v := tx.at(c)
+		views[c.Oid.String()] = v
+		return v
+	}
+	for _, p := range paths {
+		pending[tx.commit.Oid.String()] = append(pending[tx.commit.Oid.String()], tx.clean(p))
+	}
+
+	tx.walkCommits(tx.commit, func(c *gogit.Commit, parents []*gogit.Commit) ([]*gogit.Commit, bool) {
+		id := c.Oid.String()
+		ps := pending[id]
+		delete(pending, id)
+		cv := view(c)
+		delete(views, id)
+		follow := []*gogit.Commit{}
+		following := make(map[string]bool)
+		for _, p := range ps {
+			if _, ok := ret[p]; ok {
+				continue
+			}
+			pid := cv.entryID(p)
+			var same *gogit.Commit
+			for _, pc := range parents {
+				if view(pc).entryID(p) == pid {
+					same = pc
+					break
+				}
+			}
+			if same != nil {
+				sid := same.Oid.String()
+				pending[sid] = append(pending[sid], p)
+				if !following[sid] {
+					following[sid] = true
+					follow = append(follow, same)
+				}
+			} else if pid != "" || len(parents) > 0 {
+				ret[p] = commitRevision(c, pid)
+			}
+		}
+		return follow, len(pending) > 0
+	})
+	return ret, nil
+}
+
+func commitRevision(c *gogit.Commit, version string) PassRevision {
+	sig := c.Author
+	if sig == nil {
+		sig = c.Committer
+	}
+	message, trailers := parseTrailers(c.CommitMessage)
+	return PassRevision{
+		Revision:    c.Oid.String(),
+		Author:      sig.Name,
+		AuthorEmail: sig.Email,
+		Time:        sig.When,
+		Message:     message,
+		Version:     version,
+		UserID:      trailers[trailerUserID],
+		RequestID:   trailers[trailerRequestID],
+		Operation:   trailers[trailerOperation],
+	}
+}
+
+func (tx *gitPassTx) At(revision string) (PassTx, error) {
+	oid, err := gogit.NewOidFromString(revision)
+	if err != nil {
+		return nil, ErrUnknownRevision
+	}
+
+	// only allow revisions that are part of our history
+	var found *gogit.Commit
+	tx.walkCommits(tx.commit, func(c *gogit.Commit, parents []*gogit.Commit) ([]*gogit.Commit, bool) {
+		if c.Oid.Equal(oid) {
+			found = c
+			return nil, false
+		}
+		return nil, true
+	})
+	if found == nil {
+		return nil, ErrUnknownRevision
+	}
+	return tx.at(found), nil
+}
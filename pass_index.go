@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/speedata/gogit"
+)
+
+// indexCacheSize is the number of commits whose indexes are kept. Only the
+// tip of the branch is normally read, but transactions that began before a
+// commit keep using the index of the previous tip.
+const indexCacheSize = 8
+
+// passIndex caches the trees of a commit by path, and the effective
+// recipients of its directories. It is filled in as transactions read the
+// commit, and shared by every transaction that begins at it; since commits
+// never change, it never needs to be invalidated.
+type passIndex struct {
+	repo *gogit.Repository
+	root *gogit.TreeEntry
+
+	mu         sync.Mutex
+	dirs       map[string]*indexedDir
+	recipients map[string]indexedRecipients
+}
+
+type indexedDir struct {
+	tree    *gogit.Tree
+	entries map[string]*gogit.TreeEntry
+}
+
+type indexedRecipients struct {
+	keyIDs []string
+	err    error
+}
+
+func newPassIndex(repo *gogit.Repository, c *gogit.Commit) *passIndex {
+	return &passIndex{
+		repo: repo,
+		root: &gogit.TreeEntry{
+			Type:     gogit.ObjectTree,
+			Id:       c.Tree.Oid,
+			Filemode: gogit.FileModeTree,
+			Name:     "",
+		},
+		dirs:       map[string]*indexedDir{"": newIndexedDir(c.Tree)},
+		recipients: make(map[string]indexedRecipients),
+	}
+}
+
+func newIndexedDir(t *gogit.Tree) *indexedDir {
+	d := &indexedDir{
+		tree:    t,
+		entries: make(map[string]*gogit.TreeEntry, len(t.TreeEntries)),
+	}
+	for _, te := range t.TreeEntries {
+		d.entries[te.Name] = te
+	}
+	return d
+}
+
+// entry returns the tree entry at the clean path p.
+func (ix *passIndex) entry(p string) (*gogit.TreeEntry, error) {
+	if p == "" {
+		return ix.root, nil
+	}
+	dir, file := path.Split(p)
+	if d, err := ix.dir(cleanPassPath(dir)); err != nil {
+		return nil, err
+	} else if te := d.entries[file]; te == nil {
+		return nil, os.ErrNotExist
+	} else {
+		return te, nil
+	}
+}
+
+// dir returns the directory at the clean path p, looking up its tree (and
+// those of its parents) the first time.
+func (ix *passIndex) dir(p string) (*indexedDir, error) {
+	ix.mu.Lock()
+	d, ok := ix.dirs[p]
+	ix.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	// concurrent lookups of the same tree are harmless; the last one wins
+	if te, err := ix.entry(p); err != nil {
+		return nil, err
+	} else if te.Type != gogit.ObjectTree {
+		return nil, os.ErrNotExist
+	} else if t, err := ix.repo.LookupTree(te.Id); err != nil {
+		return nil, err
+	} else {
+		d = newIndexedDir(t)
+	}
+	ix.mu.Lock()
+	ix.dirs[p] = d
+	ix.mu.Unlock()
+	return d, nil
+}
+
+func (ix *passIndex) cachedRecipients(dir string) (indexedRecipients, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	r, ok := ix.recipients[dir]
+	return r, ok
+}
+
+func (ix *passIndex) cacheRecipients(dir string, keyIDs []string, err error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.recipients[dir] = indexedRecipients{keyIDs, err}
+}
+
+// tip returns the repository and the commit at the tip of the branch. The
+// repository is opened once and reused until the branch moves; it's reopened
+// then, since the new commit may be in a pack it hasn't seen.
+func (g *GitPass) tip() (*gogit.Repository, *gogit.Commit, error) {
+	g.repoMu.Lock()
+	defer g.repoMu.Unlock()
+	for reopened := g.repo == nil; ; reopened = true {
+		if reopened {
+			repo, err := gogit.OpenRepository(g.repoRoot)
+			if err != nil {
+				return nil, nil, err
+			}
+			g.repo = repo
+		}
+		ref, err := g.repo.LookupReference("refs/heads/" + g.branch)
+		if err != nil {
+			return nil, nil, err
+		} else if id := ref.Oid.String(); id != g.repoTip && !reopened {
+			continue
+		} else {
+			g.repoTip = id
+		}
+		c, err := g.repo.LookupCommit(ref.Oid)
+		return g.repo, c, err
+	}
+}
+
+// index returns the index of commit c, creating it if it isn't cached.
+func (g *GitPass) index(repo *gogit.Repository, c *gogit.Commit) *passIndex {
+	id := c.Oid.String()
+	if ix, ok := g.indexes.Get(id); ok {
+		return ix.(*passIndex)
+	}
+	ix := newPassIndex(repo, c)
+	g.indexes.Add(id, ix)
+	return ix
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/unrolled/render"
+	"goji.io"
+	"goji.io/pat"
+	"golang.org/x/net/context"
+)
+
+func TestGitPassIndex(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-index")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := pushForTest(t, g, "refs/heads/master", map[string][]byte{
+			".gpg-id":       []byte("A"),
+			"a/.gpg-id":     []byte("B"),
+			"a/b/c/pw.gpg":  []byte("pw"),
+			"d/pw.gpg":      []byte("pw"),
+			"d/e/other.gpg": []byte("pw"),
+		})
+		if err := g.git("update-ref", "refs/heads/master", u.New, u.Old); err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := g.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			p          string
+			recipients string
+		}{
+			{"a/b/c/pw.gpg", "B"},
+			{"a/b", "B"},
+			{"d/e/other.gpg", "A"},
+			{"d", "A"},
+			{"", "A"},
+		} {
+			// twice: once to fill the index, and once from it
+			for i := 0; i < 2; i++ {
+				if r, err := tx.Recipients(c.p); err != nil || len(r) != 1 || r[0] != c.recipients {
+					t.Errorf("Recipients(%q) = %v, %v; want [%s]", c.p, r, err, c.recipients)
+				}
+			}
+		}
+		if exists, isFile := tx.Type("a/b/c/pw.gpg"); !exists || !isFile {
+			t.Error("a/b/c/pw.gpg should be a file")
+		} else if exists, _ := tx.Type("a/b/c/pw.gpg/x"); exists {
+			t.Error("a/b/c/pw.gpg/x should not exist")
+		}
+
+		// changes made outside of the store (by a push) are seen by new
+		// transactions, while old ones keep their commit
+		u = pushForTest(t, g, "refs/heads/master", map[string][]byte{"d/.gpg-id": []byte("C")})
+		if err := g.git("update-ref", "refs/heads/master", u.New, u.Old); err != nil {
+			t.Fatal(err)
+		}
+		if r, _ := tx.Recipients("d/pw.gpg"); len(r) != 1 || r[0] != "A" {
+			t.Errorf("Old transaction got recipients %v; want [A]", r)
+		}
+		if tx, err := g.Begin(); err != nil {
+			t.Fatal(err)
+		} else if r, _ := tx.Recipients("d/pw.gpg"); len(r) != 1 || r[0] != "C" {
+			t.Errorf("New transaction got recipients %v; want [C]", r)
+		}
+	})
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Add("c", 3) // evicts b, the least recently used
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("Get(a) = %v, %v", v, ok)
+	}
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Errorf("Get(c) = %v, %v", v, ok)
+	}
+	c.Purge()
+	if _, ok := c.Get("a"); ok {
+		t.Error("a was not purged")
+	}
+}
+
+// benchmarkStore creates a store of 200 directories of 100 passwords each.
+// Every tenth directory has recipients of its own.
+func benchmarkStore(b *testing.B) (*GitPass, func()) {
+	dir, err := ioutil.TempDir("", "gpm-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	g, err := NewGitPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+
+	var in bytes.Buffer
+	pw := encryptForTest(b, "password")
+	fmt.Fprintf(&in, "blob\nmark :1\ndata %d\n%s\n", len(pw), pw)
+	fmt.Fprintf(&in, "commit refs/heads/master\ncommitter test <test@example.com> 0 +0000\ndata 5\nbench\nfrom refs/heads/master^0\n")
+	fmt.Fprintf(&in, "M 644 inline .gpg-id\ndata %d\n%s\n", len(tolar2PublicKeyID), tolar2PublicKeyID)
+	for d := 0; d < 200; d++ {
+		if d%10 == 0 {
+			fmt.Fprintf(&in, "M 644 inline dir%d/.gpg-id\ndata %d\n%s\n", d, len(tolar2PublicKeyID), tolar2PublicKeyID)
+		}
+		for f := 0; f < 100; f++ {
+			fmt.Fprintf(&in, "M 644 :1 dir%d/pw%d.gpg\n", d, f)
+		}
+	}
+	cmd := g.gitHelper("fast-import", "--quiet")
+	cmd.Stdin = &in
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		b.Fatalf("Could not create store: %v\n%s", err, out)
+	}
+	return g, func() { os.RemoveAll(dir) }
+}
+
+func benchmarkGetPass(b *testing.B, url func(i int) string) {
+	g, cleanup := benchmarkStore(b)
+	defer cleanup()
+	ctx := ContextWithPass(context.Background(), g)
+	ctx = ContextWithRender(ctx, render.New())
+	mux := goji.NewMux()
+	mux.HandleFuncC(pat.Get("/api/pass/*"), handleGetPass)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url(i), nil)
+		mux.ServeHTTPC(ctx, rw, r)
+		if rw.Code != http.StatusOK {
+			b.Fatalf("GET %s: %d %s", r.URL, rw.Code, rw.Body)
+		}
+	}
+}
+
+func BenchmarkGetPassFile(b *testing.B) {
+	benchmarkGetPass(b, func(i int) string {
+		return fmt.Sprintf("/api/pass/dir%d/pw%d.gpg", rand.Intn(200), rand.Intn(100))
+	})
+}
+
+func BenchmarkGetPassDir(b *testing.B) {
+	benchmarkGetPass(b, func(i int) string {
+		return fmt.Sprintf("/api/pass/dir%d", rand.Intn(200))
+	})
+}
+
+func BenchmarkGetAffectedFiles(b *testing.B) {
+	g, cleanup := benchmarkStore(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if tx, err := g.Begin(); err != nil {
+			b.Fatal(err)
+		} else if files, err := tx.GetAffectedFiles("/"); err != nil {
+			b.Fatal(err)
+		} else if len(files) != 18000 {
+			b.Fatalf("Got %d affected files; want 18000", len(files))
+		}
+	}
+}
+
+// BenchmarkGetAffectedFilesUncached measures the first read after a commit,
+// which has to fill the index.
+func BenchmarkGetAffectedFilesUncached(b *testing.B) {
+	g, cleanup := benchmarkStore(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.indexes.Purge()
+		if tx, err := g.Begin(); err != nil {
+			b.Fatal(err)
+		} else if _, err := tx.GetAffectedFiles("/"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
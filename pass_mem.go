@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemPass is a PassStore kept in memory, for tests and development. Like
+// GitPass, it keeps every revision, and a directory only exists while there
+// are files in it.
+type MemPass struct {
+	mu sync.Mutex
+	// revisions are oldest first; the ID of each is its index
+	revisions []memRevision
+	keys      KeyResolver
+}
+
+type memRevision struct {
+	files memFiles
+	info  CommitInfo
+	time  time.Time
+}
+
+// memFiles maps the clean path of every file (including .gpg-id files) to
+// its contents. It is never modified once it's part of a revision.
+type memFiles map[string][]byte
+
+func NewMemPass() *MemPass {
+	return &MemPass{
+		revisions: []memRevision{{
+			files: memFiles{},
+			info:  CommitInfo{Message: "Initial Commit"},
+			time:  time.Now(),
+		}},
+	}
+}
+
+// SetKeyResolver sets the function used to find the subkeys of recipients
+// when verifying that files are encrypted to the right keys.
+func (m *MemPass) SetKeyResolver(r KeyResolver) {
+	m.keys = r
+}
+
+type memPassTx struct {
+	m   *MemPass
+	rev int
+}
+
+type memPassTxW struct {
+	*memChanges
+	base *memPassTx
+}
+
+// memChanges are the changes of a write transaction, for the stores that
+// verify and apply them to a full copy of the files (MemPass and SQLPass).
+// The transaction reads its base through them.
+type memChanges struct {
+	*passOverlay
+	// the deletions (nil contents) are applied first, then the rest
+	changed map[string][]byte
+}
+
+func newMemChanges(base PassTx) *memChanges {
+	c := &memChanges{changed: make(map[string][]byte)}
+	c.passOverlay = &passOverlay{base, func() map[string][]byte { return c.changed }}
+	return c
+}
+
+func (m *MemPass) Begin() (PassTx, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &memPassTx{m, len(m.revisions) - 1}, nil
+}
+
+func (m *MemPass) BeginW() (PassTxW, error) {
+	tx, _ := m.Begin()
+	return &memPassTxW{newMemChanges(tx), tx.(*memPassTx)}, nil
+}
+
+func (tx *memPassTx) files() memFiles {
+	tx.m.mu.Lock()
+	defer tx.m.mu.Unlock()
+	return tx.m.revisions[tx.rev].files
+}
+
+func (f memFiles) typ(p string) (exists bool, file bool) {
+	if _, ok := f[p]; ok {
+		return true, true
+	} else if p == "" {
+		return true, false
+	}
+	for q := range f {
+		if strings.HasPrefix(q, p+"/") {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// under lists the files in the directory p and its subdirectories, sorted.
+func (f memFiles) under(p string) []string {
+	var ret []string
+	for q := range f {
+		if p == "" || strings.HasPrefix(q, p+"/") {
+			ret = append(ret, q)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (f memFiles) version(p string) string {
+	h := sha1.New()
+	if c, ok := f[p]; ok {
+		h.Write(c)
+	} else if exists, _ := f.typ(p); !exists {
+		return ""
+	} else {
+		for _, q := range f.under(p) {
+			fmt.Fprintf(h, "%s\x00%d\x00", q, len(f[q]))
+			h.Write(f[q])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (f memFiles) recipients(dir string) []string {
+	for ; ; dir = cleanPassPath(path.Dir(dir)) {
+		if b, ok := f[path.Join(dir, recipientFile)]; ok {
+			return strings.Split(strings.TrimSpace(string(b)), "\n")
+		} else if dir == "" {
+			return nil
+		}
+	}
+}
+
+func (tx *memPassTx) Type(p string) (exists bool, file bool) {
+	return tx.files().typ(cleanPassPath(p))
+}
+
+func (tx *memPassTx) Version(p string) (string, error) {
+	if v := tx.files().version(cleanPassPath(p)); v != "" {
+		return v, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func (tx *memPassTx) List(p string) ([]PassDirent, error) {
+	return tx.files().list(cleanPassPath(p))
+}
+
+func (f memFiles) list(p string) ([]PassDirent, error) {
+	if exists, isFile := f.typ(p); !exists {
+		return nil, os.ErrNotExist
+	} else if isFile {
+		return nil, os.ErrInvalid
+	}
+	seen := make(map[string]bool)
+	ret := []PassDirent{}
+	for _, q := range f.under(p) {
+		rest := strings.TrimPrefix(strings.TrimPrefix(q, p), "/")
+		name := strings.SplitN(rest, "/", 2)[0]
+		// ignore dot files
+		if strings.HasPrefix(name, ".") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		ret = append(ret, PassDirent{Name: name, File: name == rest})
+	}
+	return ret, nil
+}
+
+func (tx *memPassTx) Get(p string) ([]byte, error) {
+	if c, ok := tx.files()[cleanPassPath(p)]; ok {
+		return c, nil
+	} else if exists, _ := tx.Type(p); exists {
+		return nil, os.ErrInvalid
+	}
+	return nil, os.ErrNotExist
+}
+
+func (tx *memPassTx) Recipients(p string) ([]string, error) {
+	return tx.files().recipients(cleanPassPath(p)), nil
+}
+
+func (tx *memPassTx) GetAffectedFiles(p string) ([]string, error) {
+	return tx.files().affected(cleanPassPath(p)), nil
+}
+
+// affected lists the files that get their recipients from the directory p,
+// or from above it.
+func (f memFiles) affected(p string) []string {
+	var ret []string
+	for _, q := range f.under(p) {
+		// files below a directory with its own recipients aren't affected
+		dir := cleanPassPath(path.Dir(q))
+		affected := !strings.HasPrefix(path.Base(q), ".")
+		for ; affected && dir != p; dir = cleanPassPath(path.Dir(dir)) {
+			_, ownRecipients := f[path.Join(dir, recipientFile)]
+			affected = !ownRecipients
+		}
+		if affected {
+			ret = append(ret, q)
+		}
+	}
+	return ret
+}
+
+func (tx *memPassTx) History(p string) ([]PassRevision, error) {
+	p = cleanPassPath(p)
+	tx.m.mu.Lock()
+	defer tx.m.mu.Unlock()
+	var ret []PassRevision
+	for i := tx.rev; i >= 0; i-- {
+		r := tx.m.revisions[i]
+		v := r.files.version(p)
+		if i > 0 && tx.m.revisions[i-1].files.version(p) == v || i == 0 && v == "" {
+			continue
+		}
+		author := r.info.UserName
+		if author == "" {
+			author = r.info.UserID
+		}
+		if author == "" {
+			author = "pass"
+		}
+		ret = append(ret, PassRevision{
+			Revision:  strconv.Itoa(i),
+			Author:    author,
+			Time:      r.time,
+			Message:   strings.TrimSpace(r.info.Message),
+			Version:   v,
+			UserID:    r.info.UserID,
+			RequestID: r.info.RequestID,
+			Operation: r.info.Operation,
+		})
+	}
+	return ret, nil
+}
+
+func (tx *memPassTx) At(revision string) (PassTx, error) {
+	if i, err := strconv.Atoi(revision); err != nil || i < 0 || i > tx.rev {
+		return nil, ErrUnknownRevision
+	} else {
+		return &memPassTx{tx.m, i}, nil
+	}
+}
+
+func (tx *memChanges) Put(p string, contents []byte) {
+	if len(contents) == 0 {
+		contents = []byte{} // nil is a deletion
+	}
+	tx.changed[cleanPassPath(p)] = contents
+}
+
+func (tx *memChanges) Delete(p string) {
+	p = cleanPassPath(p)
+	// deletions are applied first, so forget the earlier writes that this
+	// deletes
+	for q := range tx.changed {
+		if below(q, p) {
+			delete(tx.changed, q)
+		}
+	}
+	tx.changed[p] = nil
+}
+
+func (tx *memChanges) SetRecipients(p string, recipients []string) {
+	r := path.Join(cleanPassPath(p), recipientFile)
+	if len(recipients) == 0 {
+		tx.changed[r] = nil
+	} else {
+		tx.changed[r] = []byte(strings.Join(recipients, "\n"))
+	}
+}
+
+func (tx *memChanges) Mkdir(p string) {
+	p = cleanPassPath(p)
+	if exists, _ := tx.Type(p); !exists {
+		tx.changed[path.Join(p, placeholderFile)] = []byte{}
+	}
+}
+
+// Move deletes src, and writes everything in it at dst.
+func (tx *memChanges) Move(src, dst string) error {
+	src, dst = cleanPassPath(src), cleanPassPath(dst)
+	if src == "" || dst == "" || dst == src || strings.HasPrefix(dst, src+"/") {
+		return os.ErrInvalid
+	} else if exists, _ := tx.Type(dst); exists {
+		return os.ErrExist
+	}
+	files, err := tx.subtree(src)
+	if err != nil {
+		return err
+	}
+	tx.Delete(src)
+	for rel, contents := range files {
+		tx.changed[path.Join(dst, rel)] = contents
+	}
+	return nil
+}
+
+// apply returns a copy of f with the changes of the transaction.
+func (tx *memChanges) apply(f memFiles) memFiles {
+	ret := make(memFiles, len(f))
+	for p, c := range f {
+		ret[p] = c
+	}
+	remove := func(p string) {
+		delete(ret, p)
+		for _, q := range ret.under(p) {
+			delete(ret, q)
+		}
+	}
+
+	for p, c := range tx.changed {
+		if c == nil {
+			remove(p)
+		}
+	}
+	for p, c := range tx.changed {
+		if c != nil {
+			ret[p] = c
+		}
+	}
+	return ret
+}
+
+// touchedPaths lists the paths whose contents the transaction depends on,
+// like gitPassTxW.touchedPaths.
+func (tx *memChanges) touchedPaths() []string {
+	var ret []string
+	add := func(p string) {
+		ret = append(ret, p)
+		for dir := cleanPassPath(path.Dir(p)); ; dir = cleanPassPath(path.Dir(dir)) {
+			ret = append(ret, path.Join(dir, recipientFile))
+			if dir == "" {
+				break
+			}
+		}
+	}
+	for p := range tx.changed {
+		add(p)
+		if path.Base(p) == recipientFile {
+			// the version of a directory covers everything in it
+			ret = append(ret, cleanPassPath(path.Dir(p)))
+		}
+	}
+	return ret
+}
+
+// conflicts checks if something the transaction depends on has changed from
+// base (where it began) to tip (where it would be committed).
+func (tx *memChanges) conflicts(base, tip memFiles) bool {
+	for _, p := range tx.touchedPaths() {
+		if base.version(p) != tip.version(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the changes from before to after, following the same rules
+// as GitPass.
+func (tx *memChanges) verify(before, after memFiles, keys KeyResolver) error {
+	for p, c := range tx.changed {
+		dir := cleanPassPath(path.Dir(p))
+		switch {
+		case c == nil:
+			q := p
+			if path.Base(p) == recipientFile || path.Base(p) == placeholderFile {
+				q = dir
+			}
+			if err := validatePassPath(q, passPathAny); err != nil {
+				return err
+			} else if p == recipientFile {
+				return VerifyError{"/", "the root directory must have recipients"}
+			}
+		case path.Base(p) == recipientFile || path.Base(p) == placeholderFile:
+			if err := validatePassPath(dir, passPathDir); err != nil {
+				return err
+			} else if after.fileAt(dir) {
+				return VerifyError{dir, "is a file"}
+			}
+		default:
+			kind := passPathFile
+			if exists, isFile := before.typ(p); exists && isFile {
+				kind = passPathAny
+			}
+			if err := validatePassPath(p, kind); err != nil {
+				return err
+			} else if exists, isFile := before.typ(p); exists && !isFile {
+				return VerifyError{p, "is a directory"}
+			} else if after.fileAt(dir) {
+				return VerifyError{p, "parent is a file"}
+			}
+		}
+	}
+
+	// like with GitPass, changing a .gpg-id means reencrypting every file
+	// that gets its recipients from it
+	for p := range tx.changed {
+		dir := cleanPassPath(path.Dir(p))
+		if exists, _ := before.typ(dir); !exists || path.Base(p) != recipientFile {
+			continue
+		}
+		for _, f := range after.affected(dir) {
+			if _, ok := tx.changed[f]; !ok {
+				return VerifyError{f, "must be reencrypted to the new recipients of " + dir}
+			}
+		}
+	}
+
+	// every file that was written or moved must be encrypted to its
+	// recipients
+	for _, p := range after.under("") {
+		_, written := tx.changed[p]
+		if c, ok := before[p]; strings.HasPrefix(path.Base(p), ".") || ok && !written && string(c) == string(after[p]) {
+			continue
+		} else if err := verifyCiphertext(p, after[p], after.recipients(cleanPassPath(path.Dir(p))), keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileAt checks if there is a file at dir or any of its parents, like
+// parentIsFile.
+func (f memFiles) fileAt(dir string) bool {
+	for ; dir != ""; dir = cleanPassPath(path.Dir(dir)) {
+		if _, ok := f[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *memPassTxW) Commit(info CommitInfo) error {
+	m := tx.base.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	base, tip := m.revisions[tx.base.rev].files, m.revisions[len(m.revisions)-1].files
+
+	if err := tx.verify(base, tx.apply(base), m.keys); err != nil {
+		return err
+	}
+	if tx.conflicts(base, tip) {
+		return ErrConflict
+	}
+	if info.Message == "" {
+		info.Message = "Update passwords"
+	}
+	m.revisions = append(m.revisions, memRevision{
+		files: tx.apply(tip),
+		info:  info,
+		time:  time.Now(),
+	})
+	return nil
+}
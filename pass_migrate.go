@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// storeSnapshot is the full contents of a revision of a PassStore, as read
+// through a PassTx.
+type storeSnapshot struct {
+	// files maps the path of every file to its contents.
+	files map[string][]byte
+	// recipients maps the directories that have a .gpg-id to its key IDs.
+	recipients map[string]string
+	// dirs has every directory, including the root.
+	dirs map[string]bool
+}
+
+func readStoreSnapshot(tx PassTx) (storeSnapshot, error) {
+	s := storeSnapshot{
+		files:      make(map[string][]byte),
+		recipients: make(map[string]string),
+		dirs:       make(map[string]bool),
+	}
+	err := PassWalk(tx, "/", func(d PassDirent) error {
+		p := cleanPassPath(d.Name)
+		if d.File {
+			c, err := tx.Get(p)
+			s.files[p] = c
+			return err
+		}
+		s.dirs[p] = true
+		r := path.Join(p, recipientFile)
+		if exists, isFile := tx.Type(r); exists && isFile {
+			c, err := tx.Get(r)
+			s.recipients[p] = strings.TrimSpace(string(c))
+			return err
+		}
+		return nil
+	})
+	return s, err
+}
+
+// copyStoreSnapshot makes dst look like src in a single commit. It returns
+// false, without committing, if dst already did.
+func copyStoreSnapshot(dst PassStore, src storeSnapshot, info CommitInfo) (bool, error) {
+	tx, err := dst.BeginW()
+	if err != nil {
+		return false, err
+	}
+	old, err := readStoreSnapshot(tx)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+
+	// remove what's gone, only deleting the topmost directory of each
+	// removed subtree
+	for p := range old.files {
+		if _, ok := src.files[p]; !ok && src.dirs[cleanPassPath(path.Dir(p))] {
+			tx.Delete(p)
+			changed = true
+		}
+	}
+	for p := range old.dirs {
+		if !src.dirs[p] && src.dirs[cleanPassPath(path.Dir(p))] {
+			tx.Delete(p)
+			changed = true
+		}
+	}
+
+	// files must be reencrypted whenever their recipients change, so put
+	// every file below a changed .gpg-id even if it's the same
+	var reencrypt []string
+	for p, r := range src.recipients {
+		if o, ok := old.recipients[p]; !ok || o != r {
+			tx.SetRecipients(p, strings.Split(r, "\n"))
+			reencrypt = append(reencrypt, p)
+			changed = true
+		}
+	}
+	for p := range old.recipients {
+		if _, ok := src.recipients[p]; !ok && src.dirs[p] {
+			tx.SetRecipients(p, nil)
+			reencrypt = append(reencrypt, p)
+			changed = true
+		}
+	}
+	nonEmpty := make(map[string]bool)
+	for p, c := range src.files {
+		nonEmpty[cleanPassPath(path.Dir(p))] = true
+		o, ok := old.files[p]
+		put := !ok || string(o) != string(c)
+		for _, dir := range reencrypt {
+			put = put || dir == "" || strings.HasPrefix(p, dir+"/")
+		}
+		if put {
+			tx.Put(p, c)
+			changed = true
+		}
+	}
+
+	// empty directories are the only ones that need to be created
+	for p := range src.dirs {
+		if p != "" {
+			nonEmpty[cleanPassPath(path.Dir(p))] = true
+		}
+	}
+	for p := range src.dirs {
+		if _, ok := src.recipients[p]; !nonEmpty[p] && !ok && !old.dirs[p] {
+			tx.Mkdir(p)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+	return true, tx.Commit(info)
+}
+
+// migratePass copies the history of src to dst, which must be empty, with a
+// commit for each revision of src. The commits keep their messages and
+// attribution, but are made at the current time. It's used to move a store
+// between a git repository and a database, in either direction.
+func migratePass(dst, src PassStore) error {
+	if tx, err := dst.Begin(); err != nil {
+		return err
+	} else if s, err := readStoreSnapshot(tx); err != nil {
+		return err
+	} else if len(s.files) > 0 || len(s.recipients) > 0 {
+		return errors.New("the destination is not empty")
+	}
+
+	tx, err := src.Begin()
+	if err != nil {
+		return err
+	}
+	revs, err := tx.History("/")
+	if err != nil {
+		return err
+	}
+	for i := len(revs) - 1; i >= 0; i-- {
+		r := revs[i]
+		info := CommitInfo{
+			UserID:    r.UserID,
+			Message:   r.Message,
+			RequestID: r.RequestID,
+			Operation: r.Operation,
+		}
+		if r.UserID != "" {
+			info.UserName = r.Author
+		}
+		if at, err := tx.At(r.Revision); err != nil {
+			return err
+		} else if s, err := readStoreSnapshot(at); err != nil {
+			return fmt.Errorf("revision %s: %v", r.Revision, err)
+		} else if _, err := copyStoreSnapshot(dst, s, info); err != nil {
+			return fmt.Errorf("revision %s: %v", r.Revision, err)
+		}
+	}
+	return nil
+}
+
+// migrateCommand runs "export <repo>", which copies the database store to a
+// new git repository at repo, or "import <repo>", which copies the git
+// repository at repo to the (empty) database store.
+func migrateCommand(config Config, command, repo string) int {
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return 1
+	}
+
+	if _, err := os.Stat(repo); command == "export" && err == nil {
+		return fail(fmt.Errorf("%s already exists", repo))
+	} else if command == "import" && err != nil {
+		return fail(err)
+	}
+	db, err := initDB(config.DB.Driver, config.DB.DSN)
+	if err != nil {
+		return fail(err)
+	}
+	sp, err := NewSQLPass(db)
+	if err != nil {
+		return fail(err)
+	}
+	g, err := NewGitPass(repo, config.Git.Branch, false)
+	if err != nil {
+		return fail(err)
+	}
+	sp.SetKeyResolver(storeKeyResolver(db))
+	g.SetKeyResolver(storeKeyResolver(db))
+	g.SetEmailDomain(config.Git.EmailDomain)
+	if signer, trusted, err := loadSigningConfig(config); err != nil {
+		return fail(err)
+	} else {
+		g.SetSigningKey(signer)
+		g.SetTrustedKeys(trusted)
+	}
+
+	if command == "export" {
+		err = migratePass(g, sp)
+	} else {
+		err = migratePass(sp, g)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/speedata/gogit"
+)
+
+const nativeTreeMode = "40000"
+
+// ErrNativeUnsupported is returned by the features of GitPass that run the
+// git binary when the store uses the native backend, which is meant for hosts
+// without it.
+var ErrNativeUnsupported = errors.New("not supported by the native git backend")
+
+// nativeGit is the gitBackend that writes loose objects and refs itself, in
+// the same formats (and with the same ref locking) as git.
+type nativeGit struct{}
+
+func (g *GitPass) isNative() bool {
+	_, ok := g.backend.(nativeGit)
+	return ok
+}
+
+func (nativeGit) initRepository(g *GitPass) error {
+	for _, d := range []string{"objects/info", "objects/pack", "refs/heads", "refs/tags", "hooks"} {
+		if err := os.MkdirAll(filepath.Join(g.repoRoot, filepath.FromSlash(d)), 0700); err != nil {
+			return err
+		}
+	}
+	files := map[string]string{
+		"HEAD":   "ref: refs/heads/" + g.branch + "\n",
+		"config": "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(g.repoRoot, name), []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+
+	_, committer := g.commitIdents(CommitInfo{})
+	if tree, err := writeObject(g.repoRoot, "tree", nil); err != nil {
+		return err
+	} else if c, err := writeObject(g.repoRoot, "commit", []byte(fmt.Sprintf("tree %s\nauthor %s\ncommitter %s\n\nInitial Commit\n", tree, committer, committer))); err != nil {
+		return err
+	} else {
+		return updateRef(g.repoRoot, "refs/heads/"+g.branch, c, "")
+	}
+}
+
+// importCommits builds the trees of the commits in memory, writing only the
+// trees that changed, and then moves ref to the last commit.
+func (nativeGit) importCommits(g *GitPass, ref, from string, commits []importedCommit) error {
+	repo, _, err := g.tip()
+	if err != nil {
+		return err
+	}
+	oid, err := gogit.NewOidFromString(from)
+	if err != nil {
+		return err
+	}
+	c, err := repo.LookupCommit(oid)
+	if err != nil {
+		return err
+	}
+
+	root := &nativeTree{id: c.Tree.Oid.String()}
+	parent := from
+	for _, c := range commits {
+		for _, p := range c.deletes {
+			if _, err := root.remove(repo, splitPath(p)); err != nil {
+				return err
+			}
+		}
+		for _, f := range c.files {
+			e := &nativeEntry{mode: strings.TrimLeft(f.mode, "0"), id: f.id}
+			if f.contents != nil {
+				if e.id, err = writeObject(g.repoRoot, "blob", f.contents); err != nil {
+					return err
+				}
+			}
+			if err := root.set(repo, splitPath(f.path), e); err != nil {
+				return err
+			}
+		}
+
+		tree, err := root.write(g.repoRoot)
+		if err != nil {
+			return err
+		}
+		author, committer := g.commitIdents(c.info)
+		if author == "" {
+			author = committer
+		}
+		var raw bytes.Buffer
+		fmt.Fprintf(&raw, "tree %s\nparent %s\n", tree, parent)
+		if c.merge != "" {
+			fmt.Fprintf(&raw, "parent %s\n", c.merge)
+		}
+		fmt.Fprintf(&raw, "author %s\ncommitter %s\n\n%s", author, committer, formatTrailers(c.info))
+		commit := raw.Bytes()
+		if g.signer != nil {
+			if commit, err = g.signedCommit(commit); err != nil {
+				return err
+			}
+		}
+		if parent, err = writeObject(g.repoRoot, "commit", commit); err != nil {
+			return err
+		}
+	}
+	return updateRef(g.repoRoot, ref, parent, from)
+}
+
+func splitPath(p string) []string {
+	return strings.Split(cleanPassPath(p), "/")
+}
+
+// nativeTree is a tree being modified. Subtrees are only read when they are
+// needed; an unmodified tree keeps its object ID.
+type nativeTree struct {
+	// id is empty if the tree was modified
+	id string
+	// entries are nil until the tree is read
+	entries map[string]*nativeEntry
+}
+
+type nativeEntry struct {
+	mode string
+	// id is the object of a blob, or of a tree that hasn't been read
+	id   string
+	tree *nativeTree
+}
+
+func (t *nativeTree) load(repo *gogit.Repository) error {
+	if t.entries != nil {
+		return nil
+	}
+	t.entries = make(map[string]*nativeEntry)
+	if t.id == "" {
+		return nil
+	}
+	oid, err := gogit.NewOidFromString(t.id)
+	if err != nil {
+		return err
+	}
+	gt, err := repo.LookupTree(oid)
+	if err != nil {
+		return err
+	}
+	for _, te := range gt.TreeEntries {
+		t.entries[te.Name] = &nativeEntry{
+			mode: fmt.Sprintf("%o", te.Filemode),
+			id:   te.Id.String(),
+		}
+	}
+	return nil
+}
+
+// subtree returns the tree of a directory entry.
+func (e *nativeEntry) subtree() *nativeTree {
+	if e.tree == nil {
+		e.tree = &nativeTree{id: e.id}
+	}
+	return e.tree
+}
+
+// remove removes the file or directory at path, and the directories that
+// become empty, returning the removed entry (or nil if there was none).
+func (t *nativeTree) remove(repo *gogit.Repository, path []string) (*nativeEntry, error) {
+	if err := t.load(repo); err != nil {
+		return nil, err
+	}
+	name := path[0]
+	e := t.entries[name]
+	if e == nil {
+		return nil, nil
+	} else if len(path) == 1 {
+		delete(t.entries, name)
+		t.id = ""
+		return e, nil
+	} else if e.mode != nativeTreeMode {
+		return nil, nil
+	}
+
+	sub := e.subtree()
+	removed, err := sub.remove(repo, path[1:])
+	if err != nil || removed == nil {
+		return removed, err
+	}
+	t.id = ""
+	if len(sub.entries) == 0 {
+		delete(t.entries, name)
+	}
+	return removed, nil
+}
+
+// set puts e at path, creating parent directories (and replacing files in the
+// way) as needed.
+func (t *nativeTree) set(repo *gogit.Repository, path []string, e *nativeEntry) error {
+	if err := t.load(repo); err != nil {
+		return err
+	}
+	t.id = ""
+	name := path[0]
+	if len(path) == 1 {
+		t.entries[name] = e
+		return nil
+	}
+	dir := t.entries[name]
+	if dir == nil || dir.mode != nativeTreeMode {
+		dir = &nativeEntry{mode: nativeTreeMode, tree: &nativeTree{}}
+		t.entries[name] = dir
+	}
+	return dir.subtree().set(repo, path[1:], e)
+}
+
+// write writes the modified trees, and returns the ID of t.
+func (t *nativeTree) write(root string) (string, error) {
+	if t.id != "" {
+		return t.id, nil
+	}
+
+	// git sorts directories as if their names ended with a slash
+	keys := make([]string, 0, len(t.entries))
+	names := make(map[string]string, len(t.entries))
+	for name, e := range t.entries {
+		key := name
+		if e.mode == nativeTreeMode {
+			key += "/"
+		}
+		keys = append(keys, key)
+		names[key] = name
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		name := names[key]
+		e := t.entries[name]
+		if e.tree != nil {
+			var err error
+			if e.id, err = e.tree.write(root); err != nil {
+				return "", err
+			}
+		}
+		id, err := hex.DecodeString(e.id)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&buf, "%s %s\x00", e.mode, name)
+		buf.Write(id)
+	}
+	id, err := writeObject(root, "tree", buf.Bytes())
+	if err == nil {
+		t.id = id
+	}
+	return id, err
+}
+
+// writeObject writes a loose object to the repository at root, unless it's
+// already there, and returns its ID.
+func writeObject(root, kind string, data []byte) (string, error) {
+	return writeObjectFrom(root, kind, bytes.NewReader(data), int64(len(data)))
+}
+
+// writeObjectFrom is writeObject for the size bytes of r, which it reads
+// twice (once to hash them, and once to write them) instead of holding them in
+// memory.
+func writeObjectFrom(root, kind string, r io.ReadSeeker, size int64) (string, error) {
+	header := fmt.Sprintf("%s %d\x00", kind, size)
+	h := sha1.New()
+	io.WriteString(h, header)
+	if _, err := io.Copy(h, io.LimitReader(r, size)); err != nil {
+		return "", err
+	} else if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(h.Sum(nil))
+
+	dir := filepath.Join(root, "objects", id[:2])
+	file := filepath.Join(dir, id[2:])
+	if _, err := os.Stat(file); err == nil {
+		return id, nil
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first, so that the object appears atomically
+	f, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	zw := zlib.NewWriter(f)
+	io.WriteString(zw, header)
+	if _, err := io.Copy(zw, io.LimitReader(r, size)); err != nil {
+		f.Close()
+		return "", err
+	} else if err := zw.Close(); err != nil {
+		f.Close()
+		return "", err
+	} else if err := f.Close(); err != nil {
+		return "", err
+	} else if err := os.Chmod(f.Name(), 0444); err != nil {
+		return "", err
+	}
+	return id, os.Rename(f.Name(), file)
+}
+
+// readRef returns the ID the ref name points to, or the empty string if it
+// doesn't exist.
+func readRef(root, name string) (string, error) {
+	if b, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name))); err == nil {
+		return strings.TrimSpace(string(b)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// refs may have been packed by git gc
+	f, err := os.Open(filepath.Join(root, "packed-refs"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) == 2 && fields[1] == name {
+			return fields[0], nil
+		}
+	}
+	return "", s.Err()
+}
+
+// updateRef points the ref name to id if it points to old (or doesn't exist,
+// if old is empty); otherwise, errRefMoved is returned. Like git update-ref,
+// it holds name.lock while doing so.
+func updateRef(root, name, id, old string) error {
+	file := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(file+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		// someone else (maybe git) is updating it
+		return errRefMoved
+	} else if err != nil {
+		return err
+	}
+	// the lock is only removed if it's still ours: once renamed, a file of
+	// the same name is someone else's lock
+	abort := func(err error) error {
+		lock.Close()
+		os.Remove(lock.Name())
+		return err
+	}
+
+	if cur, err := readRef(root, name); err != nil {
+		return abort(err)
+	} else if cur != old {
+		return abort(errRefMoved)
+	} else if _, err := io.WriteString(lock, id+"\n"); err != nil {
+		return abort(err)
+	} else if err := lock.Close(); err != nil {
+		return abort(err)
+	} else if err := os.Rename(lock.Name(), file); err != nil {
+		os.Remove(lock.Name())
+		return err
+	}
+	return nil
+}
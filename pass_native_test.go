@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type newGitPassFunc func(root, branch string, debug bool) (*GitPass, error)
+
+// forEachGitBackend runs a test of GitPass with each way of writing to the
+// repository.
+func forEachGitBackend(t *testing.T, test func(t *testing.T, newPass newGitPassFunc)) {
+	for _, b := range []struct {
+		name    string
+		newPass newGitPassFunc
+	}{
+		{"exec", NewGitPass},
+		{"native", NewNativeGitPass},
+	} {
+		t.Run(b.name, func(t *testing.T) {
+			test(t, b.newPass)
+		})
+	}
+}
+
+// TestNativeGitPass makes the same transactions with both backends, which
+// must produce the same trees, and checks the repository written by the
+// native one with git fsck.
+func TestNativeGitPass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+
+	exec, err := NewGitPass(filepath.Join(dir, "exec.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := NewNativeGitPass(filepath.Join(dir, "native.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := native.git("fsck", "--strict"); err != nil {
+		t.Fatal("New repository is invalid: ", err)
+	}
+
+	var pw [4][]byte
+	for i := range pw {
+		pw[i] = encryptForTest(t, "password")
+	}
+	steps := []struct {
+		name string
+		tx   func(tx PassTxW) error
+	}{
+		{"set recipients", func(tx PassTxW) error {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			return nil
+		}},
+		{"put", func(tx PassTxW) error {
+			tx.Put("/a.gpg", pw[0])
+			tx.Put("/dir/b.gpg", pw[1])
+			tx.Put("/dir/sub/c.gpg", pw[2])
+			tx.Mkdir("/empty")
+			return nil
+		}},
+		{"move directory", func(tx PassTxW) error {
+			return tx.Move("dir", "moved/here")
+		}},
+		{"delete last file", func(tx PassTxW) error {
+			tx.Delete("/moved/here/sub/c.gpg")
+			return nil
+		}},
+		{"set subdirectory recipients", func(tx PassTxW) error {
+			tx.SetRecipients("/other", []string{tolar2PublicKeyID})
+			tx.Put("/other/d.gpg", pw[3])
+			return nil
+		}},
+		{"move file", func(tx PassTxW) error {
+			return tx.Move("other/d.gpg", "d.gpg")
+		}},
+		{"delete directory", func(tx PassTxW) error {
+			tx.Delete("/moved")
+			tx.Delete("/a.gpg")
+			return nil
+		}},
+	}
+	for _, s := range steps {
+		var trees [2]string
+		for i, g := range []*GitPass{exec, native} {
+			g.SetKeyResolver(storeKeyResolver(db))
+			if tx, err := g.BeginW(); err != nil {
+				t.Fatal(err)
+			} else if err := s.tx(tx); err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			} else if err := tx.Commit(CommitInfo{UserID: "test", Message: s.name}); err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			} else if tree, err := g.gitO("rev-parse", "master^{tree}"); err != nil {
+				t.Fatal(err)
+			} else {
+				trees[i] = string(tree)
+			}
+		}
+		if trees[0] != trees[1] {
+			ls, _ := native.gitO("ls-tree", "-r", "-t", "master")
+			t.Fatalf("%s: native tree %s != %s:\n%s", s.name, trees[1], trees[0], ls)
+		}
+	}
+
+	if err := native.git("fsck", "--strict"); err != nil {
+		t.Fatal("Repository is invalid: ", err)
+	}
+	if tx, err := native.Begin(); err != nil {
+		t.Fatal(err)
+	} else if revs, err := tx.History("/d.gpg"); err != nil {
+		t.Fatal(err)
+	} else if len(revs) != 1 || revs[0].UserID != "test" || revs[0].Message != "move file" {
+		t.Fatalf("Got unexpected history: %+v", revs)
+	}
+}
+
+// TestNativeGitPassUnsupported checks that the native backend refuses what
+// needs the git binary.
+func TestNativeGitPassUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g, err := NewNativeGitPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddRemote(Remote{Name: "origin", URL: filepath.Join(dir, "remote.git")}); err != ErrNativeUnsupported {
+		t.Errorf("AddRemote returned %v", err)
+	} else if len(g.Remotes()) != 0 {
+		t.Error("AddRemote added a remote")
+	}
+	if err := g.InstallPreReceiveHook("/bin/true"); err != ErrNativeUnsupported {
+		t.Errorf("InstallPreReceiveHook returned %v", err)
+	} else if _, err := os.Stat(filepath.Join(dir, "repo.git", "hooks", "pre-receive")); err == nil {
+		t.Error("InstallPreReceiveHook installed a hook")
+	}
+	if _, err := g.HTTPBackend("/git", "test"); err != ErrNativeUnsupported {
+		t.Errorf("HTTPBackend returned %v", err)
+	}
+}
+
+func TestUpdateRef(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const a, b = "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"
+	lock := filepath.Join(dir, "refs", "heads", "master.lock")
+
+	if err := updateRef(dir, "refs/heads/master", a, ""); err != nil {
+		t.Fatal(err)
+	} else if err := updateRef(dir, "refs/heads/master", b, b); err != errRefMoved {
+		t.Errorf("Update from the wrong value returned %v", err)
+	} else if _, err := os.Stat(lock); err == nil {
+		t.Error("A failed update left its lock")
+	} else if err := updateRef(dir, "refs/heads/master", b, a); err != nil {
+		t.Fatal(err)
+	} else if cur, err := readRef(dir, "refs/heads/master"); err != nil || cur != b {
+		t.Errorf("Ref is %q after updating it: %v", cur, err)
+	} else if _, err := os.Stat(lock); err == nil {
+		t.Error("An update left its lock")
+	}
+
+	// the lock of someone else is left alone
+	if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	} else if err := updateRef(dir, "refs/heads/master", a, b); err != errRefMoved {
+		t.Errorf("Update of a locked ref returned %v", err)
+	} else if _, err := os.Stat(lock); err != nil {
+		t.Error("An update removed the lock of someone else")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// passOverlay is what a write transaction reads: base, with the transaction's
+// pending changes applied. Like Commit, it applies every deletion (of a file
+// or a whole directory) before writing any file; write transactions keep
+// their changes so that this has the same result as making them in order.
+// Paths that no change touches are read from base.
+type passOverlay struct {
+	base PassTx
+	// pending returns every changed path (including .gpg-id and placeholder
+	// files) with its new contents, or nil if it's deleted.
+	pending func() map[string][]byte
+}
+
+// below checks if q is inside the directory p.
+func below(q, p string) bool {
+	return q != p && (p == "" || strings.HasPrefix(q, p+"/"))
+}
+
+// deleted checks if p, or one of its parents, is deleted by changes.
+func deleted(changes map[string][]byte, p string) bool {
+	for dir := p; ; dir = cleanPassPath(path.Dir(dir)) {
+		if c, ok := changes[dir]; ok && c == nil {
+			return true
+		} else if dir == "" {
+			return false
+		}
+	}
+}
+
+// touched checks if changes affect p or anything inside it.
+func touched(changes map[string][]byte, p string) bool {
+	for q := range changes {
+		if q == p || below(q, p) {
+			return true
+		}
+	}
+	return deleted(changes, p)
+}
+
+func (o *passOverlay) typ(changes map[string][]byte, p string) (exists bool, file bool) {
+	if c := changes[p]; c != nil {
+		return true, true
+	}
+	for q, c := range changes {
+		if c != nil && below(q, p) {
+			return true, false
+		}
+	}
+	if deleted(changes, p) {
+		return false, false
+	}
+	exists, file = o.base.Type(p)
+	if !exists || file || p == "" || !touched(changes, p) {
+		return exists, file
+	}
+	// a directory only remains while something is left in it
+	return len(o.children(changes, p)) > 0, false
+}
+
+// children returns the names of the files and directories (including dot
+// files) in the directory p, and whether each is a file.
+func (o *passOverlay) children(changes map[string][]byte, p string) map[string]bool {
+	names := make(map[string]bool)
+	if !deleted(changes, p) {
+		if l, err := o.base.List(p); err == nil {
+			for _, d := range l {
+				names[d.Name] = true
+			}
+		}
+		// List leaves them out
+		for _, name := range []string{recipientFile, recipientSigFile, placeholderFile} {
+			names[name] = true
+		}
+	}
+	for q := range changes {
+		if below(q, p) {
+			names[strings.SplitN(strings.TrimPrefix(q[len(p):], "/"), "/", 2)[0]] = true
+		}
+	}
+
+	ret := make(map[string]bool, len(names))
+	for name := range names {
+		if exists, isFile := o.typ(changes, path.Join(p, name)); exists {
+			ret[name] = isFile
+		}
+	}
+	return ret
+}
+
+func (o *passOverlay) Type(p string) (exists bool, file bool) {
+	return o.typ(o.pending(), cleanPassPath(p))
+}
+
+func (o *passOverlay) Version(p string) (string, error) {
+	return o.version(o.pending(), cleanPassPath(p))
+}
+
+// version returns the version of base for untouched paths. The versions of
+// changed ones are only meaningful within the transaction.
+func (o *passOverlay) version(changes map[string][]byte, p string) (string, error) {
+	if !touched(changes, p) {
+		return o.base.Version(p)
+	}
+	exists, isFile := o.typ(changes, p)
+	if !exists {
+		return "", os.ErrNotExist
+	}
+	h := sha1.New()
+	if isFile {
+		if c, err := o.get(changes, p); err != nil {
+			return "", err
+		} else {
+			h.Write(c)
+		}
+	} else {
+		children := o.children(changes, p)
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if v, err := o.version(changes, path.Join(p, name)); err != nil {
+				return "", err
+			} else {
+				fmt.Fprintf(h, "%s\x00%s\x00", name, v)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (o *passOverlay) List(p string) ([]PassDirent, error) {
+	p = cleanPassPath(p)
+	changes := o.pending()
+	if !touched(changes, p) {
+		return o.base.List(p)
+	} else if exists, isFile := o.typ(changes, p); !exists {
+		return nil, os.ErrNotExist
+	} else if isFile {
+		return nil, os.ErrInvalid
+	}
+	children := o.children(changes, p)
+	names := make([]string, 0, len(children))
+	for name := range children {
+		// ignore dot files
+		if !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ret := make([]PassDirent, len(names))
+	for i, name := range names {
+		ret[i] = PassDirent{Name: name, File: children[name]}
+	}
+	return ret, nil
+}
+
+func (o *passOverlay) Get(p string) ([]byte, error) {
+	return o.get(o.pending(), cleanPassPath(p))
+}
+
+func (o *passOverlay) get(changes map[string][]byte, p string) ([]byte, error) {
+	if c := changes[p]; c != nil {
+		return c, nil
+	} else if !touched(changes, p) {
+		return o.base.Get(p)
+	} else if exists, isFile := o.typ(changes, p); !exists {
+		return nil, os.ErrNotExist
+	} else if !isFile {
+		return nil, os.ErrInvalid
+	}
+	return o.base.Get(p)
+}
+
+func (o *passOverlay) Recipients(p string) ([]string, error) {
+	changes := o.pending()
+	if len(changes) == 0 {
+		return o.base.Recipients(p)
+	}
+	for dir := cleanPassPath(p); ; dir = cleanPassPath(path.Dir(dir)) {
+		r := path.Join(dir, recipientFile)
+		if c := changes[r]; c != nil {
+			return strings.Split(strings.TrimSpace(string(c)), "\n"), nil
+		} else if exists, isFile := o.typ(changes, r); exists && isFile {
+			// unchanged, so base can check it (and its signature)
+			return o.base.Recipients(dir)
+		} else if dir == "" {
+			return nil, nil
+		}
+	}
+}
+
+func (o *passOverlay) GetAffectedFiles(p string) ([]string, error) {
+	p = cleanPassPath(p)
+	changes := o.pending()
+	if !touched(changes, p) {
+		return o.base.GetAffectedFiles(p)
+	}
+
+	// files below a directory with its own recipients aren't affected
+	var ret []string
+	var walk func(dir string)
+	walk = func(dir string) {
+		for name, isFile := range o.children(changes, dir) {
+			q := path.Join(dir, name)
+			if strings.HasPrefix(name, ".") {
+				continue
+			} else if isFile {
+				ret = append(ret, q)
+			} else if exists, _ := o.typ(changes, path.Join(q, recipientFile)); !exists {
+				walk(q)
+			}
+		}
+	}
+	if exists, isFile := o.typ(changes, p); exists && !isFile {
+		walk(p)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (o *passOverlay) History(p string) ([]PassRevision, error) {
+	return o.base.History(p)
+}
+
+func (o *passOverlay) At(revision string) (PassTx, error) {
+	return o.base.At(revision)
+}
+
+func (o *passOverlay) Walk(root string, fn PassWalkFn) error {
+	if !touched(o.pending(), cleanPassPath(root)) {
+		return PassWalk(o.base, root, fn)
+	}
+	return walkPassTx(o, root, fn)
+}
+
+// subtree returns the files at or below p (including .gpg-id and placeholder
+// files, but not signatures), by their path relative to p; a file p itself
+// is "".
+func (o *passOverlay) subtree(p string) (map[string][]byte, error) {
+	p = cleanPassPath(p)
+	changes := o.pending()
+	ret := make(map[string][]byte)
+	var walk func(q string, isFile bool) error
+	walk = func(q string, isFile bool) error {
+		if isFile {
+			c, err := o.get(changes, q)
+			ret[strings.TrimPrefix(q[len(p):], "/")] = c
+			return err
+		}
+		for name, isFile := range o.children(changes, q) {
+			if name == recipientSigFile {
+				continue
+			} else if err := walk(path.Join(q, name), isFile); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if exists, isFile := o.typ(changes, p); !exists {
+		return nil, os.ErrNotExist
+	} else {
+		return ret, walk(p, isFile)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const zeroID = "0000000000000000000000000000000000000000"
+
+// refUpdate is a ref changed by a push, as given to the pre-receive hook.
+type refUpdate struct {
+	Old, New, Ref string
+}
+
+func readRefUpdates(r io.Reader) ([]refUpdate, error) {
+	var ret []refUpdate
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) != 3 {
+			return nil, fmt.Errorf("unexpected pre-receive input %q", s.Text())
+		}
+		ret = append(ret, refUpdate{f[0], f[1], f[2]})
+	}
+	return ret, s.Err()
+}
+
+// gitRevision reads the files of a commit with git plumbing. Unlike gogit,
+// this also sees the objects of a push that hasn't been accepted yet.
+type gitRevision struct {
+	g   *GitPass
+	rev string
+}
+
+func (r gitRevision) get(p string) ([]byte, error) {
+	return r.g.gitB("cat-file", "blob", r.rev+":"+p)
+}
+
+// recipients finds the recipients of dir like gitPassTx.Recipients.
+func (r gitRevision) recipients(dir string) []string {
+	for ; ; dir = cleanPassPath(path.Dir(dir)) {
+		if b, err := r.get(path.Join(dir, recipientFile)); err == nil {
+			return strings.Split(strings.TrimSpace(string(b)), "\n")
+		} else if dir == "" {
+			return nil
+		}
+	}
+}
+
+// files lists every file under dir.
+func (r gitRevision) files(dir string) ([]string, error) {
+	args := []string{"ls-tree", "-r", "-z", "--name-only", r.rev}
+	if dir != "" {
+		args = append(args, "--", dir)
+	}
+	out, err := r.g.gitO(args...)
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00"), nil
+}
+
+// checkPush checks that a push by userID follows the same rules as changes
+// made through the API: only the store's branch may be updated, by
+// fast-forwarding, and every new commit must be a valid transaction by the
+// user (see checkCommit). The returned error is meant for the user.
+func (g *GitPass) checkPush(ctx context.Context, userID string, updates []refUpdate) error {
+	uPubKeyIDs, err := StoreFromContext(ctx).GetPublicKeyIDs(userID)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		if u.Ref != "refs/heads/"+g.branch {
+			return fmt.Errorf("%s: only refs/heads/%s can be pushed", u.Ref, g.branch)
+		} else if u.New == zeroID {
+			return fmt.Errorf("%s: the branch can't be deleted", u.Ref)
+		} else if u.Old == zeroID {
+			return fmt.Errorf("%s: the branch can't be created", u.Ref)
+		} else if g.git("merge-base", "--is-ancestor", u.Old, u.New) != nil {
+			return fmt.Errorf("%s: non-fast-forward pushes are not allowed; pull first", u.Ref)
+		} else if err := g.checkCommits(ctx, uPubKeyIDs, u.Old, u.New); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCommits runs checkCommit on every commit in from..to.
+func (g *GitPass) checkCommits(ctx context.Context, uPubKeyIDs []string, from, to string) error {
+	// each line is a commit followed by its parents; merges are checked
+	// against their first parent
+	out, err := g.gitO("rev-list", "--reverse", "--parents", from+".."+to)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) < 2 {
+			return fmt.Errorf("%s: unexpected root commit", line)
+		} else if err := g.checkCommit(ctx, uPubKeyIDs, f[1], f[0]); err != nil {
+			return fmt.Errorf("commit %s: %v", f[0][:7], err)
+		}
+	}
+	return nil
+}
+
+// checkCommit checks the changes made by commit c to its parent p like the
+// API does for a transaction: paths must be valid, the user must be a
+// recipient of everything changed, new .gpg-id files must only name certified
+// keys (and be signed by a trusted key, if there are any), and every file must
+// be encrypted to exactly its recipients. With nil uPubKeyIDs, the commit is
+// not checked as any user's, only for the rest.
+func (g *GitPass) checkCommit(ctx context.Context, uPubKeyIDs []string, p, c string) error {
+	before, after := gitRevision{g, p}, gitRevision{g, c}
+	changes, err := g.diffTree(p, c)
+	if err != nil {
+		return err
+	}
+
+	recipientDirs := make(map[string]bool)
+	for f, ch := range changes {
+		deleted := ch.Mode == ""
+		dir := cleanPassPath(path.Dir(f))
+		switch path.Base(f) {
+		case recipientFile, recipientSigFile:
+			if err := validatePassPath(dir, passPathDir); err != nil {
+				return err
+			} else if deleted && dir == "" && path.Base(f) == recipientFile {
+				return VerifyError{"/", "the root directory must have recipients"}
+			} else if uPubKeyIDs != nil && !containsAny(before.recipients(dir), uPubKeyIDs) {
+				return VerifyError{"/" + dir, "you are not a recipient"}
+			}
+			recipientDirs[dir] = true
+		case placeholderFile:
+			if err := validatePassPath(dir, passPathDir); err != nil {
+				return err
+			}
+		default:
+			kind := passPathFile
+			if deleted {
+				kind = passPathAny
+			} else if validatePassPath(f, kind) != nil {
+				// files that exist already (e.g. being reencrypted) keep
+				// their names
+				if _, err := before.get(f); err == nil {
+					kind = passPathAny
+				}
+			}
+			if err := validatePassPath(f, kind); err != nil {
+				return err
+			} else if uPubKeyIDs != nil && !containsAny(before.recipients(dir), uPubKeyIDs) {
+				return VerifyError{"/" + f, "you are not a recipient"}
+			} else if deleted {
+				continue
+			} else if contents, err := after.get(f); err != nil {
+				return err
+			} else if err := verifyCiphertext(f, contents, after.recipients(dir), g.keys); err != nil {
+				return err
+			}
+		}
+	}
+
+	for dir := range recipientDirs {
+		r := path.Join(dir, recipientFile)
+		if contents, err := after.get(r); err != nil {
+			continue // removed
+		} else if err := checkRecipientsCertified(ctx, after.recipients(dir)); err != nil {
+			return err
+		} else if sig, err := after.get(r + ".sig"); err != nil {
+			if err := g.checkRecipientsSignature(r, contents, nil); err != nil {
+				return err
+			}
+		} else if err := g.checkRecipientsSignature(r, contents, sig); err != nil {
+			return err
+		}
+	}
+
+	// files whose recipients changed must have been reencrypted
+	for dir := range recipientDirs {
+		files, err := after.files(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fdir := cleanPassPath(path.Dir(f))
+			if strings.HasPrefix(path.Base(f), ".") {
+				continue
+			} else if _, ok := changes[f]; ok {
+				continue
+			} else if !matchKeyIDs(before.recipients(fdir), after.recipients(fdir), nil) {
+				return VerifyError{f, "must be reencrypted to the new recipients of /" + dir}
+			}
+		}
+	}
+	return nil
+}
+
+// InstallPreReceiveHook makes pushes to the repository run the executable
+// (this server) as "executable pre-receive", which checks them with
+// checkPush. The repositories of the native backend aren't served to git
+// clients, so they get no hook.
+func (g *GitPass) InstallPreReceiveHook(executable string) error {
+	if g.isNative() {
+		return ErrNativeUnsupported
+	}
+	hooks := filepath.Join(g.repoRoot, "hooks")
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		return err
+	}
+	// single quotes are the only thing that needs escaping for sh
+	quoted := "'" + strings.Replace(executable, "'", `'\''`, -1) + "'"
+	script := "#!/bin/sh\n# installed by the password manager; checks pushes like its API does\nexec " + quoted + " pre-receive\n"
+	return ioutil.WriteFile(filepath.Join(hooks, "pre-receive"), []byte(script), 0755)
+}
+
+// preReceive is the pre-receive hook. It runs in the repository, with the
+// environment set up by the git HTTP handler (REMOTE_USER and GPM_WORKDIR,
+// the directory the server runs in) and by git. It returns the exit status.
+func preReceive(config Config) int {
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "push rejected:", err)
+		return 1
+	}
+
+	user := os.Getenv("REMOTE_USER")
+	if user == "" {
+		return fail(fmt.Errorf("not authenticated"))
+	}
+
+	// git sets some of these to relative paths; make them absolute before
+	// moving to the server's directory to open the database
+	gitDir := os.Getenv("GIT_DIR")
+	if gitDir == "" {
+		gitDir = "."
+	}
+	for _, k := range []string{"GIT_DIR", "GIT_OBJECT_DIRECTORY", "GIT_QUARANTINE_PATH", "GIT_ALTERNATE_OBJECT_DIRECTORIES"} {
+		v := os.Getenv(k)
+		if k == "GIT_DIR" {
+			v = gitDir
+		} else if v == "" {
+			continue
+		}
+		dirs := filepath.SplitList(v)
+		for i, d := range dirs {
+			if uq, err := strconv.Unquote(d); err == nil {
+				d = uq
+			}
+			if abs, err := filepath.Abs(d); err == nil {
+				dirs[i] = abs
+			}
+		}
+		os.Setenv(k, strings.Join(dirs, string(filepath.ListSeparator)))
+	}
+	gitDir = os.Getenv("GIT_DIR")
+	if wd := os.Getenv("GPM_WORKDIR"); wd != "" {
+		if err := os.Chdir(wd); err != nil {
+			return fail(err)
+		}
+	}
+
+	db, err := initDB(config.DB.Driver, config.DB.DSN)
+	if err != nil {
+		return fail(err)
+	}
+	g, err := NewGitPass(gitDir, config.Git.Branch, false)
+	if err != nil {
+		return fail(err)
+	}
+	g.SetKeyResolver(storeKeyResolver(db))
+	if _, trusted, err := loadSigningConfig(config); err != nil {
+		return fail(err)
+	} else {
+		g.SetTrustedKeys(trusted)
+	}
+
+	ctx := context.Background()
+	ctx = ContextWithConfig(ctx, config)
+	ctx = ContextWithStore(ctx, db)
+	if updates, err := readRefUpdates(os.Stdin); err != nil {
+		return fail(err)
+	} else if err := g.checkPush(ctx, user, updates); err != nil {
+		return fail(err)
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// pushForTest makes a commit on top of the branch of g with the given files
+// (nil contents delete a file), without any of the checks of BeginW, and
+// returns the ref update that pushing it would make.
+func pushForTest(t *testing.T, g *GitPass, ref string, files map[string][]byte) refUpdate {
+	old, err := g.gitO("rev-parse", "refs/heads/"+g.branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in bytes.Buffer
+	fmt.Fprintf(&in, "commit refs/incoming\ncommitter test <test@example.com> 0 +0000\ndata 4\npush\nfrom %s\n", old)
+	for p, c := range files {
+		if c == nil {
+			fmt.Fprintf(&in, "D %s\n", p)
+		} else {
+			fmt.Fprintf(&in, "M 644 inline %s\ndata %d\n%s\n", p, len(c), c)
+		}
+	}
+	cmd := g.gitHelper("fast-import", "--quiet", "--force")
+	cmd.Stdin = strings.NewReader(in.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Could not create commit: %v\n%s", err, out)
+	}
+	n, err := g.gitO("rev-parse", "refs/incoming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refUpdate{string(old), string(n), ref}
+}
+
+func TestGitPassCheckPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	ctx := ContextWithStore(ContextWithConfig(context.Background(), Config{}), db)
+
+	g, err := NewGitPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetKeyResolver(storeKeyResolver(db))
+	if tx, err := g.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		tx.SetRecipients("/other", []string{"0123456789ABCDEF"})
+		tx.Put("/a.gpg", encryptForTest(t, "a"))
+		if err := tx.Commit(CommitInfo{UserID: "test", Message: "Set recipients"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		ref   string
+		files map[string][]byte
+		ok    bool
+	}{
+		{"valid file", "refs/heads/master", map[string][]byte{"b.gpg": encryptForTest(t, "b")}, true},
+		{"deleted file", "refs/heads/master", map[string][]byte{"a.gpg": nil}, true},
+		{"other branch", "refs/heads/other", map[string][]byte{"b.gpg": encryptForTest(t, "b")}, false},
+		{"not encrypted", "refs/heads/master", map[string][]byte{"b.gpg": []byte("plain text")}, false},
+		{"not a .gpg file", "refs/heads/master", map[string][]byte{"b.txt": encryptForTest(t, "b")}, false},
+		{"not a recipient", "refs/heads/master", map[string][]byte{"other/b.gpg": encryptForTest(t, "b")}, false},
+		{"root recipients removed", "refs/heads/master", map[string][]byte{".gpg-id": nil}, false},
+		{"not reencrypted", "refs/heads/master", map[string][]byte{".gpg-id": []byte(tolar2PublicKeyID + "\n0123456789ABCDEF")}, false},
+	} {
+		u := pushForTest(t, g, c.ref, c.files)
+		if err := g.checkPush(ctx, "tolar2", []refUpdate{u}); (err == nil) != c.ok {
+			t.Errorf("%s: checkPush returned %v, expected ok = %v", c.name, err, c.ok)
+		}
+	}
+
+	// a push that isn't a fast-forward
+	u := pushForTest(t, g, "refs/heads/master", map[string][]byte{"b.gpg": encryptForTest(t, "b")})
+	u.Old, u.New = u.New, u.Old
+	if err := g.checkPush(ctx, "tolar2", []refUpdate{u}); err == nil {
+		t.Error("checkPush accepted a non-fast-forward push")
+	}
+}
+
+func TestInstallPreReceiveHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpm-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g, err := NewGitPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hook gets the ref updates on stdin; echo them back
+	exe := filepath.Join(dir, "it's a server")
+	if err := ioutil.WriteFile(exe, []byte("#!/bin/sh\necho \"$1\"\ncat\n"), 0755); err != nil {
+		t.Fatal(err)
+	} else if err := g.InstallPreReceiveHook(exe); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(g.repoRoot, "hooks", "pre-receive"))
+	cmd.Stdin = strings.NewReader("a b c\n")
+	if out, err := cmd.Output(); err != nil {
+		t.Fatal("Could not run hook: ", err)
+	} else if string(out) != "pre-receive\na b c\n" {
+		t.Fatalf("Hook ran with unexpected arguments or input: %q", out)
+	}
+}
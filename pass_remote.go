@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var ErrUnknownRemote = errors.New("unknown remote")
+
+// Remote is a git repository that a GitPass is kept in sync with.
+type Remote struct {
+	// Name identifies the remote; fetched commits are kept in
+	// refs/remotes/<Name>/<Branch>.
+	Name string
+	// URL is anything git fetch and git push accept: a path, file://,
+	// ssh:// or https:// URL.
+	URL string
+	// Branch is the remote branch; it defaults to the local branch.
+	Branch string
+}
+
+// SyncConflict is a path that was changed differently on both sides since
+// they were last in sync. The local version is kept; the remote version can be
+// seen in the history of the path at Revision (which becomes an ancestor of the
+// local branch) and restored from there.
+type SyncConflict struct {
+	Path     string    `json:"path"`
+	Revision string    `json:"revision"`
+	Time     time.Time `json:"time"`
+}
+
+// RemoteStatus is the outcome of the latest sync with a remote, and the
+// conflicts that haven't been cleared yet.
+type RemoteStatus struct {
+	Name      string         `json:"name"`
+	LastSync  time.Time      `json:"lastSync"`
+	LastError string         `json:"lastError,omitempty"`
+	Conflicts []SyncConflict `json:"conflicts"`
+}
+
+// PassSyncer is implemented by PassStores that can be synced with remote
+// repositories.
+type PassSyncer interface {
+	// Remotes returns the status of every remote.
+	Remotes() []RemoteStatus
+	// Sync fetches from the remote, merges its changes, and pushes the
+	// result back. The changes must pass the same checks as a push, with the
+	// configuration and store in ctx.
+	Sync(ctx context.Context, name string) (RemoteStatus, error)
+	// ClearConflicts forgets the reported conflicts of a remote.
+	ClearConflicts(name string) error
+}
+
+type gitRemote struct {
+	Remote
+	status RemoteStatus
+}
+
+// AddRemote registers a remote to sync with. Syncing needs the git binary,
+// so stores using the native backend have no remotes.
+func (g *GitPass) AddRemote(r Remote) error {
+	if g.isNative() {
+		return ErrNativeUnsupported
+	}
+	if r.Branch == "" {
+		r.Branch = g.branch
+	}
+	g.remoteMu.Lock()
+	defer g.remoteMu.Unlock()
+	if g.remotes == nil {
+		g.remotes = make(map[string]*gitRemote)
+	}
+	g.remotes[r.Name] = &gitRemote{
+		Remote: r,
+		status: RemoteStatus{Name: r.Name, Conflicts: []SyncConflict{}},
+	}
+	return nil
+}
+
+func (g *GitPass) Remotes() []RemoteStatus {
+	g.remoteMu.Lock()
+	defer g.remoteMu.Unlock()
+	ret := make([]RemoteStatus, 0, len(g.remotes))
+	for _, r := range g.remotes {
+		ret = append(ret, r.status)
+	}
+	return ret
+}
+
+func (g *GitPass) ClearConflicts(name string) error {
+	g.remoteMu.Lock()
+	defer g.remoteMu.Unlock()
+	if r, ok := g.remotes[name]; !ok {
+		return ErrUnknownRemote
+	} else {
+		r.status.Conflicts = []SyncConflict{}
+		return nil
+	}
+}
+
+// SyncPeriodically syncs with the remote every interval until the process
+// exits. Errors are logged and reported in the remote's status.
+func (g *GitPass) SyncPeriodically(ctx context.Context, name string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := g.Sync(ctx, name); err != nil {
+			log.Printf("Could not sync with remote %s: %v", name, err)
+		}
+	}
+}
+
+func (g *GitPass) Sync(ctx context.Context, name string) (RemoteStatus, error) {
+	g.remoteMu.Lock()
+	r, ok := g.remotes[name]
+	g.remoteMu.Unlock()
+	if !ok {
+		return RemoteStatus{}, ErrUnknownRemote
+	}
+
+	// only one sync at a time; local commits can still happen concurrently
+	g.syncMu.Lock()
+	defer g.syncMu.Unlock()
+
+	conflicts, err := g.sync(ctx, r.Remote)
+
+	g.remoteMu.Lock()
+	defer g.remoteMu.Unlock()
+	r.status.LastSync = time.Now()
+	r.status.LastError = ""
+	if err != nil {
+		r.status.LastError = err.Error()
+	}
+	r.status.Conflicts = append(r.status.Conflicts, conflicts...)
+	return r.status, err
+}
+
+func (g *GitPass) sync(ctx context.Context, r Remote) ([]SyncConflict, error) {
+	remoteRef := fmt.Sprintf("refs/remotes/%s/%s", r.Name, r.Branch)
+	push := fmt.Sprintf("refs/heads/%s:refs/heads/%s", g.branch, r.Branch)
+	if heads, err := g.gitO("ls-remote", "--heads", r.URL, "refs/heads/"+r.Branch); err != nil {
+		return nil, err
+	} else if len(heads) == 0 {
+		// a new, empty remote; just mirror the local branch
+		return nil, g.git("push", "--quiet", r.URL, push)
+	} else if err := g.git("fetch", "--quiet", r.URL, fmt.Sprintf("+refs/heads/%s:%s", r.Branch, remoteRef)); err != nil {
+		return nil, err
+	}
+
+	var conflicts []SyncConflict
+	for attempt := 1; ; attempt++ {
+		var err error
+		if conflicts, err = g.merge(ctx, remoteRef); err != errRefMoved {
+			if err != nil {
+				return nil, err
+			}
+			break
+		} else if attempt == maxCommitAttempts {
+			return nil, ErrConflict
+		}
+	}
+
+	// a rejected push (the remote moved since the fetch) is resolved by the
+	// next sync
+	return conflicts, g.git("push", "--quiet", r.URL, push)
+}
+
+// merge brings the changes in remoteRef into the local branch: by
+// fast-forwarding if possible, or else with a merge commit that takes every
+// path changed only on the remote. Paths changed on both sides keep their
+// local version and are returned as conflicts. Like a push, the commits
+// fast-forwarded to, or the merge commit, must pass checkCommit, though not
+// as any user.
+func (g *GitPass) merge(ctx context.Context, remoteRef string) ([]SyncConflict, error) {
+	localRef := "refs/heads/" + g.branch
+	if local, err := g.gitO("rev-parse", localRef); err != nil {
+		return nil, err
+	} else if remote, err := g.gitO("rev-parse", remoteRef); err != nil {
+		return nil, err
+	} else if bytes.Equal(local, remote) || g.git("merge-base", "--is-ancestor", string(remote), string(local)) == nil {
+		return nil, nil
+	} else if g.git("merge-base", "--is-ancestor", string(local), string(remote)) == nil {
+		if err := g.checkCommits(ctx, nil, string(local), string(remote)); err != nil {
+			return nil, err
+		} else if err := g.git("update-ref", localRef, string(remote), string(local)); err != nil {
+			return nil, errRefMoved
+		}
+		return nil, nil
+	} else if base, err := g.gitO("merge-base", string(local), string(remote)); err != nil {
+		return nil, err
+	} else if ours, err := g.diffTree(string(base), string(local)); err != nil {
+		return nil, err
+	} else if theirs, err := g.diffTree(string(base), string(remote)); err != nil {
+		return nil, err
+	} else {
+		var conflicts []SyncConflict
+		var changes []treeChange
+		for _, c := range theirs {
+			if o, ok := ours[c.Path]; !ok {
+				changes = append(changes, c)
+			} else if o.Mode != c.Mode || o.ID != c.ID {
+				conflicts = append(conflicts, SyncConflict{c.Path, string(remote), time.Now()})
+			}
+		}
+		message := fmt.Sprintf("Merged %s", strings.TrimPrefix(remoteRef, "refs/remotes/"))
+		return conflicts, g.mergeCommit(ctx, string(local), string(remote), message, changes)
+	}
+}
+
+// treeChange is a path as changed by a commit; a deleted path has an empty
+// Mode.
+type treeChange struct {
+	Path string
+	Mode string
+	ID   string
+}
+
+// diffTree lists the files (including metadata files) that differ between
+// two commits, by path.
+func (g *GitPass) diffTree(from, to string) (map[string]treeChange, error) {
+	out, err := g.gitO("diff-tree", "-r", "-z", "--no-renames", from, to)
+	if err != nil {
+		return nil, err
+	}
+	// each entry is ":<old mode> <new mode> <old id> <new id> <status>\0<path>\0"
+	ret := make(map[string]treeChange)
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) != 5 {
+			return nil, fmt.Errorf("unexpected diff-tree output %q", fields[i])
+		}
+		c := treeChange{Path: fields[i+1], Mode: meta[1], ID: meta[3]}
+		if meta[4] == "D" {
+			c.Mode, c.ID = "", ""
+		}
+		ret[c.Path] = c
+	}
+	return ret, nil
+}
+
+var pendingMerges uint64
+
+// mergeCommit commits the changes on top of local, as a merge with remote.
+// The commit is made on a temporary ref, and only put on the branch if it
+// passes checkCommit.
+func (g *GitPass) mergeCommit(ctx context.Context, local, remote, message string, changes []treeChange) error {
+	c := importedCommit{
+		info:  CommitInfo{Message: message, Operation: OpMerge},
+		merge: remote,
+	}
+	for _, ch := range changes {
+		if ch.Mode == "" {
+			c.deletes = append(c.deletes, ch.Path)
+		} else {
+			c.files = append(c.files, importedFile{path: ch.Path, mode: ch.Mode, id: ch.ID})
+		}
+	}
+	ref := fmt.Sprintf("refs/pass/merge/%d-%d", os.Getpid(), atomic.AddUint64(&pendingMerges, 1))
+	defer g.git("update-ref", "-d", ref)
+	if err := g.git("update-ref", ref, local); err != nil {
+		return err
+	} else if err := g.backend.importCommits(g, ref, local, []importedCommit{c}); err != nil {
+		return err
+	} else if merged, err := g.gitO("rev-parse", ref); err != nil {
+		return err
+	} else if err := g.checkCommit(ctx, nil, local, string(merged)); err != nil {
+		return fmt.Errorf("merge of %s: %v", remote[:7], err)
+	} else if err := g.git("update-ref", "refs/heads/"+g.branch, string(merged), local); err != nil {
+		return errRefMoved
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/net/context"
+)
+
+func encryptForTest(t testing.TB, plain string) []byte {
+	el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(tolar2PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, el, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(plain))
+	w.Close()
+	return buf.Bytes()
+}
+
+func putForTest(t *testing.T, g *GitPass, p string, contents []byte) {
+	if tx, err := g.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.Put(p, contents)
+		if err := tx.Commit(CommitInfo{UserID: "test", Message: "Put " + p}); err != nil {
+			t.Fatalf("Could not put %s: %v", p, err)
+		}
+	}
+}
+
+func getForTest(t *testing.T, g *GitPass, p string) []byte {
+	if tx, err := g.Begin(); err != nil {
+		t.Fatal(err)
+	} else if b, err := tx.Get(p); err != nil {
+		t.Fatalf("Could not get %s: %v", p, err)
+	} else {
+		return b
+	}
+	return nil
+}
+
+// commitRawForTest commits contents at p to the master branch of the bare
+// repository at repo with git itself, bypassing the checks of GitPass. It
+// returns the previous commit of the branch.
+func commitRawForTest(t *testing.T, repo, p string, contents []byte) string {
+	index := filepath.Join(repo, "test-index")
+	defer os.Remove(index)
+	git := func(stdin []byte, args ...string) string {
+		cmd := exec.Command("git", append([]string{"--git-dir", repo, "-c", "user.name=test", "-c", "user.email=test@localhost"}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+index)
+		cmd.Stdin = bytes.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	head := git(nil, "rev-parse", "refs/heads/master")
+	git(nil, "read-tree", head)
+	id := git(contents, "hash-object", "-w", "--stdin")
+	git(nil, "update-index", "--add", "--cacheinfo", "100644,"+id+","+p)
+	tree := git(nil, "write-tree")
+	commit := git(nil, "commit-tree", tree, "-p", head, "-m", "Put "+p)
+	git(nil, "update-ref", "refs/heads/master", commit, head)
+	return head
+}
+
+func TestGitPassSync(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-sync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := initDB("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDefaults(db)
+		ctx := context.Background()
+		ctx = ContextWithConfig(ctx, Config{})
+		ctx = ContextWithStore(ctx, db)
+
+		// the remote stands in for a canonical store somewhere else
+		remotePath := filepath.Join(dir, "remote.git")
+		remote, err := newPass(remotePath, "master", false)
+		if err != nil {
+			t.Fatal("Could not create remote: ", err)
+		}
+		remote.SetKeyResolver(storeKeyResolver(db))
+		if tx, err := remote.BeginW(); err != nil {
+			t.Fatal(err)
+		} else {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			if err := tx.Commit(CommitInfo{UserID: "test", Message: "Set recipients"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		localPath := filepath.Join(dir, "local.git")
+		if out, err := exec.Command("git", "clone", "--quiet", "--bare", remotePath, localPath).CombinedOutput(); err != nil {
+			t.Fatalf("Could not clone remote: %v\n%s", err, out)
+		}
+		// syncing needs the git binary, so only the remote can be native
+		local, err := NewGitPass(localPath, "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.SetKeyResolver(storeKeyResolver(db))
+		if err := local.AddRemote(Remote{Name: "origin", URL: remotePath}); err != nil {
+			t.Fatal(err)
+		}
+
+		// unrelated changes on both sides are merged
+		a, b := encryptForTest(t, "a"), encryptForTest(t, "b")
+		putForTest(t, remote, "a.gpg", a)
+		putForTest(t, local, "b.gpg", b)
+		if status, err := local.Sync(ctx, "origin"); err != nil {
+			t.Fatal("Could not sync: ", err)
+		} else if len(status.Conflicts) != 0 {
+			t.Fatalf("Got unexpected conflicts: %v", status.Conflicts)
+		}
+		for _, g := range []*GitPass{local, remote} {
+			if !bytes.Equal(getForTest(t, g, "a.gpg"), a) || !bytes.Equal(getForTest(t, g, "b.gpg"), b) {
+				t.Fatal("Changes were not merged")
+			}
+		}
+
+		// changes on one side only are fast-forwarded
+		a2 := encryptForTest(t, "a2")
+		putForTest(t, remote, "a.gpg", a2)
+		if _, err := local.Sync(ctx, "origin"); err != nil {
+			t.Fatal("Could not sync: ", err)
+		} else if !bytes.Equal(getForTest(t, local, "a.gpg"), a2) {
+			t.Fatal("Remote change was not fetched")
+		}
+
+		// the same file changed on both sides is a conflict; the local version wins
+		cLocal, cRemote := encryptForTest(t, "local"), encryptForTest(t, "remote")
+		putForTest(t, remote, "c.gpg", cRemote)
+		putForTest(t, local, "c.gpg", cLocal)
+		status, err := local.Sync(ctx, "origin")
+		if err != nil {
+			t.Fatal("Could not sync: ", err)
+		} else if len(status.Conflicts) != 1 || status.Conflicts[0].Path != "c.gpg" {
+			t.Fatalf("Got unexpected conflicts: %v != [c.gpg]", status.Conflicts)
+		}
+		for _, g := range []*GitPass{local, remote} {
+			if !bytes.Equal(getForTest(t, g, "c.gpg"), cLocal) {
+				t.Fatal("Local version of a conflicting file was not kept")
+			}
+		}
+		if tx, err := local.Begin(); err != nil {
+			t.Fatal(err)
+		} else if old, err := tx.At(status.Conflicts[0].Revision); err != nil {
+			t.Fatal("Could not open the remote revision of a conflict: ", err)
+		} else if c, err := old.Get("c.gpg"); err != nil || !bytes.Equal(c, cRemote) {
+			t.Fatal("Remote version of a conflicting file is not in the history")
+		}
+
+		if err := local.ClearConflicts("origin"); err != nil {
+			t.Fatal(err)
+		} else if remotes := local.Remotes(); len(remotes) != 1 || len(remotes[0].Conflicts) != 0 {
+			t.Fatalf("Conflicts were not cleared: %v", remotes)
+		} else if _, err := local.Sync(ctx, "nonexistent"); err != ErrUnknownRemote {
+			t.Fatalf("Got unexpected error when syncing with an unknown remote: %v != %v", err, ErrUnknownRemote)
+		}
+
+		// remote commits must pass the same checks as pushes, whether they
+		// are fast-forwarded to or merged
+		exists := func(p string) bool {
+			tx, err := local.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			exists, _ := tx.Type(p)
+			return exists
+		}
+		good := commitRawForTest(t, remotePath, "bad.gpg", []byte("not encrypted"))
+		if _, err := local.Sync(ctx, "origin"); err == nil {
+			t.Error("Fast-forwarded to an unencrypted file")
+		} else if exists("bad.gpg") {
+			t.Error("A rejected fast-forward was made")
+		}
+		putForTest(t, local, "d.gpg", encryptForTest(t, "d"))
+		if _, err := local.Sync(ctx, "origin"); err == nil {
+			t.Error("Merged an unencrypted file")
+		} else if exists("bad.gpg") {
+			t.Error("A rejected merge was committed")
+		}
+		if out, err := exec.Command("git", "--git-dir", remotePath, "update-ref", "refs/heads/master", good).CombinedOutput(); err != nil {
+			t.Fatalf("Could not reset remote: %v\n%s", err, out)
+		} else if _, err := local.Sync(ctx, "origin"); err != nil {
+			t.Fatal("Could not sync: ", err)
+		}
+
+		// new files must be encrypted to recipients changed on the other side
+		_, key := addUserForTest(t, db, "other")
+		putForTest(t, local, "dir/x.gpg", encryptForTest(t, "x"))
+		if _, err := local.Sync(ctx, "origin"); err != nil {
+			t.Fatal("Could not sync: ", err)
+		} else if tx, err := remote.BeginW(); err != nil {
+			t.Fatal(err)
+		} else {
+			tx.SetRecipients("dir", []string{tolar2PublicKeyID, key.PrimaryKey.KeyIdString()})
+			tx.Put("dir/x.gpg", encryptForTestTo(t, "x", tolar2Keys(t)[0], key))
+			if err := tx.Commit(CommitInfo{UserID: "test", Message: "Share dir"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		putForTest(t, local, "dir/y.gpg", encryptForTest(t, "y"))
+		if _, err := local.Sync(ctx, "origin"); err == nil {
+			t.Error("Merged new recipients without reencrypting a new file")
+		} else if exists("dir/.gpg-id") {
+			t.Error("A rejected merge was committed")
+		}
+	})
+}
+
+// TestGitPassSyncSigned checks that merges of a signing store keep the
+// remote's commits as they are, so they can be pushed back.
+func TestGitPassSyncSigned(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-sync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := initDB("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDefaults(db)
+		ctx := context.Background()
+		ctx = ContextWithConfig(ctx, Config{})
+		ctx = ContextWithStore(ctx, db)
+		key, err := openpgp.NewEntity("pass", "", "pass@example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remotePath := filepath.Join(dir, "remote.git")
+		remote, err := newPass(remotePath, "master", false)
+		if err != nil {
+			t.Fatal("Could not create remote: ", err)
+		}
+		remote.SetKeyResolver(storeKeyResolver(db))
+		if tx, err := remote.BeginW(); err != nil {
+			t.Fatal(err)
+		} else {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			if err := tx.Commit(CommitInfo{UserID: "test", Message: "Set recipients"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		localPath := filepath.Join(dir, "local.git")
+		if out, err := exec.Command("git", "clone", "--quiet", "--bare", remotePath, localPath).CombinedOutput(); err != nil {
+			t.Fatalf("Could not clone remote: %v\n%s", err, out)
+		}
+		// syncing needs the git binary, so only the remote can be native
+		local, err := NewGitPass(localPath, "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.SetKeyResolver(storeKeyResolver(db))
+		local.SetSigningKey(key)
+		if err := local.AddRemote(Remote{Name: "origin", URL: remotePath}); err != nil {
+			t.Fatal(err)
+		}
+
+		putForTest(t, remote, "a.gpg", encryptForTest(t, "a"))
+		putForTest(t, local, "b.gpg", encryptForTest(t, "b"))
+		theirs, err := remote.gitO("rev-parse", "refs/heads/master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := local.Sync(ctx, "origin"); err != nil {
+			t.Fatal("Could not sync: ", err)
+		} else if parents, err := local.gitO("rev-parse", "refs/heads/master^1", "refs/heads/master^2"); err != nil {
+			t.Fatal(err)
+		} else if p := strings.Fields(string(parents)); len(p) != 2 || p[1] != strings.TrimSpace(string(theirs)) {
+			t.Errorf("The merge has parents %v, not the remote's commit %s", p, theirs)
+		} else if raw, err := local.gitB("cat-file", "commit", "refs/heads/master"); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Contains(raw, []byte("\ngpgsig ")) {
+			t.Error("The merge is not signed")
+		}
+		for _, g := range []*GitPass{local, remote} {
+			if getForTest(t, g, "a.gpg") == nil || getForTest(t, g, "b.gpg") == nil {
+				t.Error("Changes were not merged")
+			}
+		}
+	})
+}
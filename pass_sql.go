@@ -0,0 +1,483 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/net/context"
+)
+
+const passInitQuery = `
+CREATE TABLE IF NOT EXISTS pass_revisions (
+	rev INTEGER PRIMARY KEY NOT NULL,
+	time INTEGER NOT NULL, -- nanoseconds since the epoch
+	uid TEXT NOT NULL,
+	name TEXT NOT NULL,
+	message TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	operation TEXT NOT NULL
+);
+
+
+CREATE TABLE IF NOT EXISTS pass_files (
+	path TEXT NOT NULL, -- clean path, without the leading slash
+	created INTEGER NOT NULL REFERENCES pass_revisions(rev),
+	deleted INTEGER REFERENCES pass_revisions(rev), -- NULL while it exists
+	contents BLOB NOT NULL,
+	PRIMARY KEY (path, created)
+);
+
+
+CREATE TABLE IF NOT EXISTS pass_recipients (
+	dir TEXT NOT NULL, -- clean path, without the leading slash
+	created INTEGER NOT NULL REFERENCES pass_revisions(rev),
+	deleted INTEGER REFERENCES pass_revisions(rev), -- NULL while it exists
+	key_ids TEXT NOT NULL, -- one per line, like .gpg-id
+	PRIMARY KEY (dir, created)
+);
+
+
+INSERT INTO pass_revisions (rev, time, uid, name, message, request_id, operation)
+SELECT 0, 0, '', '', 'Initial Commit', '', ''
+WHERE NOT EXISTS (SELECT 1 FROM pass_revisions);
+`
+
+// SQLPass is a PassStore kept in the same database as DBStore, for
+// deployments that can't keep a git repository. Files (pass_files) and the
+// recipients of directories (pass_recipients) are never updated: each row
+// is valid from the revision that created it until the one that deleted it,
+// so every revision in pass_revisions can still be read.
+//
+// A transaction reads the revision that was the latest when it began, which
+// gives it a consistent snapshot without holding a database transaction open
+// (PassTx has no way to end one). Commit runs in a serializable database
+// transaction, reading only the paths it touches, and like GitPass fails with
+// ErrConflict only if they changed since the transaction began (or another
+// process committed at the same time).
+type SQLPass struct {
+	db   *sqlx.DB
+	keys KeyResolver
+	// mu serializes the commits of this process; the database transaction
+	// serializes them with those of other processes.
+	mu sync.Mutex
+}
+
+func NewSQLPass(db DBStore) (*SQLPass, error) {
+	if _, err := db.DB.Exec(passInitQuery); err != nil {
+		return nil, err
+	}
+	return &SQLPass{db: db.DB}, nil
+}
+
+// SetKeyResolver sets the function used to find the subkeys of recipients
+// when verifying that files are encrypted to the right keys.
+func (s *SQLPass) SetKeyResolver(r KeyResolver) {
+	s.keys = r
+}
+
+type sqlPassTx struct {
+	s   *SQLPass
+	rev int64
+}
+
+type sqlPassTxW struct {
+	*memChanges
+	base *sqlPassTx
+}
+
+type sqlPassRevision struct {
+	Rev       int64  `db:"rev"`
+	Time      int64  `db:"time"`
+	UserID    string `db:"uid"`
+	UserName  string `db:"name"`
+	Message   string `db:"message"`
+	RequestID string `db:"request_id"`
+	Operation string `db:"operation"`
+}
+
+type sqlPassRow struct {
+	Path     string `db:"path"`
+	Created  int64  `db:"created"`
+	Contents []byte `db:"contents"`
+}
+
+func latestRevision(q sqlx.Queryer) (int64, error) {
+	var rev int64
+	err := sqlx.Get(q, &rev, `SELECT MAX(rev) FROM pass_revisions;`)
+	return rev, err
+}
+
+func (s *SQLPass) Begin() (PassTx, error) {
+	if rev, err := latestRevision(s.db); err != nil {
+		return nil, err
+	} else {
+		return &sqlPassTx{s, rev}, nil
+	}
+}
+
+func (s *SQLPass) BeginW() (PassTxW, error) {
+	if tx, err := s.Begin(); err != nil {
+		return nil, err
+	} else {
+		return &sqlPassTxW{newMemChanges(tx), tx.(*sqlPassTx)}, nil
+	}
+}
+
+// sqlSubtree returns the condition that column is p or below it. Paths below
+// p sort between p+"/" and p+"0", the next character.
+func sqlSubtree(column, p string) (string, []interface{}) {
+	if p == "" {
+		return "1 = 1", nil
+	}
+	return "(" + column + " = ? OR " + column + " >= ? AND " + column + " < ?)",
+		[]interface{}{p, p + "/", p + "0"}
+}
+
+// sqlVisible is the condition that a row is part of a revision, which is the
+// argument twice.
+const sqlVisible = `created <= ? AND (deleted IS NULL OR deleted > ?)`
+
+// load returns the files (including .gpg-id files) at p and below it in
+// revision rev. Unless contents is true, the contents of each file are only
+// the revision that created it, which is enough to compare versions.
+func (s *SQLPass) load(q sqlx.Queryer, rev int64, p string, contents bool) (memFiles, error) {
+	// the .gpg-id of a directory is below it, but so is the one of p if it's
+	// a .gpg-id itself
+	files, fileArgs := sqlSubtree("path", p)
+	dirs, dirArgs := sqlSubtree("dir", p)
+	if path.Base(p) == recipientFile {
+		dirs = "dir = ?"
+		dirArgs = []interface{}{cleanPassPath(path.Dir(p))}
+	}
+	ret := make(memFiles)
+	return ret, s.loadWhere(ret, q, rev, contents, files, fileArgs, dirs, dirArgs)
+}
+
+// loadWhere adds the files of revision rev whose paths match files, and the
+// .gpg-id files of the directories that match dirs, to f.
+func (s *SQLPass) loadWhere(f memFiles, q sqlx.Queryer, rev int64, contents bool, files string, fileArgs []interface{}, dirs string, dirArgs []interface{}) error {
+	column := "contents"
+	if !contents {
+		column = "CAST(created AS TEXT) AS contents"
+	}
+	var rows []sqlPassRow
+	if err := sqlx.Select(q, &rows, `SELECT path, created, `+column+` FROM pass_files
+	                                 WHERE `+sqlVisible+` AND (`+files+`);`,
+		append([]interface{}{rev, rev}, fileArgs...)...,
+	); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		f[r.Path] = r.Contents
+	}
+
+	column = "key_ids AS contents"
+	if !contents {
+		column = "CAST(created AS TEXT) AS contents"
+	}
+	rows = nil
+	if err := sqlx.Select(q, &rows, `SELECT dir AS path, created, `+column+` FROM pass_recipients
+	                                 WHERE `+sqlVisible+` AND (`+dirs+`);`,
+		append([]interface{}{rev, rev}, dirArgs...)...,
+	); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		f[path.Join(r.Path, recipientFile)] = r.Contents
+	}
+	return nil
+}
+
+// sqlLoadBatch is the number of paths loadTouched looks for in one query,
+// which keeps it below the limits on the number of query parameters.
+const sqlLoadBatch = 100
+
+// loadTouched returns the files of revision rev that the changes depend on,
+// which is enough for Commit to verify them, check them for conflicts and
+// write them: the subtrees of the changed paths (of their directories, for
+// .gpg-id files, since the version of a directory covers everything in it),
+// and the parents of the changed paths with their .gpg-id files.
+func (s *SQLPass) loadTouched(q sqlx.Queryer, rev int64, changes *memChanges) (memFiles, error) {
+	subtrees := make(map[string]bool)
+	for p := range changes.changed {
+		if path.Base(p) == recipientFile {
+			subtrees[cleanPassPath(path.Dir(p))] = true
+		} else {
+			subtrees[p] = true
+		}
+	}
+	// loaded with the subtree of one of its parents
+	loaded := func(p string) bool {
+		for dir := p; dir != ""; {
+			dir = cleanPassPath(path.Dir(dir))
+			if subtrees[dir] {
+				return true
+			}
+		}
+		return false
+	}
+	var roots, parents []string
+	seen := make(map[string]bool)
+	for p := range subtrees {
+		if loaded(p) {
+			continue
+		}
+		roots = append(roots, p)
+		for dir := p; dir != ""; {
+			dir = cleanPassPath(path.Dir(dir))
+			if !seen[dir] && !subtrees[dir] && !loaded(dir) {
+				seen[dir] = true
+				parents = append(parents, dir)
+			}
+		}
+	}
+
+	ret := make(memFiles)
+	for len(roots) > 0 || len(parents) > 0 {
+		var files, dirs []string
+		var fileArgs, dirArgs []interface{}
+		for i := 0; i < sqlLoadBatch && len(roots) > 0; i++ {
+			cond, args := sqlSubtree("path", roots[0])
+			files, fileArgs = append(files, cond), append(fileArgs, args...)
+			cond, args = sqlSubtree("dir", roots[0])
+			dirs, dirArgs = append(dirs, cond), append(dirArgs, args...)
+			roots = roots[1:]
+		}
+		for i := 0; i < sqlLoadBatch && len(parents) > 0; i++ {
+			files, fileArgs = append(files, "path = ?"), append(fileArgs, parents[0])
+			dirs, dirArgs = append(dirs, "dir = ?"), append(dirArgs, parents[0])
+			parents = parents[1:]
+		}
+		if err := s.loadWhere(ret, q, rev, true, strings.Join(files, " OR "), fileArgs, strings.Join(dirs, " OR "), dirArgs); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Type returns false for paths that can't be read from the database.
+func (tx *sqlPassTx) Type(p string) (exists bool, file bool) {
+	p = cleanPassPath(p)
+	if f, err := tx.s.load(tx.s.db, tx.rev, p, false); err != nil {
+		return false, false
+	} else {
+		return f.typ(p)
+	}
+}
+
+func (tx *sqlPassTx) Version(p string) (string, error) {
+	p = cleanPassPath(p)
+	if f, err := tx.s.load(tx.s.db, tx.rev, p, false); err != nil {
+		return "", err
+	} else if v := f.version(p); v != "" {
+		return v, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func (tx *sqlPassTx) List(p string) ([]PassDirent, error) {
+	p = cleanPassPath(p)
+	if f, err := tx.s.load(tx.s.db, tx.rev, p, false); err != nil {
+		return nil, err
+	} else {
+		return f.list(p)
+	}
+}
+
+func (tx *sqlPassTx) Get(p string) ([]byte, error) {
+	p = cleanPassPath(p)
+	if f, err := tx.s.load(tx.s.db, tx.rev, p, true); err != nil {
+		return nil, err
+	} else if c, ok := f[p]; ok {
+		return c, nil
+	} else if exists, _ := f.typ(p); exists {
+		return nil, os.ErrInvalid
+	}
+	return nil, os.ErrNotExist
+}
+
+func (tx *sqlPassTx) Recipients(p string) ([]string, error) {
+	var dirs []interface{}
+	for dir := cleanPassPath(p); ; dir = cleanPassPath(path.Dir(dir)) {
+		dirs = append(dirs, dir)
+		if dir == "" {
+			break
+		}
+	}
+	var rows []sqlPassRow
+	if err := sqlx.Select(tx.s.db, &rows, `SELECT dir AS path, created, key_ids AS contents FROM pass_recipients
+	                                       WHERE `+sqlVisible+` AND dir IN (?`+strings.Repeat(", ?", len(dirs)-1)+`);`,
+		append([]interface{}{tx.rev, tx.rev}, dirs...)...,
+	); err != nil {
+		return nil, err
+	}
+	f := make(memFiles, len(rows))
+	for _, r := range rows {
+		f[path.Join(r.Path, recipientFile)] = r.Contents
+	}
+	return f.recipients(cleanPassPath(p)), nil
+}
+
+func (tx *sqlPassTx) GetAffectedFiles(p string) ([]string, error) {
+	p = cleanPassPath(p)
+	if f, err := tx.s.load(tx.s.db, tx.rev, p, false); err != nil {
+		return nil, err
+	} else {
+		return f.affected(p), nil
+	}
+}
+
+func (tx *sqlPassTx) History(p string) ([]PassRevision, error) {
+	p = cleanPassPath(p)
+	// rows are only written when something changes, so every revision that
+	// created or deleted one at or below p changed it; the root also exists
+	// from the initial revision
+	files, args := sqlSubtree("path", p)
+	recipients, rargs := sqlSubtree("dir", p)
+	if path.Base(p) == recipientFile {
+		recipients = "dir = ?"
+		rargs = []interface{}{cleanPassPath(path.Dir(p))}
+	}
+	var revs []sqlPassRevision
+	if err := sqlx.Select(tx.s.db, &revs, `SELECT rev, time, uid, name, message, request_id, operation FROM pass_revisions
+	                                       WHERE rev <= ? AND (rev IN (
+	                                         SELECT created FROM pass_files WHERE `+files+`
+	                                         UNION SELECT deleted FROM pass_files WHERE `+files+`
+	                                         UNION SELECT created FROM pass_recipients WHERE `+recipients+`
+	                                         UNION SELECT deleted FROM pass_recipients WHERE `+recipients+`
+	                                       ) OR rev = 0 AND ? = '')
+	                                       ORDER BY rev DESC;`,
+		append(append(append(append(append([]interface{}{tx.rev}, args...), args...), rargs...), rargs...), p)...,
+	); err != nil {
+		return nil, err
+	}
+
+	ret := make([]PassRevision, 0, len(revs))
+	for _, r := range revs {
+		f, err := tx.s.load(tx.s.db, r.Rev, p, false)
+		if err != nil {
+			return nil, err
+		}
+		author := r.UserName
+		if author == "" {
+			author = r.UserID
+		}
+		if author == "" {
+			author = "pass"
+		}
+		ret = append(ret, PassRevision{
+			Revision:  strconv.FormatInt(r.Rev, 10),
+			Author:    author,
+			Time:      time.Unix(0, r.Time),
+			Message:   r.Message,
+			Version:   f.version(p),
+			UserID:    r.UserID,
+			RequestID: r.RequestID,
+			Operation: r.Operation,
+		})
+	}
+	return ret, nil
+}
+
+func (tx *sqlPassTx) At(revision string) (PassTx, error) {
+	if i, err := strconv.ParseInt(revision, 10, 64); err != nil || i < 0 || i > tx.rev {
+		return nil, ErrUnknownRevision
+	} else {
+		return &sqlPassTx{tx.s, i}, nil
+	}
+}
+
+func (tx *sqlPassTxW) Commit(info CommitInfo) error {
+	s := tx.base.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dbtx, err := s.db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer dbtx.Rollback()
+
+	latest, err := latestRevision(dbtx)
+	if err != nil {
+		return err
+	}
+	base, err := s.loadTouched(dbtx, tx.base.rev, tx.memChanges)
+	if err != nil {
+		return err
+	} else if err := tx.verify(base, tx.apply(base), s.keys); err != nil {
+		return err
+	}
+	tip := base
+	if latest != tx.base.rev {
+		if tip, err = s.loadTouched(dbtx, latest, tx.memChanges); err != nil {
+			return err
+		} else if tx.conflicts(base, tip) {
+			return ErrConflict
+		}
+	}
+
+	if info.Message == "" {
+		info.Message = "Update passwords"
+	}
+	rev := latest + 1
+	if _, err := dbtx.Exec(`INSERT INTO pass_revisions (rev, time, uid, name, message, request_id, operation)
+	                        VALUES (?, ?, ?, ?, ?, ?, ?);`,
+		rev, time.Now().UnixNano(), info.UserID, info.UserName, strings.TrimSpace(info.Message), info.RequestID, info.Operation,
+	); err != nil {
+		dbtx.Rollback()
+		if s.revisionTaken(err, rev) {
+			return ErrConflict
+		}
+		return err
+	}
+
+	// write only the files that changed, so that History finds the revisions
+	// of a path by its rows
+	after := tx.apply(tip)
+	for p, c := range tip {
+		if a, ok := after[p]; ok && string(a) == string(c) {
+			continue
+		}
+		query := `UPDATE pass_files SET deleted = ? WHERE path = ? AND deleted IS NULL;`
+		if path.Base(p) == recipientFile {
+			query = `UPDATE pass_recipients SET deleted = ? WHERE dir = ? AND deleted IS NULL;`
+			p = cleanPassPath(path.Dir(p))
+		}
+		if _, err := dbtx.Exec(query, rev, p); err != nil {
+			return err
+		}
+	}
+	for p, c := range after {
+		if t, ok := tip[p]; ok && string(t) == string(c) {
+			continue
+		}
+		query := `INSERT INTO pass_files (path, created, contents) VALUES (?, ?, ?);`
+		var contents interface{} = c
+		if path.Base(p) == recipientFile {
+			query = `INSERT INTO pass_recipients (dir, created, key_ids) VALUES (?, ?, ?);`
+			p, contents = cleanPassPath(path.Dir(p)), string(c)
+		}
+		if _, err := dbtx.Exec(query, p, rev, contents); err != nil {
+			return err
+		}
+	}
+	return dbtx.Commit()
+}
+
+// revisionTaken checks if err, from inserting revision rev, is because
+// another process committed it since Commit read the latest revision.
+func (s *SQLPass) revisionTaken(err error, rev int64) bool {
+	if e, ok := err.(sqlite3.Error); ok {
+		return e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || e.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	// other drivers have their own errors for it
+	latest, err := latestRevision(s.db)
+	return err == nil && latest >= rev
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newSQLPassForTest returns an SQLPass in a new database file; unlike
+// :memory:, it's shared by every connection.
+func newSQLPassForTest(t *testing.T, keys KeyResolver) *SQLPass {
+	dir, err := ioutil.TempDir("", "gpm-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := initDB("sqlite3", filepath.Join(dir, "db.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	s, err := NewSQLPass(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetKeyResolver(keys)
+	return s
+}
+
+func TestMigratePass(t *testing.T) {
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	keys := storeKeyResolver(db)
+	pw := encryptForTest(t, "password")
+
+	dir, err := ioutil.TempDir("", "gpm-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g, err := NewGitPass(filepath.Join(dir, "from.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetKeyResolver(keys)
+
+	for _, step := range []struct {
+		info CommitInfo
+		fn   func(tx PassTxW)
+	}{
+		{CommitInfo{Message: "Set initial recipients"}, func(tx PassTxW) {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		}},
+		{CommitInfo{UserID: "tolar2", UserName: "Tolar", Message: "add", Operation: OpPut}, func(tx PassTxW) {
+			tx.Put("/a.gpg", pw)
+			tx.Put("/dir/b.gpg", pw)
+			tx.Mkdir("/empty")
+		}},
+		{CommitInfo{UserID: "tolar2", Message: "own recipients", RequestID: "req"}, func(tx PassTxW) {
+			tx.SetRecipients("/dir", []string{tolar2PublicKeyID})
+			tx.Put("/dir/b.gpg", encryptForTest(t, "other"))
+		}},
+		{CommitInfo{UserID: "tolar2", Message: "move", Operation: OpMove}, func(tx PassTxW) {
+			tx.Move("/dir", "/moved")
+			tx.Delete("/a.gpg")
+		}},
+	} {
+		tx, _ := g.BeginW()
+		step.fn(tx)
+		if err := tx.Commit(step.info); err != nil {
+			t.Fatalf("%s: %v", step.info.Message, err)
+		}
+	}
+
+	// there and back again
+	s := newSQLPassForTest(t, keys)
+	back, err := NewGitPass(filepath.Join(dir, "to.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back.SetKeyResolver(keys)
+	if err := migratePass(s, g); err != nil {
+		t.Fatal(err)
+	} else if err := migratePass(back, s); err != nil {
+		t.Fatal(err)
+	} else if err := migratePass(s, g); err == nil {
+		t.Error("Migrated to a store that isn't empty")
+	}
+
+	history := func(ps PassStore) ([]PassRevision, []storeSnapshot) {
+		tx, _ := ps.Begin()
+		revs, err := tx.History("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snaps []storeSnapshot
+		for i := range revs {
+			at, _ := tx.At(revs[i].Revision)
+			snap, err := readStoreSnapshot(at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			snaps = append(snaps, snap)
+			revs[i].Revision, revs[i].Time, revs[i].Version, revs[i].AuthorEmail = "", revs[i].Time.Truncate(0), "", ""
+		}
+		return revs, snaps
+	}
+	wantRevs, wantSnaps := history(g)
+	for name, ps := range map[string]PassStore{"sql": s, "git": back} {
+		revs, snaps := history(ps)
+		if len(revs) != len(wantRevs) {
+			t.Errorf("%s: got %d revisions; want %d", name, len(revs), len(wantRevs))
+			continue
+		}
+		for i := range revs {
+			revs[i].Time = wantRevs[i].Time
+			if !reflect.DeepEqual(revs[i], wantRevs[i]) {
+				t.Errorf("%s: got revision %+v; want %+v", name, revs[i], wantRevs[i])
+			} else if !reflect.DeepEqual(snaps[i], wantSnaps[i]) {
+				t.Errorf("%s: revision %q has %+v; want %+v", name, revs[i].Message, snaps[i], wantSnaps[i])
+			}
+		}
+	}
+}
+
+func TestSQLPassCommit(t *testing.T) {
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	s := newSQLPassForTest(t, storeKeyResolver(db))
+	commit := func(fn func(tx PassTxW)) error {
+		tx, err := s.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(tx)
+		return tx.Commit(CommitInfo{Message: "Test"})
+	}
+	if err := commit(func(tx PassTxW) {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		tx.SetRecipients("/own", []string{tolar2PublicKeyID})
+		tx.Put("/a.gpg", encryptForTest(t, "a"))
+		tx.Put("/dir/b.gpg", encryptForTest(t, "b"))
+		tx.Put("/own/c.gpg", encryptForTest(t, "c"))
+		tx.Put("/own/sub/d.gpg", encryptForTest(t, "d"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the paths that the changes depend on are loaded
+	for _, c := range []struct {
+		fn   func(tx PassTxW)
+		want []string
+	}{
+		{func(tx PassTxW) { tx.Put("/dir/new.gpg", nil) }, []string{recipientFile}},
+		{func(tx PassTxW) { tx.Delete("/own/sub") }, []string{recipientFile, "own/" + recipientFile, "own/sub/d.gpg"}},
+		{func(tx PassTxW) { tx.SetRecipients("/own", nil) }, []string{recipientFile, "own/" + recipientFile, "own/c.gpg", "own/sub/d.gpg"}},
+	} {
+		tx, _ := s.BeginW()
+		c.fn(tx)
+		if f, err := s.loadTouched(s.db, 1, tx.(*sqlPassTxW).memChanges); err != nil {
+			t.Fatal(err)
+		} else if got := f.under(""); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Loaded %v; want %v", got, c.want)
+		}
+	}
+
+	// a trigger stands in for another process committing the same revision
+	// between reading the latest one and inserting the next
+	if _, err := s.db.Exec(`CREATE TRIGGER race BEFORE INSERT ON pass_revisions WHEN NEW.rev = 2 BEGIN
+		INSERT INTO pass_revisions (rev, time, uid, name, message, request_id, operation)
+		VALUES (NEW.rev, 0, '', '', 'Race', '', '');
+	END;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(func(tx PassTxW) { tx.Put("/e.gpg", encryptForTest(t, "e")) }); err != ErrConflict {
+		t.Errorf("Commit of a revision that was taken returned %v", err)
+	}
+}
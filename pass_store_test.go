@@ -0,0 +1,554 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// otherKeyID is a recipient that the test files are not encrypted to.
+const otherKeyID = "0123456789ABCDEF"
+
+// testPassStore checks that a PassStore behaves as documented by PassTx and
+// PassTxW. newStore returns an empty store that verifies ciphertexts with
+// keys.
+func testPassStore(t *testing.T, newStore func(t *testing.T, keys KeyResolver) PassStore) {
+	db, err := initDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	keys := storeKeyResolver(db)
+	pw := encryptForTest(t, "password")
+
+	commit := func(t *testing.T, ps PassStore, fn func(tx PassTxW)) error {
+		tx, err := ps.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(tx)
+		return tx.Commit(CommitInfo{UserID: "test", Message: "test"})
+	}
+	// populated returns a store with:
+	//   /.gpg-id        tolar2
+	//   /a.gpg
+	//   /dir/b.gpg
+	//   /dir/sub/c.gpg
+	//   /own/.gpg-id    tolar2 (its own, so not affected by changes above)
+	//   /own/d.gpg
+	populated := func(t *testing.T) PassStore {
+		ps := newStore(t, keys)
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			tx.SetRecipients("/own", []string{tolar2PublicKeyID})
+			for _, p := range []string{"/a.gpg", "/dir/b.gpg", "/dir/sub/c.gpg", "/own/d.gpg"} {
+				tx.Put(p, pw)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ps
+	}
+	begin := func(t *testing.T, ps PassStore) PassTx {
+		tx, err := ps.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	sorted := func(s []string) []string {
+		sort.Strings(s)
+		return s
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		tx := begin(t, newStore(t, keys))
+		if exists, isFile := tx.Type("/"); !exists || isFile {
+			t.Error("The root directory should exist")
+		} else if l, err := tx.List("/"); err != nil || len(l) != 0 {
+			t.Errorf("List(/) = %v, %v; want nothing", l, err)
+		} else if r, err := tx.Recipients("/"); err != nil || len(r) != 0 {
+			t.Errorf("Recipients(/) = %v, %v; want none", r, err)
+		}
+	})
+
+	t.Run("Type", func(t *testing.T) {
+		tx := begin(t, populated(t))
+		for p, want := range map[string][2]bool{
+			"/":              {true, false},
+			"":               {true, false},
+			"/a.gpg":         {true, true},
+			"a.gpg":          {true, true},
+			"/dir":           {true, false},
+			"/dir/":          {true, false},
+			"/dir/sub/c.gpg": {true, true},
+			"/.gpg-id":       {true, true},
+			"/missing.gpg":   {false, false},
+			"/a.gpg/x":       {false, false},
+		} {
+			if exists, isFile := tx.Type(p); exists != want[0] || isFile != want[1] {
+				t.Errorf("Type(%q) = %v, %v; want %v, %v", p, exists, isFile, want[0], want[1])
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		tx := begin(t, populated(t))
+		if l, err := tx.List("/"); err != nil {
+			t.Fatal(err)
+		} else {
+			sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+			want := []PassDirent{{true, "a.gpg"}, {false, "dir"}, {false, "own"}}
+			if !reflect.DeepEqual(l, want) {
+				t.Errorf("List(/) = %v; want %v", l, want)
+			}
+		}
+		if l, err := tx.List("/dir/sub"); err != nil || !reflect.DeepEqual(l, []PassDirent{{true, "c.gpg"}}) {
+			t.Errorf("List(/dir/sub) = %v, %v", l, err)
+		}
+		if _, err := tx.List("/missing"); err == nil {
+			t.Error("List of a missing directory succeeded")
+		} else if _, err := tx.List("/a.gpg"); err == nil {
+			t.Error("List of a file succeeded")
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		tx := begin(t, populated(t))
+		if c, err := tx.Get("/dir/b.gpg"); err != nil || string(c) != string(pw) {
+			t.Errorf("Get(/dir/b.gpg) = %v", err)
+		} else if _, err := tx.Get("/missing.gpg"); err == nil {
+			t.Error("Get of a missing file succeeded")
+		} else if _, err := tx.Get("/dir"); err == nil {
+			t.Error("Get of a directory succeeded")
+		}
+	})
+
+	t.Run("Recipients", func(t *testing.T) {
+		ps := populated(t)
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.SetRecipients("/new", []string{tolar2PublicKeyID, otherKeyID})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tx := begin(t, ps)
+		for p, want := range map[string][]string{
+			"/":              {tolar2PublicKeyID},
+			"/dir/sub":       {tolar2PublicKeyID},
+			"/dir/sub/c.gpg": {tolar2PublicKeyID},
+			"/own/d.gpg":     {tolar2PublicKeyID},
+			"/new":           {tolar2PublicKeyID, otherKeyID},
+			"/new/x/y":       {tolar2PublicKeyID, otherKeyID},
+			"/missing/dir":   {tolar2PublicKeyID},
+		} {
+			if r, err := tx.Recipients(p); err != nil || !reflect.DeepEqual(r, want) {
+				t.Errorf("Recipients(%q) = %v, %v; want %v", p, r, err, want)
+			}
+		}
+	})
+
+	t.Run("GetAffectedFiles", func(t *testing.T) {
+		tx := begin(t, populated(t))
+		for p, want := range map[string][]string{
+			"/":    {"a.gpg", "dir/b.gpg", "dir/sub/c.gpg"},
+			"/dir": {"dir/b.gpg", "dir/sub/c.gpg"},
+			"/own": {"own/d.gpg"},
+		} {
+			if files, err := tx.GetAffectedFiles(p); err != nil || !reflect.DeepEqual(sorted(files), want) {
+				t.Errorf("GetAffectedFiles(%q) = %v, %v; want %v", p, files, err, want)
+			}
+		}
+	})
+
+	t.Run("Walk", func(t *testing.T) {
+		tx := begin(t, populated(t))
+		// both the store's own Walk (if any) and the fallback
+		for _, tx := range []PassTx{tx, struct{ PassTx }{tx}} {
+			var names []string
+			if err := PassWalk(tx, "/dir", func(d PassDirent) error {
+				names = append(names, d.Name)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"dir", "dir/b.gpg", "dir/sub", "dir/sub/c.gpg"}; !reflect.DeepEqual(sorted(names), want) {
+				t.Errorf("%T: walked %v; want %v", tx, names, want)
+			}
+			names = nil
+			if err := PassWalk(tx, "/", func(d PassDirent) error {
+				if d.Name == "dir" {
+					return filepath.SkipDir
+				}
+				names = append(names, d.Name)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"", "a.gpg", "own", "own/d.gpg"}; !reflect.DeepEqual(sorted(names), want) {
+				t.Errorf("%T: walked %v with SkipDir; want %v", tx, names, want)
+			}
+			if err := PassWalk(tx, "/missing", func(d PassDirent) error { return nil }); err == nil {
+				t.Errorf("%T: walked a missing directory", tx)
+			}
+		}
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		ps := populated(t)
+		other := encryptForTest(t, "other")
+		before, _ := begin(t, ps).Version("/dir")
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.Put("/dir/b.gpg", other)
+			tx.Put("/dir/new/e.gpg", pw)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tx := begin(t, ps)
+		if c, _ := tx.Get("/dir/b.gpg"); string(c) != string(other) {
+			t.Error("Put did not replace the file")
+		} else if exists, isFile := tx.Type("/dir/new/e.gpg"); !exists || !isFile {
+			t.Error("Put did not create the file and its directory")
+		} else if after, _ := tx.Version("/dir"); after == before {
+			t.Error("The version of the directory didn't change")
+		}
+	})
+
+	t.Run("PutInvalid", func(t *testing.T) {
+		for name, fn := range map[string]func(tx PassTxW){
+			"not .gpg":          func(tx PassTxW) { tx.Put("/x.txt", pw) },
+			"dot file":          func(tx PassTxW) { tx.Put("/dir/.x.gpg", pw) },
+			"not encrypted":     func(tx PassTxW) { tx.Put("/x.gpg", []byte("plain")) },
+			"wrong recipients":  func(tx PassTxW) { tx.SetRecipients("/new", []string{otherKeyID}); tx.Put("/new/x.gpg", pw) },
+			"file as directory": func(tx PassTxW) { tx.Put("/dir.gpg", pw); tx.Put("/dir.gpg/x.gpg", pw) },
+			"over a directory":  func(tx PassTxW) { tx.Put("/dir", pw) },
+			"remove root":       func(tx PassTxW) { tx.SetRecipients("/", nil) },
+		} {
+			ps := populated(t)
+			before, _ := begin(t, ps).Version("/")
+			if err := commit(t, ps, fn); err == nil {
+				t.Errorf("%s: commit succeeded", name)
+			} else if _, ok := err.(VerifyError); !ok {
+				t.Errorf("%s: got %T %v; want a VerifyError", name, err, err)
+			} else if after, _ := begin(t, ps).Version("/"); after != before {
+				t.Errorf("%s: the store changed", name)
+			}
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		ps := populated(t)
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.Delete("/a.gpg")
+			tx.Delete("/dir")
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tx := begin(t, ps)
+		for _, p := range []string{"/a.gpg", "/dir", "/dir/sub/c.gpg"} {
+			if exists, _ := tx.Type(p); exists {
+				t.Errorf("%s still exists", p)
+			}
+		}
+		if exists, _ := tx.Type("/own/d.gpg"); !exists {
+			t.Error("/own/d.gpg was deleted")
+		}
+	})
+
+	t.Run("SetRecipients", func(t *testing.T) {
+		ps := populated(t)
+		// every affected file must be reencrypted
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.SetRecipients("/dir", []string{tolar2PublicKeyID, otherKeyID})
+			tx.Put("/dir/b.gpg", pw)
+		}); err == nil {
+			t.Error("Changing recipients without reencrypting every file succeeded")
+		} else if _, ok := err.(VerifyError); !ok {
+			t.Errorf("Got %T %v; want a VerifyError", err, err)
+		}
+
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.SetRecipients("/dir", []string{tolar2PublicKeyID})
+			tx.Put("/dir/b.gpg", pw)
+			tx.Put("/dir/sub/c.gpg", pw)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if r, _ := begin(t, ps).Recipients("/dir/sub"); !reflect.DeepEqual(r, []string{tolar2PublicKeyID}) {
+			t.Errorf("Recipients(/dir/sub) = %v", r)
+		}
+		if files, _ := begin(t, ps).GetAffectedFiles("/"); !reflect.DeepEqual(sorted(files), []string{"a.gpg"}) {
+			t.Errorf("GetAffectedFiles(/) = %v after giving /dir its own recipients", files)
+		}
+	})
+
+	t.Run("RemoveRecipients", func(t *testing.T) {
+		ps := populated(t)
+		// deleting .gpg-id (and moving it away) is checked on its directory
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.SetRecipients("/own", nil)
+			tx.Put("/own/d.gpg", pw)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := begin(t, ps).GetAffectedFiles("/"); !reflect.DeepEqual(sorted(files), []string{"a.gpg", "dir/b.gpg", "dir/sub/c.gpg", "own/d.gpg"}) {
+			t.Errorf("GetAffectedFiles(/) = %v after removing the recipients of /own", files)
+		}
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.SetRecipients("/dir", []string{tolar2PublicKeyID})
+			tx.Put("/dir/b.gpg", pw)
+			tx.Put("/dir/sub/c.gpg", pw)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(t, ps, func(tx PassTxW) {
+			if err := tx.Move("/dir", "/moved"); err != nil {
+				t.Fatal(err)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if r, _ := begin(t, ps).Recipients("/moved/sub"); !reflect.DeepEqual(r, []string{tolar2PublicKeyID}) {
+			t.Errorf("Recipients(/moved/sub) = %v", r)
+		}
+	})
+
+	t.Run("MkdirMove", func(t *testing.T) {
+		ps := populated(t)
+		if err := commit(t, ps, func(tx PassTxW) {
+			tx.Mkdir("/empty")
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if exists, isFile := begin(t, ps).Type("/empty"); !exists || isFile {
+			t.Error("Mkdir did not create a directory")
+		}
+		if err := commit(t, ps, func(tx PassTxW) {
+			if err := tx.Move("/dir", "/empty/moved"); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Move("/a.gpg", "/own"); err != os.ErrExist {
+				t.Errorf("Moving onto an existing path: %v", err)
+			} else if err := tx.Move("/own", "/own/x"); err != os.ErrInvalid {
+				t.Errorf("Moving into itself: %v", err)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tx := begin(t, ps)
+		if exists, _ := tx.Type("/dir"); exists {
+			t.Error("/dir still exists after moving it")
+		} else if c, err := tx.Get("/empty/moved/sub/c.gpg"); err != nil || string(c) != string(pw) {
+			t.Errorf("Moved file: %v", err)
+		}
+	})
+
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		ps := populated(t)
+		other := encryptForTest(t, "other")
+		tx, _ := ps.BeginW()
+		before, _ := tx.Version("/dir")
+
+		tx.Put("/dir/b.gpg", other)
+		tx.Put("/dir/new/e.gpg", pw)
+		if c, err := tx.Get("/dir/b.gpg"); err != nil || string(c) != string(other) {
+			t.Errorf("Get after Put = %v", err)
+		} else if exists, isFile := tx.Type("/dir/new"); !exists || isFile {
+			t.Error("A directory created by Put doesn't exist")
+		} else if l, _ := tx.List("/dir"); !reflect.DeepEqual(l, []PassDirent{{true, "b.gpg"}, {false, "new"}, {false, "sub"}}) {
+			t.Errorf("List(/dir) = %v after Put", l)
+		} else if after, _ := tx.Version("/dir"); after == before {
+			t.Error("The version of a changed directory didn't change")
+		}
+
+		// a deletion hides what was written in the deleted directory before,
+		// but not after
+		tx.Put("/gone/x.gpg", pw)
+		tx.Delete("/gone")
+		tx.Delete("/dir/sub")
+		tx.Put("/dir/sub/f.gpg", pw)
+		if exists, _ := tx.Type("/gone"); exists {
+			t.Error("A deleted directory exists")
+		} else if exists, _ := tx.Type("/dir/sub/c.gpg"); exists {
+			t.Error("A file in a deleted directory exists")
+		} else if files, _ := tx.GetAffectedFiles("/dir"); !reflect.DeepEqual(sorted(files), []string{"dir/b.gpg", "dir/new/e.gpg", "dir/sub/f.gpg"}) {
+			t.Errorf("GetAffectedFiles(/dir) = %v", files)
+		}
+
+		// moves take what was written before along
+		tx.Put("/own/g.gpg", pw)
+		if err := tx.Move("/own", "/moved"); err != nil {
+			t.Fatal(err)
+		} else if exists, _ := tx.Type("/own"); exists {
+			t.Error("The source of a move exists")
+		} else if c, err := tx.Get("/moved/g.gpg"); err != nil || string(c) != string(pw) {
+			t.Errorf("Get of a moved file = %v", err)
+		} else if r, _ := tx.Recipients("/moved/g.gpg"); !reflect.DeepEqual(r, []string{tolar2PublicKeyID}) {
+			t.Errorf("Recipients of a moved file = %v", r)
+		}
+
+		tx.SetRecipients("/moved", []string{tolar2PublicKeyID, otherKeyID})
+		if r, _ := tx.Recipients("/moved/x"); !reflect.DeepEqual(r, []string{tolar2PublicKeyID, otherKeyID}) {
+			t.Errorf("Recipients after SetRecipients = %v", r)
+		} else if files, _ := tx.GetAffectedFiles("/"); !reflect.DeepEqual(sorted(files), []string{"a.gpg", "dir/b.gpg", "dir/new/e.gpg", "dir/sub/f.gpg"}) {
+			t.Errorf("GetAffectedFiles(/) = %v after SetRecipients", files)
+		}
+		tx.SetRecipients("/moved", []string{tolar2PublicKeyID})
+		tx.Put("/moved/d.gpg", pw)
+		tx.Put("/moved/g.gpg", pw)
+
+		// what the transaction reads is what it commits
+		want, err := readStoreSnapshot(tx)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(CommitInfo{Message: "test"}); err != nil {
+			t.Fatal(err)
+		} else if got, err := readStoreSnapshot(begin(t, ps)); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("Committed %+v; the transaction read %+v", got, want)
+		}
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		ps := populated(t)
+		tip := func() string {
+			v, _ := begin(t, ps).Version("/")
+			return v
+		}
+		start := tip()
+
+		// nothing happens without a commit
+		tx, _ := ps.BeginW()
+		tx.Delete("/a.gpg")
+		if tip() != start {
+			t.Error("An uncommitted transaction changed the store")
+		}
+
+		// transactions see the store as it was when they began
+		old := begin(t, ps)
+		a, _ := ps.BeginW()
+		b, _ := ps.BeginW()
+		c, _ := ps.BeginW()
+		a.Delete("/a.gpg")
+		b.Delete("/dir/b.gpg")
+		c.Delete("/a.gpg")
+		if err := a.Commit(CommitInfo{Message: "a"}); err != nil {
+			t.Fatal(err)
+		} else if err := b.Commit(CommitInfo{Message: "b"}); err != nil {
+			t.Error("Unrelated concurrent commit failed: ", err)
+		} else if err := c.Commit(CommitInfo{Message: "c"}); err != ErrConflict {
+			t.Errorf("Conflicting commit: got %v; want ErrConflict", err)
+		}
+		if exists, _ := old.Type("/a.gpg"); !exists {
+			t.Error("An old transaction saw a later commit")
+		}
+		now := begin(t, ps)
+		for _, p := range []string{"/a.gpg", "/dir/b.gpg"} {
+			if exists, _ := now.Type(p); exists {
+				t.Errorf("%s was not deleted", p)
+			}
+		}
+
+		if revs, err := now.History("/dir/b.gpg"); err != nil {
+			t.Fatal(err)
+		} else if len(revs) != 2 || revs[0].Message != "b" || revs[0].Version != "" {
+			t.Errorf("Unexpected history: %+v", revs)
+		} else if at, err := now.At(revs[1].Revision); err != nil {
+			t.Fatal(err)
+		} else if c, err := at.Get("/dir/b.gpg"); err != nil || string(c) != string(pw) {
+			t.Errorf("Get at an old revision: %v", err)
+		} else if _, err := old.At(revs[0].Revision); err != ErrUnknownRevision {
+			t.Errorf("At a later revision: got %v; want ErrUnknownRevision", err)
+		}
+	})
+
+	t.Run("CommitRekeyed", func(t *testing.T) {
+		// a file added to a directory while its recipients change would be
+		// encrypted to the old ones
+		ps := populated(t)
+		a, _ := ps.BeginW()
+		b, _ := ps.BeginW()
+		a.SetRecipients("/own", []string{tolar2PublicKeyID})
+		a.Put("/own/d.gpg", pw)
+		b.Put("/own/e.gpg", pw)
+		if err := b.Commit(CommitInfo{Message: "b"}); err != nil {
+			t.Fatal(err)
+		} else if err := a.Commit(CommitInfo{Message: "a"}); err != ErrConflict {
+			t.Errorf("Changing recipients after a file was added: got %v; want ErrConflict", err)
+		}
+
+		// unrelated changes still don't conflict
+		a, _ = ps.BeginW()
+		b, _ = ps.BeginW()
+		a.SetRecipients("/own", []string{tolar2PublicKeyID})
+		a.Put("/own/d.gpg", pw)
+		a.Put("/own/e.gpg", pw)
+		b.Put("/dir/e.gpg", pw)
+		if err := b.Commit(CommitInfo{Message: "b"}); err != nil {
+			t.Fatal(err)
+		} else if err := a.Commit(CommitInfo{Message: "a"}); err != nil {
+			t.Errorf("Changing recipients after an unrelated change: %v", err)
+		}
+	})
+
+	t.Run("LastChanges", func(t *testing.T) {
+		ps := populated(t)
+		if err := commit(t, ps, func(tx PassTxW) { tx.Put("/dir/sub/c.gpg", encryptForTest(t, "c")) }); err != nil {
+			t.Fatal(err)
+		} else if err := commit(t, ps, func(tx PassTxW) { tx.Delete("/a.gpg") }); err != nil {
+			t.Fatal(err)
+		}
+		tx := begin(t, ps)
+		paths := []string{"/", "/a.gpg", "/dir", "/dir/b.gpg", "/dir/sub/c.gpg", "/own", "/missing.gpg"}
+		changes, err := lastChanges(tx, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != len(paths)-1 {
+			t.Errorf("LastChanges returned %d paths; want %d", len(changes), len(paths)-1)
+		}
+		for _, p := range paths {
+			revs, _ := tx.History(p)
+			if got, ok := changes[cleanPassPath(p)]; len(revs) == 0 && ok {
+				t.Errorf("%s: got %s; want no change", p, got.Revision)
+			} else if len(revs) > 0 && got.Revision != revs[0].Revision {
+				t.Errorf("%s: got %s; want %s", p, got.Revision, revs[0].Revision)
+			}
+		}
+	})
+}
+
+func TestGitPassStore(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		testPassStore(t, func(t *testing.T, keys KeyResolver) PassStore {
+			dir, err := ioutil.TempDir("", "gpm-store")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// subtests share the parent's lifetime
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.SetKeyResolver(keys)
+			return g
+		})
+	})
+}
+
+func TestMemPassStore(t *testing.T) {
+	testPassStore(t, func(t *testing.T, keys KeyResolver) PassStore {
+		m := NewMemPass()
+		m.SetKeyResolver(keys)
+		return m
+	})
+}
+
+func TestSQLPassStore(t *testing.T) {
+	testPassStore(t, func(t *testing.T, keys KeyResolver) PassStore {
+		return newSQLPassForTest(t, keys)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/speedata/gogit"
+)
+
+// ErrTooLarge is returned by PassStreamWriter.PutStream for files over the
+// limit.
+var ErrTooLarge = errors.New("file too large")
+
+// PassStreamWriter is implemented by write transactions that can write large
+// files without holding them in memory.
+type PassStreamWriter interface {
+	// PutStream is Put with the contents read from r. If r has more than
+	// limit bytes, ErrTooLarge is returned. The contents must be encrypted
+	// like those of any other file; if they aren't an encrypted message at
+	// all, a VerifyError is returned right away.
+	PutStream(p string, r io.Reader, limit int64) error
+}
+
+// PassStreamReader is implemented by transactions that can read large files
+// without holding them in memory.
+type PassStreamReader interface {
+	// Open returns a reader of the contents of the file p, which must be
+	// closed.
+	Open(p string) (io.ReadCloser, error)
+}
+
+// streamedFile is a file written by gitPassTxW.PutStream.
+type streamedFile struct {
+	// id is the blob, which is in the repository already
+	id string
+	// keys are the key IDs the file is encrypted to
+	keys []string
+}
+
+// placeholder returns what the transaction's view has as the contents of the
+// file; they are only read through Get and Open, which find the blob.
+func (f streamedFile) placeholder() []byte {
+	return []byte("streamed blob " + f.id)
+}
+
+// PutStream copies r to a temporary file, and from there to a loose object.
+func (tx *gitPassTxW) PutStream(p string, r io.Reader, limit int64) error {
+	p = tx.clean(p)
+	tmp, err := ioutil.TempFile(filepath.Join(tx.g.repoRoot, "objects"), "tmp_stream_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	} else if size > limit {
+		return ErrTooLarge
+	} else if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	keys, err := readEncryptedKeyIDs(bufio.NewReader(tmp))
+	if err != nil {
+		return VerifyError{p, fmt.Sprintf("not an OpenPGP encrypted file: %v", err)}
+	} else if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	id, err := writeObjectFrom(tx.g.repoRoot, "blob", tmp, size)
+	if err != nil {
+		return err
+	}
+	delete(tx.changedPasswords, p)
+	tx.streamed[p] = streamedFile{id: id, keys: keys}
+	return nil
+}
+
+func (tx *gitPassTx) Open(p string) (io.ReadCloser, error) {
+	if te, err := tx.getFile(tx.clean(p)); err != nil {
+		return nil, err
+	} else if te.Type != gogit.ObjectBlob {
+		return nil, os.ErrInvalid
+	} else {
+		return tx.openBlob(te.Id.String())
+	}
+}
+
+func (tx *gitPassTxW) Open(p string) (io.ReadCloser, error) {
+	p = tx.clean(p)
+	if f, ok := tx.streamed[p]; ok {
+		return tx.openBlob(f.id)
+	} else if touched(tx.pending(), p) {
+		c, err := tx.Get(p)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(c)), nil
+	}
+	return tx.gitPassTx.Open(p)
+}
+
+// openBlob reads the blob id straight from its loose object, if it is one.
+// Packed blobs are read in memory.
+func (tx *gitPassTx) openBlob(id string) (io.ReadCloser, error) {
+	if r, err := openLooseObject(tx.g.repoRoot, id); err == nil {
+		return r, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if c, err := tx.readBlob(id); err != nil {
+		return nil, err
+	} else {
+		return ioutil.NopCloser(bytes.NewReader(c)), nil
+	}
+}
+
+// readBlob reads the blob id, which may have been written since the
+// transaction began.
+func (tx *gitPassTx) readBlob(id string) ([]byte, error) {
+	if r, err := openLooseObject(tx.g.repoRoot, id); err == nil {
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	oid, err := gogit.NewOidFromString(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := tx.repo.LookupBlob(oid)
+	if err != nil {
+		return nil, err
+	}
+	return b.Contents(), nil
+}
+
+type looseObjectReader struct {
+	io.Reader
+	zr io.ReadCloser
+	f  *os.File
+}
+
+func (r looseObjectReader) Close() error {
+	r.zr.Close()
+	return r.f.Close()
+}
+
+// openLooseObject returns a reader of the contents (after the header) of the
+// loose object id in the repository at root.
+func openLooseObject(root, id string) (io.ReadCloser, error) {
+	if len(id) < 3 {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(filepath.Join(root, "objects", id[:2], id[2:]))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(zr)
+	if _, err := br.ReadString(0); err != nil {
+		zr.Close()
+		f.Close()
+		return nil, err
+	}
+	return looseObjectReader{br, zr, f}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitPassStream(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := initDB("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDefaults(db)
+		g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.SetKeyResolver(storeKeyResolver(db))
+		read := func(tx PassTx, p string) []byte {
+			r, err := tx.(PassStreamReader).Open(p)
+			if err != nil {
+				t.Fatalf("Open %s: %v", p, err)
+			}
+			defer r.Close()
+			c, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}
+
+		a := encryptForTest(t, strings.Repeat("a", 100000))
+		tx, err := g.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		sw := tx.(PassStreamWriter)
+		if err := sw.PutStream("a.gpg", bytes.NewReader(a), int64(len(a)-1)); err != ErrTooLarge {
+			t.Fatalf("Streaming a file over the limit: %v", err)
+		} else if err := sw.PutStream("b.gpg", strings.NewReader("plain"), 100); err == nil {
+			t.Fatal("Streaming an unencrypted file succeeded")
+		} else if _, ok := err.(VerifyError); !ok {
+			t.Fatalf("Streaming an unencrypted file: %v", err)
+		} else if err := sw.PutStream("a.gpg", bytes.NewReader(a), int64(len(a))); err != nil {
+			t.Fatal(err)
+		} else if c, err := tx.Get("a.gpg"); err != nil || !bytes.Equal(c, a) {
+			t.Fatalf("Get of a streamed file: %v", err)
+		} else if c := read(tx, "a.gpg"); !bytes.Equal(c, a) {
+			t.Fatal("Open of a streamed file in its transaction returned other contents")
+		} else if err := tx.Move("a.gpg", "dir/a.gpg"); err != nil {
+			t.Fatal(err)
+		} else if err := tx.Commit(CommitInfo{UserID: "test", Message: "Stream a"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if tx, err := g.Begin(); err != nil {
+			t.Fatal(err)
+		} else if exists, _ := tx.Type("a.gpg"); exists {
+			t.Error("The streamed file wasn't moved")
+		} else if c := read(tx, "dir/a.gpg"); !bytes.Equal(c, a) {
+			t.Error("The committed streamed file has other contents")
+		} else if c, err := tx.Get("dir/a.gpg"); err != nil || !bytes.Equal(c, a) {
+			t.Errorf("Get of the committed streamed file: %v", err)
+		}
+
+		// streamed files are verified like any other
+		b, err := newPass(filepath.Join(dir, "other.git"), "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetKeyResolver(storeKeyResolver(db))
+		if tx, err := b.BeginW(); err != nil {
+			t.Fatal(err)
+		} else {
+			tx.SetRecipients("/", []string{"0000000000000000"})
+			if err := tx.(PassStreamWriter).PutStream("a.gpg", bytes.NewReader(a), int64(len(a))); err != nil {
+				t.Fatal(err)
+			} else if err := tx.Commit(CommitInfo{UserID: "test", Message: "Stream a"}); err == nil {
+				t.Error("Committed a streamed file encrypted to the wrong key")
+			}
+		}
+	})
+}
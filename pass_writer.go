@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// groupCommitWindow is how long the writer waits for more transactions
+	// to commit together with the first one it receives.
+	groupCommitWindow = 2 * time.Millisecond
+	// maxGroupCommit is the most transactions committed together.
+	maxGroupCommit = 32
+)
+
+// pendingCommit is a transaction waiting for the writer.
+type pendingCommit struct {
+	tx     *gitPassTxW
+	info   CommitInfo
+	result chan error
+}
+
+// importedCommit is a commit made by importCommits. Its changes are applied
+// to its first parent in order: deletions (of files or whole directories)
+// first, and then files.
+type importedCommit struct {
+	info CommitInfo
+	// merge is the second parent of a merge commit
+	merge   string
+	deletes []string
+	files   []importedFile
+}
+
+// importedFile is a file written by an importedCommit: either contents, or
+// an existing object id.
+type importedFile struct {
+	path     string
+	mode     string
+	id       string
+	contents []byte
+}
+
+// gitBackend creates the repository and writes commits to it. The rest of
+// GitPass (reading, verifying and queueing transactions) is shared.
+type gitBackend interface {
+	// initRepository creates a bare repository at g.repoRoot, with an empty
+	// initial commit on the branch.
+	initRepository(g *GitPass) error
+	// importCommits creates a chain of commits on ref (the branch, or the
+	// ref of a proposal). The first commit's first parent is from; if ref
+	// has moved away from from, errRefMoved is returned. With a signing key,
+	// the commits are signed.
+	importCommits(g *GitPass, ref, from string, commits []importedCommit) error
+}
+
+// queueCommit commits tx with the store's writer, starting it if necessary,
+// and waits for the result.
+func (g *GitPass) queueCommit(tx *gitPassTxW, info CommitInfo) error {
+	g.writerOnce.Do(func() {
+		g.writes = make(chan *pendingCommit)
+		go g.writer()
+	})
+	c := &pendingCommit{tx, info, make(chan error, 1)}
+	g.writes <- c
+	return <-c.result
+}
+
+// writer commits the transactions sent to it one group at a time. Every
+// transaction that arrives within groupCommitWindow of the first is
+// committed in the same fast-import run, each as its own commit.
+func (g *GitPass) writer() {
+	for c := range g.writes {
+		group := []*pendingCommit{c}
+		timeout := time.After(groupCommitWindow)
+	gather:
+		for len(group) < maxGroupCommit {
+			select {
+			case c := <-g.writes:
+				group = append(group, c)
+			case <-timeout:
+				break gather
+			}
+		}
+
+		errs := g.commitGroup(group)
+		for i, c := range group {
+			c.result <- errs[i]
+		}
+	}
+}
+
+// commitGroup commits the transactions in order on top of the branch, and
+// returns the result of each. A transaction that touches a path changed since
+// it began, or by an earlier transaction of the group, fails with
+// ErrConflict. Since the branch can move while fast-import runs (with a push
+// or a sync), the group is retried a few times.
+func (g *GitPass) commitGroup(group []*pendingCommit) []error {
+	errs := make([]error, len(group))
+	for attempt := 1; ; attempt++ {
+		tip, err := g.begin()
+		if err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
+
+		var commits []importedCommit
+		var members []int
+		changed := make(map[string]bool)
+		for i, c := range group {
+			if errs[i] = c.tx.checkRebase(tip, changed); errs[i] != nil {
+				continue
+			}
+			for _, p := range c.tx.changedPaths() {
+				changed[p] = true
+			}
+			commits = append(commits, c.tx.importedCommit(c.info))
+			members = append(members, i)
+		}
+		if len(commits) == 0 {
+			return errs
+		}
+
+		err = g.importCommits(tip.commit.Oid.String(), commits)
+		if err == errRefMoved && attempt < maxCommitAttempts {
+			continue
+		} else if err == errRefMoved {
+			err = ErrConflict
+		}
+		for _, i := range members {
+			errs[i] = err
+		}
+		return errs
+	}
+}
+
+func (g *GitPass) importCommits(from string, commits []importedCommit) error {
+	return g.backend.importCommits(g, "refs/heads/"+g.branch, from, commits)
+}
+
+// execGit is the gitBackend that runs the git binary, with git fast-import for
+// commits.
+type execGit struct{}
+
+func (execGit) initRepository(g *GitPass) error {
+	if err := os.MkdirAll(g.repoRoot, 0700); err != nil {
+		return err
+	} else if err := g.git("init", "--bare", "."); err != nil {
+		return err
+	} else if b, err := g.gitO("mktree"); err != nil {
+		return err
+	} else if b, err := g.gitO("-c", "user.name=pass", "-c", "user.email=pass@localhost", "commit-tree", string(b), "-m", "Initial Commit"); err != nil {
+		return err
+	} else {
+		return g.git("update-ref", "refs/heads/"+g.branch, string(b))
+	}
+}
+
+var unsignedCommits uint64
+
+// importCommits imports the commits with a single git fast-import. With a
+// signing key, they are imported to a temporary ref, signed, and then put on
+// ref.
+func (execGit) importCommits(g *GitPass, ref, from string, commits []importedCommit) error {
+	target := ref
+	if g.signer != nil {
+		ref = fmt.Sprintf("refs/pass/unsigned/%d-%d", os.Getpid(), atomic.AddUint64(&unsignedCommits, 1))
+		defer g.git("update-ref", "-d", ref)
+	}
+
+	var stderr bytes.Buffer
+	cmd := g.gitHelper("fast-import", "--quiet")
+	cmd.Stderr = &stderr
+	pw, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var w io.Writer = pw
+	// var w io.Writer = io.MultiWriter(pw, os.Stdout)
+	// var w io.Writer = os.Stdout
+
+	for i, c := range commits {
+		author, committer := g.commitIdents(c.info)
+		fmt.Fprintf(w, "commit %s\n", ref)
+		if author != "" {
+			fmt.Fprintf(w, "author %s\n", author)
+		}
+		fmt.Fprintf(w, "committer %s\n", committer)
+		message := formatTrailers(c.info)
+		fmt.Fprintf(w, "data %d\n%s\n", len(message), message)
+		// later commits continue from the previous one on the same ref
+		if i == 0 {
+			fmt.Fprintf(w, "from %s\n", from)
+		}
+		if c.merge != "" {
+			fmt.Fprintf(w, "merge %s\n", c.merge)
+		}
+		for _, p := range c.deletes {
+			fmt.Fprintf(w, "D %s\n", p)
+		}
+		for _, f := range c.files {
+			if f.contents == nil {
+				fmt.Fprintf(w, "M %s %s %s\n", f.mode, f.id, f.path)
+			} else {
+				fmt.Fprintf(w, "M %s inline %s\n", f.mode, f.path)
+				fmt.Fprintf(w, "data %d\n", len(f.contents))
+				w.Write(f.contents)
+				fmt.Fprint(w, "\n")
+			}
+		}
+	}
+	fmt.Fprint(w, "done\n")
+
+	pw.Close()
+
+	if err := cmd.Wait(); err != nil {
+		if bytes.Contains(stderr.Bytes(), []byte("Not updating")) {
+			return errRefMoved
+		}
+		return GitError{err, stderr.Bytes()}
+	}
+
+	if g.signer == nil {
+		return nil
+	} else if id, err := g.signCommits(from, ref); err != nil {
+		return err
+	} else if err := g.git("update-ref", target, id, from); err != nil {
+		return errRefMoved
+	}
+	return nil
+}
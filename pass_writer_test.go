@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestGitPassConcurrentCommits(t *testing.T) {
+	key, err := openpgp.NewEntity("pass", "", "pass@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		for _, signed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("signed=%v", signed), func(t *testing.T) {
+				testConcurrentCommits(t, newPass, signed, key)
+			})
+		}
+	})
+}
+
+func testConcurrentCommits(t *testing.T, newPass newGitPassFunc, signed bool, key *openpgp.Entity) {
+	dir, err := ioutil.TempDir("", "gpm-writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// every connection to :memory: gets a separate database
+	db, err := initDB("sqlite3", filepath.Join(dir, "db.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDefaults(db)
+	g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetKeyResolver(storeKeyResolver(db))
+	if signed {
+		g.SetSigningKey(key)
+		g.SetTrustedKeys(openpgp.EntityList{key})
+	}
+	if tx, err := g.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.SetRecipients("/", []string{tolar2PublicKeyID})
+		if err := tx.Commit(CommitInfo{Message: "Set recipients"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, err := g.gitO("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// half of the writers write their own file, and the others all write the
+	// same one, from the same starting commit
+	const writers = 40
+	contents := encryptForTest(t, "password")
+	var start sync.WaitGroup
+	start.Add(1)
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		tx, err := g.BeginW()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := "shared.gpg"
+		if i%2 == 0 {
+			p = fmt.Sprintf("own%d.gpg", i)
+		}
+		tx.Put(p, contents)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start.Wait()
+			errs[i] = tx.Commit(CommitInfo{UserID: "test", Message: fmt.Sprintf("Writer %d", i)})
+		}(i)
+	}
+	start.Done()
+	wg.Wait()
+
+	committed := 0
+	for i, err := range errs {
+		if err == nil {
+			committed++
+		} else if err != ErrConflict {
+			t.Errorf("Writer %d: %v", i, err)
+		} else if i%2 == 0 {
+			t.Errorf("Writer %d of its own file got a conflict", i)
+		}
+	}
+	if shared := committed - writers/2; shared != 1 {
+		t.Errorf("%d writers of the shared file committed; want 1", shared)
+	}
+
+	// every transaction is its own commit
+	if out, err := g.gitO("rev-list", string(base)+"..master"); err != nil {
+		t.Fatal(err)
+	} else if n := len(strings.Fields(string(out))); n != committed {
+		t.Errorf("Got %d commits for %d transactions", n, committed)
+	}
+	if tx, err := g.Begin(); err != nil {
+		t.Fatal(err)
+	} else {
+		for i := 0; i < writers; i += 2 {
+			if exists, _ := tx.Type(fmt.Sprintf("own%d.gpg", i)); !exists {
+				t.Errorf("own%d.gpg was lost", i)
+			}
+		}
+	}
+	if signed {
+		if out, err := g.gitO("log", "--format=%H %G?", string(base)+"..master"); err != nil {
+			t.Fatal(err)
+		} else if strings.Count(string(out), "\n")+1 != committed {
+			t.Errorf("Unexpected log:\n%s", out)
+		} else if refs, err := g.gitO("for-each-ref", "refs/pass/"); err != nil || len(refs) != 0 {
+			t.Errorf("Temporary refs were left behind: %s", refs)
+		}
+		if raw, err := g.gitB("cat-file", "-p", "master"); err != nil || !strings.Contains(string(raw), "\ngpgsig ") {
+			t.Errorf("The tip is not signed:\n%s", raw)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxPassPathLength = 1024
+	maxPassNameLength = 255
+	maxPassPathDepth  = 32
+
+	// passPathBadChars are characters not allowed anywhere in a path. Besides
+	// being confusing, most of them are not allowed in file names on Windows,
+	// where users may clone the repository.
+	passPathBadChars = "\\:*?\"<>|"
+)
+
+// cleanPassPath converts p to the canonical form used inside stores: cleaned,
+// without a leading slash, and empty for the root directory.
+func cleanPassPath(p string) string {
+	p = path.Clean(p)
+	if p == "." || p == "/" {
+		return ""
+	} else {
+		return strings.TrimPrefix(p, "/")
+	}
+}
+
+type passPathKind int
+
+const (
+	// passPathAny is an existing path that may be a file or a directory, so
+	// only the rules that keep it inside the store and away from its
+	// metadata apply.
+	passPathAny passPathKind = iota
+	// passPathFile is a password file, which must end in .gpg.
+	passPathFile
+	// passPathDir is a directory, which must not end in .gpg.
+	passPathDir
+)
+
+// writtenPathKind returns the kind of path a file written to p in tx must
+// have: files that exist already (e.g. being reencrypted) keep their names.
+func writtenPathKind(tx PassTx, p string) passPathKind {
+	if exists, isFile := tx.Type(p); exists && isFile {
+		return passPathAny
+	}
+	return passPathFile
+}
+
+// passPathKindOf returns the kind of path an existing file or directory has.
+func passPathKindOf(isFile bool) passPathKind {
+	if isFile {
+		return passPathFile
+	}
+	return passPathDir
+}
+
+// validatePassPath checks that p is an acceptable path for the given kind of
+// entry. Leading, trailing, and repeated slashes are ignored; everything else
+// that path.Clean would change (. and .. segments) is rejected, as are
+// dotfiles (which hold metadata like .gpg-id) and control characters. Paths
+// of new files and directories must also be valid UTF-8 and not too long or
+// deep, and must not contain passPathBadChars; existing paths (passPathAny)
+// may have been made by pass or an earlier version of the server, and must
+// stay readable and deletable. The returned error is a VerifyError.
+func validatePassPath(p string, kind passPathKind) error {
+	invalid := func(format string, args ...interface{}) error {
+		return VerifyError{p, fmt.Sprintf(format, args...)}
+	}
+
+	for _, r := range p {
+		if r < 0x20 || r == 0x7f {
+			return invalid("path contains control characters")
+		}
+	}
+	var segs []string
+	for _, s := range strings.Split(p, "/") {
+		if s == "." || s == ".." {
+			return invalid("path must not contain . or ..")
+		} else if strings.HasPrefix(s, ".") {
+			return invalid("names must not start with .")
+		} else if s != "" {
+			segs = append(segs, s)
+		}
+	}
+	if kind == passPathAny {
+		return nil
+	}
+
+	if len(p) > maxPassPathLength {
+		return invalid("path longer than %d bytes", maxPassPathLength)
+	} else if !utf8.ValidString(p) {
+		return invalid("path is not valid UTF-8")
+	} else if i := strings.IndexAny(p, passPathBadChars); i >= 0 {
+		return invalid("path contains %q", p[i])
+	} else if len(segs) > maxPassPathDepth {
+		return invalid("path deeper than %d directories", maxPassPathDepth)
+	}
+	for _, s := range segs {
+		if len(s) > maxPassNameLength {
+			return invalid("name longer than %d bytes", maxPassNameLength)
+		}
+	}
+
+	dirs := segs
+	if kind == passPathFile {
+		if len(segs) == 0 {
+			return invalid("missing file name")
+		}
+		name := segs[len(segs)-1]
+		if !strings.HasSuffix(name, ".gpg") {
+			return invalid("file names must end with .gpg")
+		}
+		dirs = segs[:len(segs)-1]
+	}
+	for _, s := range dirs {
+		if strings.HasSuffix(s, ".gpg") {
+			return invalid("directory names must not end with .gpg")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestValidatePassPath(t *testing.T) {
+	for _, c := range []struct {
+		path  string
+		kind  passPathKind
+		valid bool
+	}{
+		{"/", passPathAny, true},
+		{"/", passPathDir, true},
+		{"/", passPathFile, false},
+		{"/secret/db.gpg", passPathFile, true},
+		{"secret/db.gpg", passPathFile, true},
+		{"/secret//db.gpg", passPathFile, true},
+		{"/secret/db", passPathFile, false},
+		{"/secret/", passPathDir, true},
+		{"/secret.gpg/", passPathDir, false},
+		{"/secret.gpg/db.gpg", passPathFile, false},
+		{"/secret.gpg/db.gpg", passPathAny, true},
+		{"/secret/db.gpg", passPathAny, true},
+		{"/secret/.gpg-id", passPathFile, false},
+		{"/secret/.gpg-id", passPathAny, false},
+		{"/.git/config", passPathAny, false},
+		{"/secret/.hidden.gpg", passPathFile, false},
+		{"/secret/../.gpg-id", passPathAny, false},
+		{"/../x.gpg", passPathFile, false},
+		{"/./x.gpg", passPathFile, false},
+		{"/a\\b.gpg", passPathFile, false},
+		{"/a\x00b.gpg", passPathFile, false},
+		{"/a\nb.gpg", passPathFile, false},
+		{"/a:b.gpg", passPathFile, false},
+		{"/a:b.gpg", passPathAny, true},
+		{"/a\nb.gpg", passPathAny, false},
+		{"/caf\xc3.gpg", passPathFile, false},
+		{"/café.gpg", passPathFile, true},
+		{"/" + strings.Repeat("a", maxPassNameLength) + ".gpg", passPathFile, false},
+		{"/" + strings.Repeat("a", maxPassNameLength) + ".gpg", passPathAny, true},
+		{strings.Repeat("/a", maxPassPathDepth) + ".gpg", passPathFile, true},
+		{strings.Repeat("/a", maxPassPathDepth+1) + ".gpg", passPathFile, false},
+		{strings.Repeat("/abcdefgh", maxPassPathLength/9+1), passPathDir, false},
+	} {
+		if err := validatePassPath(c.path, c.kind); (err == nil) != c.valid {
+			t.Errorf("validatePassPath(%q, %v) = %v, expected valid = %v", c.path, c.kind, err, c.valid)
+		} else if err != nil {
+			if _, ok := err.(VerifyError); !ok {
+				t.Errorf("validatePassPath(%q, %v) returned a %T, expected a VerifyError", c.path, c.kind, err)
+			}
+		}
+	}
+}
+
+func FuzzValidatePassPath(f *testing.F) {
+	for _, s := range []string{"/", "/a/b.gpg", "/a/../b.gpg", "/.gpg-id", "a.gpg/b.gpg", "/a//b/", "\x00"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, p string) {
+		for _, kind := range []passPathKind{passPathAny, passPathFile, passPathDir} {
+			if validatePassPath(p, kind) != nil {
+				continue
+			}
+			clean := strings.TrimPrefix(path.Clean("/"+p), "/")
+			segs := strings.Split(clean, "/")
+			if clean == "" {
+				segs = nil
+			}
+			// existing paths only have to stay in the store
+			creating := kind != passPathAny
+			if creating && len(p) > maxPassPathLength {
+				t.Fatalf("accepted %q, which is too long", p)
+			} else if creating && len(segs) > maxPassPathDepth {
+				t.Fatalf("accepted %q, which is too deep", p)
+			}
+			for i, s := range segs {
+				if strings.HasPrefix(s, ".") {
+					t.Fatalf("accepted %q, which contains a dot segment", p)
+				} else if !creating {
+					continue
+				} else if strings.ContainsAny(s, passPathBadChars) {
+					t.Fatalf("accepted %q, which contains a bad character", p)
+				} else if i < len(segs)-1 && strings.HasSuffix(s, ".gpg") {
+					t.Fatalf("accepted %q, which has a .gpg directory", p)
+				}
+			}
+			// cleaning a valid path must not change it (other than slashes)
+			var kept []string
+			for _, s := range strings.Split(p, "/") {
+				if s != "" {
+					kept = append(kept, s)
+				}
+			}
+			if strings.Join(kept, "/") != clean {
+				t.Fatalf("accepted %q, which cleans to %q", p, clean)
+			}
+			switch kind {
+			case passPathFile:
+				if !strings.HasSuffix(clean, ".gpg") {
+					t.Fatalf("accepted file %q without .gpg", p)
+				}
+			case passPathDir:
+				if strings.HasSuffix(clean, ".gpg") {
+					t.Fatalf("accepted directory %q ending in .gpg", p)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// searchIndexCacheSize is the number of revisions whose path indexes are
+// kept, across all stores.
+const searchIndexCacheSize = 16
+
+// searchIndexes caches searchIndex by the Version of the root of a store,
+// which identifies its contents.
+var searchIndexes = newLRUCache(searchIndexCacheSize)
+
+// Search modes. searchAuto matches terms with glob characters as globs, and
+// others as substrings or, failing that, fuzzily.
+const (
+	searchAuto      = ""
+	searchSubstring = "substring"
+	searchGlob      = "glob"
+	searchFuzzy     = "fuzzy"
+)
+
+// searchEntry is a password in a searchIndex.
+type searchEntry struct {
+	// path is the clean path of the file
+	path string
+	// name is path minus the .gpg, lower case, which queries are matched
+	// against
+	name       string
+	recipients []string
+}
+
+// searchIndex lists the passwords of a revision of a store, with their
+// recipients, so searches don't need to walk it.
+type searchIndex []searchEntry
+
+// searchIndexFor returns the index of the revision of tx, building it the
+// first time.
+func searchIndexFor(tx PassTx) (searchIndex, error) {
+	version, err := tx.Version("/")
+	if err != nil {
+		return nil, err
+	}
+	if ix, ok := searchIndexes.Get(version); ok {
+		return ix.(searchIndex), nil
+	}
+
+	var ix searchIndex
+	recipients := make(map[string][]string)
+	err = PassWalk(tx, "/", func(d PassDirent) error {
+		p := cleanPassPath(d.Name)
+		if !d.File {
+			if isAttachmentDir(tx, p) {
+				return filepath.SkipDir
+			} else if r, err := tx.Recipients(p); err != nil {
+				return err
+			} else {
+				recipients[p] = r
+			}
+		} else if strings.HasSuffix(p, ".gpg") {
+			ix = append(ix, searchEntry{
+				path:       p,
+				name:       strings.ToLower(strings.TrimSuffix(p, ".gpg")),
+				recipients: recipients[cleanPassPath(path.Dir(p))],
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	searchIndexes.Add(version, ix)
+	return ix, nil
+}
+
+// searchResult is a password that matched a query.
+type searchResult struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Score int    `json:"score"`
+}
+
+// search returns the entries of ix that match every term of query in mode,
+// and are encrypted to any of keyIDs, by their score. Their paths are made
+// relative to prefix. skip excludes the entries under some top-level
+// directories.
+func (ix searchIndex) search(query, mode string, keyIDs []string, prefix string, skip map[string]bool) []searchResult {
+	terms := strings.Fields(strings.ToLower(query))
+	var ret []searchResult
+	for _, e := range ix {
+		if skip[strings.SplitN(e.path, "/", 2)[0]] || !containsAny(e.recipients, keyIDs) {
+			continue
+		}
+		score := 0
+		for _, t := range terms {
+			if s := matchTerm(t, e.name, mode); s > 0 {
+				score += s
+			} else {
+				score = 0
+				break
+			}
+		}
+		if score > 0 {
+			p := path.Join("/", prefix, e.path)
+			ret = append(ret, searchResult{Name: apiPassName(p), Path: p, Score: score})
+		}
+	}
+	sortSearchResults(ret)
+	return ret
+}
+
+// sortSearchResults orders results by score, then by shortest path.
+func sortSearchResults(results []searchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		} else if len(a.Path) != len(b.Path) {
+			return len(a.Path) < len(b.Path)
+		}
+		return a.Path < b.Path
+	})
+}
+
+// matchTerm scores how well name matches term, both in lower case; zero is
+// no match. Matches in the base name score above those elsewhere in the
+// path, and substrings above fuzzy matches.
+func matchTerm(term, name, mode string) int {
+	base := path.Base(name)
+	glob := mode == searchGlob || mode == searchAuto && strings.ContainsAny(term, "*?[")
+	switch {
+	case glob:
+		if ok, _ := path.Match(term, base); ok {
+			return 600
+		} else if ok, _ := path.Match(term, name); ok {
+			return 400
+		}
+		return 0
+	case mode == searchFuzzy:
+		return fuzzyScore(term, name)
+	}
+
+	switch i := strings.LastIndex(name, term); {
+	case base == term:
+		return 1000
+	case strings.HasPrefix(base, term):
+		return 800
+	case i >= len(name)-len(base):
+		return 600
+	case i >= 0:
+		return 400
+	case mode == searchAuto:
+		return fuzzyScore(term, name)
+	}
+	return 0
+}
+
+// fuzzyScore scores name having the characters of term in order, less for
+// every gap between them; zero is no match. Scores stay below those of
+// substring matches.
+func fuzzyScore(term, name string) int {
+	best, found := 0, false
+	for start := strings.IndexByte(name, term[0]); start >= 0; {
+		// match greedily from each occurrence of the first character
+		i, gaps, span := start, 0, 0
+		matched := true
+		for j := 0; j < len(term); j++ {
+			k := strings.IndexByte(name[i:], term[j])
+			if k < 0 {
+				matched = false
+				break
+			} else if k > 0 && j > 0 {
+				gaps++
+			}
+			span += k
+			i += k + 1
+		}
+		if !matched {
+			break
+		}
+		if s := 300 - 20*gaps - span; !found || s > best {
+			best, found = s, true
+		}
+		if next := strings.IndexByte(name[start+1:], term[0]); next >= 0 {
+			start += next + 1
+		} else {
+			start = -1
+		}
+	}
+	if !found {
+		return 0
+	} else if best < 1 {
+		return 1
+	}
+	return best
+}
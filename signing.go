@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// recipientSigFile is the detached signature of the .gpg-id file next to it,
+// as written by pass with PASSWORD_STORE_SIGNING_KEY.
+const recipientSigFile = recipientFile + ".sig"
+
+// SignatureError is returned when a .gpg-id file isn't signed by a trusted
+// key. It means the repository was changed behind the server's back.
+type SignatureError struct {
+	Path string
+	Err  error
+}
+
+func (e SignatureError) Error() string {
+	return fmt.Sprintf("%s: bad signature: %v", e.Path, e.Err)
+}
+
+// readKeyRingFile reads an armored key ring from a file.
+func readKeyRingFile(file string) (openpgp.EntityList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return openpgp.ReadArmoredKeyRing(f)
+}
+
+// readSigningKey reads the first private key in an armored key file,
+// decrypting it with passphrase if necessary.
+func readSigningKey(file, passphrase string) (*openpgp.Entity, error) {
+	el, err := readKeyRingFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range el {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, err
+			}
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				if err := sub.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("%s: no private key", file)
+}
+
+// loadSigningConfig reads the signing key and the trusted keys (including
+// the signing key) from the files in config.
+func loadSigningConfig(config Config) (*openpgp.Entity, openpgp.EntityList, error) {
+	var signer *openpgp.Entity
+	var trusted openpgp.EntityList
+	if file := config.Signing.KeyFile; file != "" {
+		var err error
+		if signer, err = readSigningKey(file, config.Signing.Passphrase); err != nil {
+			return nil, nil, err
+		}
+		trusted = append(trusted, signer)
+	}
+	if file := config.Signing.TrustedKeysFile; file != "" {
+		if el, err := readKeyRingFile(file); err != nil {
+			return nil, nil, err
+		} else {
+			trusted = append(trusted, el...)
+		}
+	}
+	return signer, trusted, nil
+}
+
+// SetSigningKey makes the store sign its commits and .gpg-id files with key.
+// key is not trusted automatically; see SetTrustedKeys.
+func (g *GitPass) SetSigningKey(key *openpgp.Entity) {
+	g.signer = key
+}
+
+// SetTrustedKeys sets the keys that .gpg-id files must be signed by. With no
+// trusted keys, signatures are not checked.
+func (g *GitPass) SetTrustedKeys(keys openpgp.EntityList) {
+	g.trusted = keys
+	// the cached recipients were checked against the old keys
+	g.indexes.Purge()
+	searchIndexes.Purge()
+}
+
+// checkRecipientsSignature checks that sig is a signature of the .gpg-id file
+// at p with contents by a trusted key. pass writes binary signatures, but
+// armored ones are accepted too.
+func (g *GitPass) checkRecipientsSignature(p string, contents, sig []byte) error {
+	if len(g.trusted) == 0 {
+		return nil
+	} else if sig == nil {
+		return SignatureError{p, fmt.Errorf("missing %s", recipientSigFile)}
+	} else if _, err := openpgp.CheckDetachedSignature(g.trusted, bytes.NewReader(contents), bytes.NewReader(sig)); err == nil {
+		return nil
+	} else if _, aerr := openpgp.CheckArmoredDetachedSignature(g.trusted, bytes.NewReader(contents), bytes.NewReader(sig)); aerr == nil {
+		return nil
+	} else {
+		return SignatureError{p, err}
+	}
+}
+
+// SignRecipients signs every .gpg-id file that has no signature yet with the
+// signing key, in a single commit, so that a store which was used without a
+// signing key can be used with one. Files with a bad signature are left for
+// an admin to look into. It returns the files that were signed.
+func (g *GitPass) SignRecipients(info CommitInfo) ([]string, error) {
+	if g.signer == nil {
+		return nil, errors.New("no signing key")
+	}
+	txw, err := g.BeginW()
+	if err != nil {
+		return nil, err
+	}
+	tx := txw.(*gitPassTxW)
+	var signed []string
+	err = PassWalk(tx, "/", func(d PassDirent) error {
+		r := path.Join(tx.clean(d.Name), recipientFile)
+		if d.File {
+			return nil
+		} else if contents, err := tx.get(r); err != nil {
+			return nil // inherited
+		} else if _, err := tx.get(r + ".sig"); err == nil {
+			return nil
+		} else {
+			// the recipients are written back as they are, and signed by
+			// Commit
+			tx.changedRecipients[r] = strings.Split(strings.TrimSpace(string(contents)), "\n")
+			signed = append(signed, r)
+		}
+		return nil
+	})
+	if err != nil || len(signed) == 0 {
+		return nil, err
+	}
+	// like any change of recipients, this needs the affected files to be
+	// written again, though their contents stay the same
+	for _, r := range signed {
+		files, err := tx.getAffectedFiles(tx.clean(path.Dir(r)), tx.changedRecipients)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if c, err := tx.get(f); err != nil {
+				return nil, err
+			} else {
+				tx.Put(f, c)
+			}
+		}
+	}
+	return signed, tx.Commit(info)
+}
+
+// signRecipientsCommand signs the unsigned .gpg-id files of the server's git
+// store (see SignRecipients), printing their paths.
+func signRecipientsCommand(config Config) int {
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "sign-recipients: %v\n", err)
+		return 1
+	}
+
+	if config.Signing.KeyFile == "" {
+		return fail(errors.New("no signing key configured"))
+	} else if _, err := os.Stat(config.Git.Root); err != nil {
+		return fail(err)
+	}
+	db, err := initDB(config.DB.Driver, config.DB.DSN)
+	if err != nil {
+		return fail(err)
+	}
+	newPass := NewGitPass
+	if config.Git.Backend == "native" {
+		newPass = NewNativeGitPass
+	}
+	g, err := newPass(config.Git.Root, config.Git.Branch, false)
+	if err != nil {
+		return fail(err)
+	}
+	g.SetKeyResolver(storeKeyResolver(db))
+	g.SetEmailDomain(config.Git.EmailDomain)
+	if signer, trusted, err := loadSigningConfig(config); err != nil {
+		return fail(err)
+	} else {
+		g.SetSigningKey(signer)
+		g.SetTrustedKeys(trusted)
+	}
+
+	signed, err := g.SignRecipients(CommitInfo{Message: "Signed the existing " + recipientFile + " files."})
+	if err != nil {
+		return fail(err)
+	}
+	for _, p := range signed {
+		fmt.Println("/" + p)
+	}
+	fmt.Printf("signed %d %s files\n", len(signed), recipientFile)
+	return 0
+}
+
+// signRecipients signs the pending .gpg-id files, returning the contents of
+// their .gpg-id.sig files.
+func (tx *gitPassTxW) signRecipients() (map[string][]byte, error) {
+	sigs := make(map[string][]byte)
+	if tx.g.signer == nil {
+		return sigs, nil
+	}
+	for p := range tx.changedRecipients {
+		if c := tx.change(p); c != nil {
+			var buf bytes.Buffer
+			if err := openpgp.DetachSign(&buf, tx.g.signer, bytes.NewReader(c), nil); err != nil {
+				return nil, err
+			}
+			sigs[p+".sig"] = buf.Bytes()
+		}
+	}
+	return sigs, nil
+}
+
+// signCommits signs the commits after from, up to ref, like git commit -S.
+// Only the first-parent chain is signed: the other parents of merges (e.g.
+// the commits of a remote) are left as they are. Each commit is rewritten to
+// point to the signed copy of its first parent; the ID of the signed copy of
+// ref is returned.
+func (g *GitPass) signCommits(from, ref string) (string, error) {
+	out, err := g.gitO("rev-list", "--reverse", "--first-parent", from+".."+ref)
+	if err != nil {
+		return "", err
+	}
+	signed := make(map[string]string)
+	var tip string
+	for _, id := range strings.Fields(string(out)) {
+		raw, err := g.gitB("cat-file", "commit", id)
+		if err != nil {
+			return "", err
+		}
+		// the headers end at the first blank line
+		end := bytes.Index(raw, []byte("\n\n"))
+		if end < 0 {
+			end = len(raw) - 1
+		}
+		headers := raw[:end+1]
+		if i := bytes.Index(headers, []byte("\nparent ")); i >= 0 {
+			start := i + len("\nparent ")
+			end := start + bytes.IndexByte(headers[start:], '\n')
+			if new, ok := signed[string(headers[start:end])]; ok {
+				headers = append(append(append([]byte{}, headers[:start]...), new...), headers[end:]...)
+			}
+		}
+		if raw, err = g.signedCommit(append(append([]byte{}, headers...), raw[end+1:]...)); err != nil {
+			return "", err
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := g.gitHelper("hash-object", "-t", "commit", "-w", "--stdin")
+		cmd.Stdin = bytes.NewReader(raw)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return "", GitError{err, stderr.Bytes()}
+		}
+		tip = strings.TrimSpace(stdout.String())
+		signed[id] = tip
+	}
+	return tip, nil
+}
+
+// signedCommit returns a copy of the raw commit with a gpgsig header.
+func (g *GitPass) signedCommit(raw []byte) ([]byte, error) {
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, g.signer, bytes.NewReader(raw), nil); err != nil {
+		return nil, err
+	}
+
+	// the signature is the last header, with continuation lines indented
+	end := bytes.Index(raw, []byte("\n\n"))
+	if end < 0 {
+		end = len(raw) - 1
+	}
+	header := "gpgsig " + strings.Replace(strings.TrimSpace(sig.String()), "\n", "\n ", -1) + "\n"
+	return append(append(append([]byte{}, raw[:end+1]...), header...), raw[end+1:]...), nil
+}
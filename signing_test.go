@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/net/context"
+)
+
+func TestGitPassSigning(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-signing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := initDB("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDefaults(db)
+		key, err := openpgp.NewEntity("pass", "", "pass@example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.SetKeyResolver(storeKeyResolver(db))
+		g.SetSigningKey(key)
+		g.SetTrustedKeys(openpgp.EntityList{key})
+		if tx, err := g.BeginW(); err != nil {
+			t.Fatal(err)
+		} else {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			tx.Put("/a.gpg", encryptForTest(t, "a"))
+			if err := tx.Commit(CommitInfo{UserID: "test", Message: "Set recipients"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the commit is signed (by the same method as git verify-commit)
+		if raw, err := g.gitB("cat-file", "commit", "refs/heads/master"); err != nil {
+			t.Fatal(err)
+		} else if i := bytes.Index(raw, []byte("\ngpgsig ")); i < 0 {
+			t.Fatalf("Commit is not signed:\n%s", raw)
+		} else {
+			end := i + 1 + bytes.Index(raw[i+1:], []byte("\n\n"))
+			sig := strings.Replace(string(raw[i+len("\ngpgsig "):end]), "\n ", "\n", -1)
+			unsigned := append(append([]byte{}, raw[:i+1]...), raw[end+1:]...)
+			if _, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{key}, bytes.NewReader(unsigned), strings.NewReader(sig)); err != nil {
+				t.Fatal("Commit signature doesn't verify: ", err)
+			}
+		}
+		if refs, err := g.gitO("for-each-ref", "refs/pass/"); err != nil || len(refs) != 0 {
+			t.Fatalf("Temporary refs were left behind: %s", refs)
+		}
+
+		// .gpg-id is signed, and the recipients can be read
+		if tx, err := g.Begin(); err != nil {
+			t.Fatal(err)
+		} else if ok, _ := tx.Type(recipientSigFile); !ok {
+			t.Fatal(".gpg-id.sig was not written")
+		} else if r, err := tx.Recipients("/"); err != nil || len(r) != 1 || r[0] != tolar2PublicKeyID {
+			t.Fatalf("Could not read signed recipients: %v, %v", r, err)
+		}
+
+		// recipients changed behind the server's back are refused
+		u := pushForTest(t, g, "refs/heads/master", map[string][]byte{".gpg-id": []byte(tolar2PublicKeyID + "\n0123456789ABCDEF")})
+		if err := g.checkPush(ContextWithStore(ContextWithConfig(context.Background(), Config{}), db), "tolar2", []refUpdate{u}); err == nil {
+			t.Fatal("checkPush accepted an unsigned .gpg-id")
+		} else if err := g.git("update-ref", "refs/heads/master", u.New, u.Old); err != nil {
+			t.Fatal(err)
+		}
+		if tx, err := g.Begin(); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Recipients("/"); err == nil {
+			t.Fatal("Got recipients from a tampered .gpg-id")
+		} else if _, ok := err.(SignatureError); !ok {
+			t.Fatalf("Got unexpected error for a tampered .gpg-id: %v", err)
+		}
+	})
+}
+
+func TestGitPassSignRecipients(t *testing.T) {
+	forEachGitBackend(t, func(t *testing.T, newPass newGitPassFunc) {
+		dir, err := ioutil.TempDir("", "gpm-signing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		db, err := initDB("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDefaults(db)
+		key, err := openpgp.NewEntity("pass", "", "pass@example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a store used without a signing key
+		g, err := newPass(filepath.Join(dir, "repo.git"), "master", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.SetKeyResolver(storeKeyResolver(db))
+		if tx, err := g.BeginW(); err != nil {
+			t.Fatal(err)
+		} else {
+			tx.SetRecipients("/", []string{tolar2PublicKeyID})
+			tx.SetRecipients("/own", []string{tolar2PublicKeyID})
+			tx.Put("/a.gpg", encryptForTest(t, "a"))
+			tx.Put("/own/b.gpg", encryptForTest(t, "b"))
+			if err := tx.Commit(CommitInfo{UserID: "test", Message: "Set recipients"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := g.SignRecipients(CommitInfo{}); err == nil {
+			t.Error("Signed recipients without a signing key")
+		}
+
+		g.SetSigningKey(key)
+		g.SetTrustedKeys(openpgp.EntityList{key})
+		if tx, err := g.Begin(); err != nil {
+			t.Fatal(err)
+		} else if _, err := tx.Recipients("/own"); err == nil {
+			t.Fatal("Got recipients from an unsigned .gpg-id")
+		}
+		if signed, err := g.SignRecipients(CommitInfo{Message: "Sign"}); err != nil {
+			t.Fatal(err)
+		} else if len(signed) != 2 || signed[0] != recipientFile || signed[1] != "own/"+recipientFile {
+			t.Errorf("Signed %v", signed)
+		}
+		if tx, err := g.Begin(); err != nil {
+			t.Fatal(err)
+		} else if r, err := tx.Recipients("/own"); err != nil || len(r) != 1 || r[0] != tolar2PublicKeyID {
+			t.Errorf("Could not read the signed recipients: %v, %v", r, err)
+		} else if exists, _ := tx.Type("/own/b.gpg"); !exists {
+			t.Error("Signing the recipients lost a file")
+		}
+		if signed, err := g.SignRecipients(CommitInfo{Message: "Sign"}); err != nil || len(signed) != 0 {
+			t.Errorf("Signed already signed recipients: %v, %v", signed, err)
+		}
+	})
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -67,6 +70,10 @@ type Store interface {
 	// AddExternalPublicKey adds the key to the store, but doesn't associate it
 	// with any user.
 	AddExternalPublicKey(keyID string, armoredKey []byte) error
+	// PutPublicKey replaces the armored form of an existing public key (for
+	// example, after it has gained new signatures). The owner of the key is
+	// left unchanged.
+	PutPublicKey(keyID string, armoredKey []byte) error
 
 	// GetUserForPublicKey finds the user id owning the given key. If the key
 	// does not belong to any users, GetUserForPublicKey returns the empty
@@ -92,29 +99,143 @@ type Store interface {
 
 	// GetPrivateKey gets information about a private key.
 	GetPrivateKey(keyID string) (user string, armoredKey []byte, err error)
+
+	// AddChangeRequest adds a change request, with its reviewers.
+	AddChangeRequest(c ChangeRequest) error
+	// GetChangeRequest gets a change request, with its reviewers.
+	GetChangeRequest(id string) (ChangeRequest, error)
+	// ListChangeRequests lists the change requests made or reviewed by the
+	// user, newest first.
+	ListChangeRequests(userID string) ([]ChangeRequest, error)
+	// SetChangeRequestStatus changes the status of a change request from
+	// from to status. If it doesn't exist, or its status isn't from (e.g.
+	// because of a concurrent request), sql.ErrNoRows is returned.
+	SetChangeRequestStatus(id, from, status string) error
+	// SetChangeReview records the decision of a reviewer of a change
+	// request.
+	SetChangeReview(id, userID, decision string) error
+}
+
+// ChangeRequest is a change to the passwords that is kept aside (see
+// PassProposer) until another user reviews it.
+type ChangeRequest struct {
+	// ID identifies the change request, and its proposal in the PassStore.
+	ID string `json:"id" db:"id"`
+	// UserID is the ID of the user who made the change.
+	UserID string `json:"userId" db:"uid"`
+	// Message describes the change.
+	Message string `json:"message" db:"message"`
+	// Status is one of the Change constants.
+	Status  string    `json:"status" db:"status"`
+	Created time.Time `json:"created" db:"created"`
+	// Reviewers are the users who may approve or reject the change.
+	Reviewers []ChangeReview `json:"reviewers" db:"-"`
 }
 
+// ChangeReview is a reviewer of a change request.
+type ChangeReview struct {
+	UserID string `json:"userId" db:"uid"`
+	// Decision is ChangeApproved or ChangeRejected once the user has
+	// reviewed the change, and empty until then.
+	Decision string `json:"decision" db:"decision"`
+}
+
+// Statuses of change requests.
+const (
+	ChangeOpen = "open"
+	// ChangeApproved is a change that was approved, but could not be merged
+	// yet.
+	ChangeApproved = "approved"
+	ChangeRejected = "rejected"
+	ChangeMerged   = "merged"
+)
+
 func GetUser(ctx context.Context, userID string) (User, error) {
 	return StoreFromContext(ctx).GetUser(userID)
 }
 
+var (
+	// ErrConflict is returned by PassTxW.Commit when a concurrent transaction
+	// changed the paths the transaction touches.
+	ErrConflict = errors.New("conflicting concurrent change")
+	// ErrUnknownRevision is returned by PassTx.At for revisions that are not
+	// part of the store's history.
+	ErrUnknownRevision = errors.New("unknown revision")
+)
+
+// PassRevision describes a change to a path in a PassStore.
+type PassRevision struct {
+	// Revision identifies the change (for git, the commit ID).
+	Revision string `json:"revision"`
+	// Author is the name of the user who made the change.
+	Author string `json:"author"`
+	// AuthorEmail is the email address of the user who made the change.
+	AuthorEmail string `json:"authorEmail,omitempty"`
+	// Time is when the change was made.
+	Time time.Time `json:"time"`
+	// Message describes the change.
+	Message string `json:"message"`
+	// Version is the Version of the path after the change, or empty if the
+	// change removed it.
+	Version string `json:"version"`
+	// UserID, RequestID and Operation are as given in the CommitInfo of the
+	// change, if known.
+	UserID    string `json:"userId,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	Operation string `json:"operation,omitempty"`
+}
+
+// CommitInfo describes who made the changes of a transaction, and why.
+type CommitInfo struct {
+	// UserID is the ID of the user who made the changes. If empty, the
+	// changes are attributed to the server itself.
+	UserID string
+	// UserName is the display name of the user.
+	UserName string
+	// Message describes the changes.
+	Message string
+	// RequestID identifies the API request that made the changes, to match
+	// them with the server's logs.
+	RequestID string
+	// Operation is the kind of change; see the Op constants.
+	Operation string
+}
+
+// Operations recorded in CommitInfo.
+const (
+	OpPut       = "put"
+	OpDelete    = "delete"
+	OpReencrypt = "reencrypt"
+	OpRestore   = "restore"
+	OpMove      = "move"
+	OpMkdir     = "mkdir"
+	OpMerge     = "merge"
+	OpBatch     = "batch"
+	OpAttach    = "attach"
+)
+
 type PassDirent struct {
 	File bool
 	Name string
 }
 
-// PassTx represents a read-only transaction on a PassStore.
+// PassTx represents a read-only transaction on a PassStore. Like pass, each
+// directory's recipients are kept in a .gpg-id file; these files are not
+// included by List or Walk, but can be read with Type and Get.
 type PassTx interface {
 	// Type determines the whether path exists and if it's a file or directory.
 	Type(path string) (exists bool, file bool)
 
+	// Version returns an opaque identifier of the current contents of path,
+	// which may be a file or a directory. It changes whenever the contents
+	// (or, for directories, anything below it) change.
+	Version(path string) (string, error)
+
 	// List lists files in a directory. The Name of each PassDirent is the
-	// basename of each file, not its full path. List will not be affect by Put
-	// and Delete.
+	// basename of each file, not its full path.
 	List(path string) ([]PassDirent, error)
 
-	// Get gets a specific file. It is an error to call Get on a path that has
-	// been previously written to in the same transaction.
+	// Get gets a specific file.
 	Get(path string) ([]byte, error)
 
 	// Recipients gets the list of recipients (key IDs) path (and possibly
@@ -125,18 +246,30 @@ type PassTx interface {
 	// of recipients at path. These are the files that need to be reencrpted
 	// and passed to SetRecipients.
 	GetAffectedFiles(path string) ([]string, error)
+
+	// History lists the changes to path (a file or a directory), newest
+	// first, up to and including the transaction's own revision. path does
+	// not need to exist anymore.
+	History(path string) ([]PassRevision, error)
+
+	// At returns a read-only view of the store as of revision, which must be
+	// the transaction's own revision or an earlier one (such as those
+	// reported by History). Other revisions result in ErrUnknownRevision.
+	At(revision string) (PassTx, error)
 }
 
 // PassTxW represents a write transaction on a PassStore. No explicit actions
 // are required to roll back an uncommitted transaction.
 type PassTxW interface {
-	// A writeable transaction is not required to include writes in future
-	// reads: writing or deleting a file and then reading it later will likely
-	// produce unexpected results.
+	// Reads include the changes the transaction has made so far, as Commit
+	// would write them (except for History and At, which only see committed
+	// revisions). Versions of changed paths are only meaningful within the
+	// transaction.
 	PassTx
 
-	// Put puts a specific file. path must end with .gpg, and all parent
-	// directories must not end with .gpg.
+	// Put puts a specific file. Unless the file exists already, path must end
+	// with .gpg, and all parent directories must not end with .gpg (see
+	// validatePassPath). Invalid paths cause Commit to fail.
 	Put(path string, contents []byte)
 
 	// Delete removes a specific file (or directory).
@@ -147,8 +280,22 @@ type PassTxW interface {
 	// files must be re-saved using Put or deleted with Delete.
 	SetRecipients(path string, recipients []string)
 
-	// Commit writes the changes to the repository to disk.
-	Commit(userName, message string) error
+	// Mkdir creates an empty directory at path, which must not end with .gpg.
+	// It has no effect if path already exists.
+	Mkdir(path string)
+
+	// Move moves a file or directory, with everything in it, from src to dst.
+	// dst must not exist, and must not be inside src. The moved files are
+	// verified at their new paths, so any whose recipients change must be
+	// re-saved using Put.
+	Move(src, dst string) error
+
+	// Commit writes the changes to the repository to disk. If the changes are
+	// rejected (e.g., a file is not encrypted to the recipients of its
+	// directory), the returned error is a VerifyError. If another transaction
+	// committed changes to the same paths first, ErrConflict is returned;
+	// concurrent changes to unrelated paths are merged.
+	Commit(info CommitInfo) error
 }
 
 type PassStore interface {
@@ -160,6 +307,30 @@ type PassWalker interface {
 	Walk(root string, fn PassWalkFn) error
 }
 
+// PassChangeTracker is implemented by transactions that can find the last
+// changes to many paths faster than calling History for each.
+type PassChangeTracker interface {
+	// LastChanges returns the newest revision History would return for each
+	// of paths that has any, by its clean path.
+	LastChanges(paths []string) (map[string]PassRevision, error)
+}
+
+// lastChanges returns the newest revision in the history of each of paths.
+func lastChanges(tx PassTx, paths []string) (map[string]PassRevision, error) {
+	if tracker, ok := tx.(PassChangeTracker); ok {
+		return tracker.LastChanges(paths)
+	}
+	ret := make(map[string]PassRevision, len(paths))
+	for _, p := range paths {
+		if revs, err := tx.History(p); err != nil {
+			return nil, err
+		} else if len(revs) > 0 {
+			ret[cleanPassPath(p)] = revs[0]
+		}
+	}
+	return ret, nil
+}
+
 // PassStoreWalkFn is the function called by PassStore; the Name field of p is
 // the full path of the file.
 // Returning filepath.SkipDir will skip a directory. Any other errors are
@@ -170,30 +341,41 @@ func PassWalk(ps PassTx, root string, fn PassWalkFn) error {
 	if walker, ok := ps.(PassWalker); ok {
 		return walker.Walk(root, fn)
 	} else {
-		q := []PassDirent{{
-			Name: "/",
-			File: false,
-		}}
-		var d PassDirent
-		for len(q) > 0 {
-			d, q = q[0], q[1:]
-			if err := fn(d); err == filepath.SkipDir {
-				continue
-			} else if err != nil {
+		return walkPassTx(ps, root, fn)
+	}
+}
+
+// walkPassTx walks ps with Type and List, for stores that don't implement
+// PassWalker.
+func walkPassTx(ps PassTx, root string, fn PassWalkFn) error {
+	root = cleanPassPath(root)
+	exists, isFile := ps.Type(root)
+	if !exists {
+		return os.ErrNotExist
+	}
+	q := []PassDirent{{
+		Name: root,
+		File: isFile,
+	}}
+	var d PassDirent
+	for len(q) > 0 {
+		d, q = q[0], q[1:]
+		if err := fn(d); err == filepath.SkipDir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !d.File {
+			// this is a directory, recurse
+			if l, err := ps.List(d.Name); err != nil {
 				return err
-			}
-			if !d.File {
-				// this is a directory, recurse
-				if l, err := ps.List(d.Name); err != nil {
-					return err
-				} else {
-					for _, f := range l {
-						f.Name = path.Join(d.Name, f.Name)
-						q = append(q, f)
-					}
+			} else {
+				for _, f := range l {
+					f.Name = path.Join(d.Name, f.Name)
+					q = append(q, f)
 				}
 			}
 		}
-		return nil
 	}
+	return nil
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 )
 
 func testStores(t *testing.T, s Store) {
@@ -15,16 +17,16 @@ func testStores(t *testing.T, s Store) {
 					ID:   "user1",
 					Name: "User 1",
 				},
-				PublicKeys: map[string][]byte{
-					"pubkey1": []byte(`pubkey1`),
-					"pubkey2": []byte(`pubkey2`),
+				PublicKeys: []keyResponse{
+					{KeyID: "pubkey1", Armored: []byte(`pubkey1`)},
+					{KeyID: "pubkey2", Armored: []byte(`pubkey2`)},
 				},
 			},
 			Password:              []byte("user1"),
 			RequiresPasswordReset: true,
-			PrivateKeys: map[string][]byte{
-				"prikey1": []byte(`prikey1`),
-				"prikey2": []byte(`prikey2`),
+			PrivateKeys: []keyResponse{
+				{KeyID: "prikey1", Armored: []byte(`prikey1`)},
+				{KeyID: "prikey2", Armored: []byte(`prikey2`)},
 			},
 		},
 		User{
@@ -33,16 +35,16 @@ func testStores(t *testing.T, s Store) {
 					ID:   "user2",
 					Name: "User 2",
 				},
-				PublicKeys: map[string][]byte{
-					"pubkey3": []byte(`pubkey3`),
-					"pubkey4": []byte(`pubkey4`),
+				PublicKeys: []keyResponse{
+					{KeyID: "pubkey3", Armored: []byte(`pubkey3`)},
+					{KeyID: "pubkey4", Armored: []byte(`pubkey4`)},
 				},
 			},
 			Password:              []byte("user2"),
 			RequiresPasswordReset: false,
-			PrivateKeys: map[string][]byte{
-				"prikey3": []byte(`prikey3`),
-				"prikey4": []byte(`prikey4`),
+			PrivateKeys: []keyResponse{
+				{KeyID: "prikey3", Armored: []byte(`prikey3`)},
+				{KeyID: "prikey4", Armored: []byte(`prikey4`)},
 			},
 		},
 	}
@@ -54,14 +56,14 @@ func testStores(t *testing.T, s Store) {
 		if err := s.PostUser(u); err != nil {
 			t.Fatalf("Got unexpected error when creating user %q: %v", u.ID, err)
 		}
-		for k, v := range u.PublicKeys {
-			if err := s.AddPublicKey(u.ID, k, v); err != nil {
-				t.Fatalf("Got unexpected error when adding public key %q to user %q: %v", k, u.ID, err)
+		for _, k := range u.PublicKeys {
+			if err := s.AddPublicKey(u.ID, k.KeyID, k.Armored); err != nil {
+				t.Fatalf("Got unexpected error when adding public key %q to user %q: %v", k.KeyID, u.ID, err)
 			}
 		}
-		for k, v := range u.PrivateKeys {
-			if err := s.AddPrivateKey(u.ID, k, v); err != nil {
-				t.Fatalf("Got unexpected error when adding private key %q to user %q: %v", k, u.ID, err)
+		for _, k := range u.PrivateKeys {
+			if err := s.AddPrivateKey(u.ID, k.KeyID, k.Armored); err != nil {
+				t.Fatalf("Got unexpected error when adding private key %q to user %q: %v", k.KeyID, u.ID, err)
 			}
 		}
 	}
@@ -70,6 +72,16 @@ func testStores(t *testing.T, s Store) {
 		t.Fatalf("Got unexpected error when adding external public key: %v", err)
 	}
 
+	if err := s.PutPublicKey("pubkey1", []byte("pubkey1")); err != nil {
+		t.Fatalf("Got unexpected error when updating public key: %v", err)
+	} else if err := s.PutPublicKey("pubkeyMissing", []byte("pubkeyMissing")); err != ErrUnknownKey {
+		t.Fatalf("Got unexpected error when updating unknown public key: %v != %v", err, ErrUnknownKey)
+	} else if u, armored, err := s.GetPublicKey("pubkey1"); err != nil {
+		t.Fatalf("Got unexpected error when getting updated public key: %v", err)
+	} else if u != "user1" || !bytes.Equal(armored, []byte("pubkey1")) {
+		t.Fatalf("Updating a public key changed its owner or contents: %q, %q", u, armored)
+	}
+
 	if users, err := s.ListUsers(); err != nil {
 		t.Fatal("Got unexpected error when listing users:", err)
 	} else if len(users) != 2 {
@@ -192,6 +204,46 @@ func testStores(t *testing.T, s Store) {
 		t.Fatalf("RequiresPasswordReset didn't update when modifying user: %v != %v", u.RequiresPasswordReset, false)
 	}
 
+	change := ChangeRequest{
+		ID:        "change1",
+		UserID:    "user1",
+		Message:   "change",
+		Status:    ChangeOpen,
+		Created:   time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC),
+		Reviewers: []ChangeReview{{UserID: "user2"}},
+	}
+	if err := s.AddChangeRequest(change); err != nil {
+		t.Fatal("Got unexpected error when adding change request:", err)
+	} else if err := s.SetChangeReview("change1", "user2", ChangeApproved); err != nil {
+		t.Fatal("Got unexpected error when reviewing change request:", err)
+	} else if err := s.SetChangeReview("change1", "user1", ChangeApproved); err != sql.ErrNoRows {
+		t.Fatal("Got unexpected error when reviewing change request by a non-reviewer:", err)
+	} else if err := s.SetChangeRequestStatus("change1", ChangeOpen, ChangeApproved); err != nil {
+		t.Fatal("Got unexpected error when setting change request status:", err)
+	} else if err := s.SetChangeRequestStatus("change1", ChangeOpen, ChangeRejected); err != sql.ErrNoRows {
+		t.Fatal("Got unexpected error when setting status of a change request that has another:", err)
+	} else if err := s.SetChangeRequestStatus("change2", ChangeOpen, ChangeApproved); err != sql.ErrNoRows {
+		t.Fatal("Got unexpected error when setting status of unknown change request:", err)
+	} else if _, err := s.GetChangeRequest("change2"); err != sql.ErrNoRows {
+		t.Fatal("Got unexpected error when getting unknown change request:", err)
+	}
+	change.Status = ChangeApproved
+	change.Reviewers[0].Decision = ChangeApproved
+	if c, err := s.GetChangeRequest("change1"); err != nil {
+		t.Fatal("Got unexpected error when getting change request:", err)
+	} else if !c.Created.Equal(change.Created) {
+		t.Fatalf("Got unexpected creation time: %v != %v", c.Created, change.Created)
+	} else if c.Created = change.Created; !reflect.DeepEqual(c, change) {
+		t.Fatalf("Got unexpected change request: %+v != %+v", c, change)
+	}
+	for _, id := range []string{"user1", "user2"} {
+		if l, err := s.ListChangeRequests(id); err != nil {
+			t.Fatal("Got unexpected error when listing change requests:", err)
+		} else if len(l) != 1 || l[0].ID != "change1" {
+			t.Fatalf("Got unexpected change requests for %s: %+v", id, l)
+		}
+	}
+
 	if err := s.DeleteUser("user1"); err != nil {
 		t.Fatal("Got unexpected error when removing user:", err)
 	} else if _, err := s.GetUser("user1"); err == nil {
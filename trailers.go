@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trailers recorded at the end of commit messages, in git's "Key: value"
+// trailer format (as parsed by git interpret-trailers).
+const (
+	trailerUserID    = "User-Id"
+	trailerRequestID = "Request-Id"
+	trailerOperation = "Operation"
+)
+
+// formatTrailers returns the commit message for info: its Message, followed
+// by a paragraph of trailers for the fields that are set.
+func formatTrailers(info CommitInfo) string {
+	var trailers []string
+	for _, t := range []struct{ key, value string }{
+		{trailerUserID, info.UserID},
+		{trailerRequestID, info.RequestID},
+		{trailerOperation, info.Operation},
+	} {
+		if v := strings.Join(strings.Fields(t.value), " "); v != "" {
+			trailers = append(trailers, fmt.Sprintf("%s: %s", t.key, v))
+		}
+	}
+	message := strings.TrimSpace(info.Message)
+	if len(trailers) == 0 {
+		return message
+	}
+	return message + "\n\n" + strings.Join(trailers, "\n")
+}
+
+// parseTrailers splits a commit message into its body and the trailers in
+// its last paragraph. The first paragraph (the subject) is never taken as
+// trailers, and neither is a last paragraph with anything but trailers.
+func parseTrailers(message string) (string, map[string]string) {
+	message = strings.TrimRight(message, " \t\n")
+	i := strings.LastIndex(message, "\n\n")
+	if i < 0 {
+		return strings.TrimSpace(message), nil
+	}
+	body, last := message[:i], message[i+2:]
+
+	trailers := make(map[string]string)
+	for _, line := range strings.Split(last, "\n") {
+		i := strings.Index(line, ": ")
+		if i <= 0 || strings.IndexFunc(line[:i], func(r rune) bool {
+			return !(r == '-' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z')
+		}) >= 0 {
+			return strings.TrimSpace(message), nil
+		}
+		trailers[line[:i]] = strings.TrimSpace(line[i+2:])
+	}
+	return strings.TrimSpace(body), trailers
+}
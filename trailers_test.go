@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatTrailers(t *testing.T) {
+	for _, c := range []struct {
+		info    CommitInfo
+		message string
+	}{
+		{CommitInfo{Message: "Update"}, "Update"},
+		{
+			CommitInfo{UserID: "tolar2", Message: "Removed a.gpg.\n", RequestID: "host/abc-1", Operation: OpDelete},
+			"Removed a.gpg.\n\nUser-Id: tolar2\nRequest-Id: host/abc-1\nOperation: delete",
+		},
+		{CommitInfo{UserID: "with\nnewline", Operation: OpPut}, "\n\nUser-Id: with newline\nOperation: put"},
+	} {
+		if m := formatTrailers(c.info); m != c.message {
+			t.Errorf("formatTrailers(%+v) = %q, expected %q", c.info, m, c.message)
+		}
+	}
+}
+
+func TestParseTrailers(t *testing.T) {
+	for _, c := range []struct {
+		message  string
+		body     string
+		trailers map[string]string
+	}{
+		{"Update", "Update", nil},
+		{"Note: only a subject", "Note: only a subject", nil},
+		{"Subject\n\nSee: this, and more\nthat", "Subject\n\nSee: this, and more\nthat", nil},
+		{"Subject\n\nA: b\nC-d: e\n", "Subject", map[string]string{"A": "b", "C-d": "e"}},
+		{"Subject\n\nBody\n\nUser-Id: tolar2", "Subject\n\nBody", map[string]string{"User-Id": "tolar2"}},
+		{"\n\nOperation: put", "", map[string]string{"Operation": "put"}},
+	} {
+		if body, trailers := parseTrailers(c.message); body != c.body || !reflect.DeepEqual(trailers, c.trailers) {
+			t.Errorf("parseTrailers(%q) = %q, %v; expected %q, %v", c.message, body, trailers, c.body, c.trailers)
+		}
+	}
+
+	// parsing undoes formatting
+	info := CommitInfo{UserID: "tolar2", Message: "Moved /a to /b.", RequestID: "host/abc-1", Operation: OpMove}
+	if body, trailers := parseTrailers(formatTrailers(info)); body != info.Message || trailers[trailerUserID] != info.UserID || trailers[trailerRequestID] != info.RequestID || trailers[trailerOperation] != info.Operation {
+		t.Errorf("parseTrailers didn't return what formatTrailers was given: %q, %v", body, trailers)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrNotCertified = errors.New("key is not certified by the organization key")
+)
+
+// UncertifiedKeyError is returned when a recipient key does not carry a valid
+// certification from the organization key.
+type UncertifiedKeyError struct {
+	KeyID string
+	Err   error
+}
+
+func (e UncertifiedKeyError) Error() string {
+	return fmt.Sprintf("recipient key %s is not certified by the organization key: %v", e.KeyID, e.Err)
+}
+
+func readSingleKey(armoredKey []byte) (*openpgp.Entity, error) {
+	if el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKey)); err != nil {
+		return nil, err
+	} else if len(el) != 1 {
+		return nil, fmt.Errorf("expected 1 key, found %d", len(el))
+	} else {
+		return el[0], nil
+	}
+}
+
+// certifiedBy returns nil if any identity of key carries a valid
+// certification signature made by org.
+func certifiedBy(key, org *openpgp.Entity) error {
+	orgID := org.PrimaryKey.KeyId
+	for _, ident := range key.Identities {
+		for _, sig := range ident.Signatures {
+			if sig.IssuerKeyId == nil || *sig.IssuerKeyId != orgID {
+				continue
+			}
+			if err := org.PrimaryKey.VerifyUserIdSignature(ident.Name, key.PrimaryKey, sig); err == nil {
+				return nil
+			}
+		}
+	}
+	return ErrNotCertified
+}
+
+// orgKey loads the organization certification key. It returns nil if the
+// signing policy is disabled.
+func orgKey(ctx context.Context) (*openpgp.Entity, error) {
+	keyID := ConfigFromContext(ctx).Trust.OrgKeyID
+	if keyID == "" {
+		return nil, nil
+	} else if _, armored, err := StoreFromContext(ctx).GetPublicKey(keyID); err != nil {
+		return nil, fmt.Errorf("could not load organization key %s: %v", keyID, err)
+	} else {
+		return readSingleKey(armored)
+	}
+}
+
+// checkRecipientsCertified verifies that every key in recipients has been
+// certified by the organization key. If the policy is disabled, it always
+// succeeds. Keys failing the check are reported as an UncertifiedKeyError.
+func checkRecipientsCertified(ctx context.Context, recipients []string) error {
+	org, err := orgKey(ctx)
+	if err != nil || org == nil {
+		return err
+	}
+	store := StoreFromContext(ctx)
+	for _, keyID := range recipients {
+		if _, armored, err := store.GetPublicKey(keyID); err == sql.ErrNoRows {
+			return UncertifiedKeyError{keyID, ErrUnknownKey}
+		} else if err != nil {
+			return err
+		} else if key, err := readSingleKey(armored); err != nil {
+			return UncertifiedKeyError{keyID, err}
+		} else if err := certifiedBy(key, org); err != nil {
+			return UncertifiedKeyError{keyID, err}
+		}
+	}
+	return nil
+}
+
+func isAdmin(ctx context.Context) bool {
+	u := UserFromContext(ctx)
+	for _, id := range ConfigFromContext(ctx).Admins {
+		if id == u.ID {
+			return true
+		}
+	}
+	return false
+}
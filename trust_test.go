@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"goji.io/pat"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// armorForTest returns the armored public key of e.
+func armorForTest(t *testing.T, e *openpgp.Entity) []byte {
+	var armored bytes.Buffer
+	if w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil); err != nil {
+		t.Fatal(err)
+	} else if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	} else {
+		w.Close()
+	}
+	return armored.Bytes()
+}
+
+// certifyForTest certifies every identity of e with org.
+func certifyForTest(t *testing.T, e, org *openpgp.Entity) {
+	for name := range e.Identities {
+		if err := e.SignIdentity(name, org, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// trustForTest makes the requests of h require recipients certified by a new
+// organization key, which it returns.
+func trustForTest(t *testing.T, h *handlerTest) *openpgp.Entity {
+	org, err := openpgp.NewEntity("org", "", "org@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StoreFromContext(h.ctx).AddExternalPublicKey(org.PrimaryKey.KeyIdString(), armorForTest(t, org)); err != nil {
+		t.Fatal(err)
+	}
+	config := ConfigFromContext(h.ctx)
+	config.Trust.OrgKeyID = org.PrimaryKey.KeyIdString()
+	config.Admins = []string{"tolar2"}
+	h.ctx = ContextWithConfig(h.ctx, config)
+	return org
+}
+
+func TestCertifiedBy(t *testing.T) {
+	org, err := openpgp.NewEntity("org", "", "org@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := openpgp.NewEntity("user", "", "user@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certifiedBy(key, org); err != ErrNotCertified {
+		t.Errorf("Uncertified key: %v", err)
+	}
+	certifyForTest(t, key, other)
+	if err := certifiedBy(key, org); err != ErrNotCertified {
+		t.Errorf("Key certified by another key: %v", err)
+	}
+	certifyForTest(t, key, org)
+	if err := certifiedBy(key, org); err != nil {
+		t.Errorf("Certified key: %v", err)
+	}
+	// the certification must survive being stored and read back
+	if read, err := readSingleKey(armorForTest(t, key)); err != nil {
+		t.Fatal(err)
+	} else if err := certifiedBy(read, org); err != nil {
+		t.Errorf("Certified key read back: %v", err)
+	}
+}
+
+func TestCheckRecipientsCertified(t *testing.T) {
+	h := newHandlerTest(t)
+	h.mux.HandleFuncC(pat.Post("/api/passPerm/*"), mounted(handlePostPerm))
+	db := StoreFromContext(h.ctx)
+	_, certified := h.addUser("certified")
+	_, uncertified := h.addUser("uncertified")
+	org := trustForTest(t, h)
+	certifyForTest(t, certified, org)
+	if err := db.PutPublicKey(certified.PrimaryKey.KeyIdString(), armorForTest(t, certified)); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := h.ps.BeginW(); err != nil {
+		t.Fatal(err)
+	} else {
+		tx.Mkdir("perm")
+		tx.Mkdir("batch")
+		if err := tx.Commit(CommitInfo{Message: "Add directories"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recipients := func(p string) []string {
+		tx, err := h.ps.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := tx.Recipients(p)
+		return r
+	}
+	uncertifiedID := uncertified.PrimaryKey.KeyIdString()
+	certifiedID := certified.PrimaryKey.KeyIdString()
+
+	type perm struct {
+		Access []string `json:"access"`
+	}
+	if rw := h.do("POST", "/api/passPerm/perm", perm{[]string{uncertifiedID}}, nil); rw.Code != http.StatusBadRequest || !bytes.Contains(rw.Body.Bytes(), []byte(uncertifiedID)) {
+		t.Errorf("POST of an uncertified recipient: %d %s", rw.Code, rw.Body)
+	} else if r := recipients("perm"); len(r) != 1 || r[0] != tolar2PublicKeyID {
+		t.Errorf("POST of an uncertified recipient set %v", r)
+	}
+	if rw := h.do("POST", "/api/passPerm/perm", perm{[]string{certifiedID}}, nil); rw.Code != http.StatusOK {
+		t.Errorf("POST of a certified recipient: %d %s", rw.Code, rw.Body)
+	} else if r := recipients("perm"); len(r) != 1 || r[0] != certifiedID {
+		t.Errorf("POST of a certified recipient set %v", r)
+	}
+
+	var response batchResponse
+	batch := func(recipients ...string) int {
+		response = batchResponse{}
+		rw := h.do("POST", "/api/batch", batchRequest{[]batchOperation{{Op: "setRecipients", Path: "batch", Recipients: recipients}}, "batch"}, nil)
+		if err := json.Unmarshal(rw.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%v\n%s", err, rw.Body)
+		}
+		return rw.Code
+	}
+	if code := batch(uncertifiedID); code != http.StatusBadRequest || len(response.Results) != 1 || response.Results[0].Status != http.StatusBadRequest {
+		t.Errorf("Batch with an uncertified recipient: %d %+v", code, response)
+	} else if !bytes.Contains([]byte(response.Results[0].Error), []byte(uncertifiedID)) {
+		t.Errorf("Batch with an uncertified recipient didn't name it: %+v", response.Results[0])
+	} else if r := recipients("batch"); len(r) != 1 || r[0] != tolar2PublicKeyID {
+		t.Errorf("Batch with an uncertified recipient set %v", r)
+	}
+	if code := batch(certifiedID); code != http.StatusOK {
+		t.Errorf("Batch with a certified recipient: %d %+v", code, response)
+	} else if r := recipients("batch"); len(r) != 1 || r[0] != certifiedID {
+		t.Errorf("Batch with a certified recipient set %v", r)
+	}
+}
@@ -16,7 +16,7 @@ func getRecipients(r io.Reader) ([]string, error) {
 			return nil, err
 		}
 		if key, ok := p.(*packet.EncryptedKey); ok {
-			ret = append(ret, fmt.Sprintf("%X", key.KeyId))
+			ret = append(ret, fmt.Sprintf("%016X", key.KeyId))
 		} else {
 			// According to RFC 4880 section 11.3, encrypted keys must be the
 			// first thing in the file. If we get a packet that isn't a key,
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// VerifyError is returned by PassTxW.Commit when a pending change does not
+// conform to the store's rules. It is the caller's fault, not the server's.
+type VerifyError struct {
+	// Path is the path of the offending file or directory.
+	Path string
+	// Reason is a human-readable description of the problem.
+	Reason string
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+}
+
+// readEncryptedKeyIDs parses r as an OpenPGP encrypted message and returns the
+// key IDs it is encrypted to. Unlike getRecipients, it requires the key
+// packets to be followed by encrypted data.
+func readEncryptedKeyIDs(r io.Reader) ([]string, error) {
+	pr := packet.NewReader(r)
+	var ret []string
+	for {
+		p, err := pr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("missing encrypted data")
+		} else if err != nil {
+			return nil, err
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			ret = append(ret, fmt.Sprintf("%016X", p.KeyId))
+		case *packet.SymmetricallyEncrypted:
+			return ret, nil
+		default:
+			return nil, fmt.Errorf("unexpected %T packet", p)
+		}
+	}
+}
+
+// normalizeKeyID converts the ways a key can be named in a .gpg-id file
+// (long key ID or fingerprint, with or without 0x) to the long key ID form
+// used by getRecipients.
+func normalizeKeyID(k string) string {
+	k = strings.ToUpper(strings.TrimSpace(k))
+	k = strings.TrimPrefix(k, "0X")
+	if len(k) > 16 {
+		k = k[len(k)-16:]
+	}
+	return k
+}
+
+// KeyResolver returns every key ID (the primary key and its subkeys) that a
+// message encrypted to recipient may name. It returns nil for unknown
+// recipients.
+type KeyResolver func(recipient string) []string
+
+// storeKeyResolver resolves recipients using the public keys in s.
+func storeKeyResolver(s Store) KeyResolver {
+	return func(recipient string) []string {
+		if _, armored, err := s.GetPublicKey(normalizeKeyID(recipient)); err != nil {
+			return nil
+		} else if e, err := readSingleKey(armored); err != nil {
+			return nil
+		} else {
+			ret := []string{e.PrimaryKey.KeyIdString()}
+			for _, sub := range e.Subkeys {
+				ret = append(ret, sub.PublicKey.KeyIdString())
+			}
+			return ret
+		}
+	}
+}
+
+// matchKeyIDs determines if a message encrypted to the keys in encrypted is
+// encrypted to exactly recipients: every recipient must have one of its keys
+// in encrypted, and every key in encrypted must belong to a recipient.
+func matchKeyIDs(encrypted, recipients []string, resolve KeyResolver) bool {
+	owner := keyOwners(recipients, resolve)
+	found := make(map[string]bool)
+	for _, k := range encrypted {
+		if r, ok := owner[normalizeKeyID(k)]; !ok {
+			return false
+		} else {
+			found[r] = true
+		}
+	}
+	for _, r := range recipients {
+		if !found[normalizeKeyID(r)] {
+			return false
+		}
+	}
+	return true
+}
+
+// keyOwners maps the key IDs of recipients (normalized, including the
+// subkeys resolve finds) to the normalized recipient they belong to.
+func keyOwners(recipients []string, resolve KeyResolver) map[string]string {
+	owner := make(map[string]string)
+	for _, r := range recipients {
+		r = normalizeKeyID(r)
+		owner[r] = r
+		if resolve != nil {
+			for _, k := range resolve(r) {
+				owner[normalizeKeyID(k)] = r
+			}
+		}
+	}
+	return owner
+}
+
+// verifyCiphertext checks that contents is an OpenPGP message encrypted to
+// exactly recipients. resolve may be nil, in which case the message must name
+// the recipients' key IDs directly.
+func verifyCiphertext(p string, contents []byte, recipients []string, resolve KeyResolver) error {
+	if len(recipients) == 0 {
+		return VerifyError{p, "no recipients configured"}
+	} else if keys, err := readEncryptedKeyIDs(bytes.NewReader(contents)); err != nil {
+		return VerifyError{p, fmt.Sprintf("not an OpenPGP encrypted file: %v", err)}
+	} else if !matchKeyIDs(keys, recipients, resolve) {
+		return VerifyError{p, fmt.Sprintf("encrypted to %v, expected %v", keys, recipients)}
+	}
+	return nil
+}